@@ -2,35 +2,140 @@ package main
 
 import (
   "flag"
+  "fmt"
   "github.com/hajimehoshi/ebiten/v2"
   "jfeintzeig/gameboy/internal/cpu"
+  "jfeintzeig/gameboy/internal/display"
   "log"
+  "os"
+  "os/signal"
 )
 
 var (
   file *string
   bootrom *bool
+  bootromFile *string
+  model *string
   fast *bool
-//  debug *bool
+  mute *bool
+  record *string
+  recordStems *bool
+  info *bool
+  screenshotScale *int
+  rewindMB *int
+  rewindInterval *uint64
+  debug *bool
+  sym *string
+  trace *string
 )
 
 func init() {
   file = flag.String("file","data/Tetris.gb","path to file to load")
   bootrom = flag.Bool("bootrom",false,"set to true to use bootrom")
+  bootromFile = flag.String("bootrom-file","","path to a DMG0/DMG/MGB/SGB/CGB boot ROM to run first (implies -bootrom)")
+  model = flag.String("model","DMG","hardware state to start in when skipping the boot ROM: DMG0, DMG, MGB, SGB, SGB2 or CGB")
   fast = flag.Bool("fast",false,"set to true to make it faster than realtime")
+  mute = flag.Bool("mute",false,"set to true to disable audio output")
+  record = flag.String("record","","path of a WAV file to record audio to (R toggles recording too)")
+  recordStems = flag.Bool("record-stems",false,"set to true to also record one WAV file per sound channel")
+  info = flag.Bool("info",false,"print the cartridge header and exit")
+  screenshotScale = flag.Int("screenshot-scale",1,"integer scale of the PNGs the P key saves next to the ROM")
+  rewindMB = flag.Int("rewind-mb",cpu.DefaultRewindConfig.MaxBytes >> 20,"megabytes of history to keep for rewinding with backspace, 0 to turn rewind off")
+  rewindInterval = flag.Uint64("rewind-interval",cpu.DefaultRewindConfig.Interval,"frames between rewind snapshots, each backspace step goes back this far")
+  debug = flag.Bool("debug",false,"start paused in the debugger, which reads commands from the terminal (try help)")
+  trace = flag.String("trace","","path of a gameboy-doctor log to write, one line per instruction (LY reads 0x90 while tracing)")
+  sym = flag.String("sym","","RGBDS/BGB .sym file with labels for -debug (default the ROM's .sym, if there is one)")
 }
 
 func main() {
   flag.Parse()
 
-  gb := cpu.NewGameBoy(file, *bootrom, *fast)
+  if *info {
+    header, err := cpu.ReadCartridgeHeader(*file)
+    if err != nil {
+      log.Fatal(err)
+    }
+    fmt.Print(header)
+    return
+  }
+
+  bootROMPath := *bootromFile
+  if *bootrom && bootROMPath == "" {
+    bootROMPath = "data/bootrom_dmg.gb"
+  }
+  startModel, err := cpu.ParseModel(*model)
+  if err != nil {
+    log.Fatal(err)
+  }
+  gb, err := cpu.NewGameBoy(file, bootROMPath, startModel, *fast)
+  if err != nil {
+    log.Fatal(err)
+  }
 
   ebiten.SetWindowSize(800, 720)
-  ebiten.SetWindowTitle("Hello, World!")
-  game, _ := cpu.NewEbitenGame(gb)
+  ebiten.SetWindowTitle(gb.Bus.CartridgeHeader().Title)
+  game, err := display.NewEbitenGame(gb, !*mute)
+  if err != nil {
+    log.Fatal(err)
+  }
+  game.RecordStems = *recordStems
+  game.ScreenshotScale = *screenshotScale
+
+  if *record != "" {
+    if err := gb.StartRecording(*record, *recordStems); err != nil {
+      log.Fatal(err)
+    }
+  }
+  // finish the WAV headers and write battery-backed RAM
+  // when the window closes
+  defer gb.StopRecording()
+  defer func() {
+    if err := gb.SaveRAM(); err != nil {
+      log.Printf("couldn't write save file: %v", err)
+    }
+  }()
+
+  if *trace != "" {
+    if err := gb.StartTrace(*trace); err != nil {
+      log.Fatal(err)
+    }
+    defer func() {
+      if err := gb.StopTrace(); err != nil {
+        log.Printf("couldn't finish the trace: %v", err)
+      }
+    }()
+  }
+
+  if *rewindMB > 0 {
+    if err := gb.EnableRewind(cpu.RewindConfig{Interval: *rewindInterval, MaxBytes: *rewindMB << 20}); err != nil {
+      log.Fatal(err)
+    }
+  }
 
-  // infinite loop at GB clockspeed
-  go gb.Execute(true, 0)
+  if *debug {
+    // the debugger runs the emulator when it's told to, ctrl-c
+    // stops it again and quitting closes the window
+    debugger := cpu.NewDebugger(gb)
+    if err := debugger.LoadSymbols(*sym); err != nil {
+      log.Fatal(err)
+    }
+    interrupts := make(chan os.Signal, 1)
+    signal.Notify(interrupts, os.Interrupt)
+    go func() {
+      for range interrupts {
+        debugger.Interrupt()
+      }
+    }()
+    go func() {
+      if err := debugger.REPL(os.Stdin, os.Stdout); err != nil {
+        log.Printf("debugger: %v", err)
+      }
+      game.Quit()
+    }()
+  } else {
+    // infinite loop at GB clockspeed
+    go gb.Execute(true, 0)
+  }
 
   // display updates @ 60Hz via infinite loop in ebiten
   if err := ebiten.RunGame(game); err != nil {
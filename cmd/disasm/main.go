@@ -0,0 +1,136 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "flag"
+  "fmt"
+  "io/fs"
+  "jfeintzeig/gameboy/internal/disasm"
+  "os"
+  "strconv"
+  "strings"
+)
+
+var (
+  file *string
+  bank *int
+  start *string
+  end *string
+  sym *string
+)
+
+func init() {
+  file = flag.String("file","","path to the ROM to disassemble")
+  bank = flag.Int("bank",-1,"ROM bank to dump, -1 for all of them that -start/-end are inside")
+  start = flag.String("start","","hex address to start at, e.g. 0x0150 (default the start of the bank)")
+  end = flag.String("end","","hex address to stop after (default the end of the bank)")
+  sym = flag.String("sym","","RGBDS/BGB .sym file for labels (default the ROM's .sym, if there is one)")
+}
+
+// dumps ROM banks as BB:AAAA  bytes  mnemonic, one instruction a line,
+// with labels from the .sym file. everything is decoded as code, data
+// included, so e.g. the header comes out as nonsense
+func main() {
+  flag.Parse()
+  if err := run(); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+}
+
+func parseAddress(s string, fallback uint16) (uint16, error) {
+  if s == "" {
+    return fallback, nil
+  }
+  address, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 16)
+  if err != nil {
+    return 0, fmt.Errorf("bad address %q: %v", s, err)
+  }
+  return uint16(address), nil
+}
+
+func run() error {
+  if *file == "" {
+    return fmt.Errorf("-file is required")
+  }
+  rom, err := os.ReadFile(*file)
+  if err != nil {
+    return err
+  }
+
+  var symbols *disasm.Symbols
+  if *sym != "" {
+    if symbols, err = disasm.LoadSymbols(*sym); err != nil {
+      return err
+    }
+  } else if symbols, err = disasm.LoadSymbols(disasm.SymbolsPath(*file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+    return err
+  }
+
+  nBanks := (len(rom) + 0x3FFF) / 0x4000
+  banks := []int{*bank}
+  if *bank < 0 {
+    banks = nil
+    for b := 0; b < nBanks; b++ {
+      banks = append(banks, b)
+    }
+  } else if *bank >= nBanks {
+    return fmt.Errorf("bank %d, but the ROM only has %d", *bank, nBanks)
+  }
+
+  out := bufio.NewWriter(os.Stdout)
+  defer out.Flush()
+  dumped := false
+  for _, b := range banks {
+    // bank 0 lives at 0000-3FFF, the rest get switched in at 4000-7FFF
+    base := uint16(0x4000)
+    if b == 0 {
+      base = 0
+    }
+    first, err := parseAddress(*start, base)
+    if err != nil {
+      return err
+    }
+    last, err := parseAddress(*end, base + 0x3FFF)
+    if err != nil {
+      return err
+    }
+    if first < base || last > base + 0x3FFF || last < first {
+      // with all the banks, a range in 4000-7FFF just skips bank 0 and
+      // one in 0000-3FFF the rest
+      if *bank < 0 {
+        continue
+      }
+      return fmt.Errorf("%04X-%04X isn't inside bank %d at %04X-%04X", first, last, b, base, base + 0x3FFF)
+    }
+    dumped = true
+
+    read := func(address uint16) uint8 {
+      // the last instruction can run off the end of the bank
+      offset := b * 0x4000 + int(address - base)
+      if address < base || offset >= len(rom) {
+        return 0xFF
+      }
+      return rom[offset]
+    }
+    for address := uint32(first); address <= uint32(last); {
+      inst := disasm.Decode(read, uint16(address))
+      if symbols != nil {
+        if name, ok := symbols.Name(b, inst.Address); ok {
+          fmt.Fprintf(out, "%s:\n", name)
+        }
+      }
+      var code []string
+      for _, c := range inst.Bytes {
+        code = append(code, fmt.Sprintf("%02X", c))
+      }
+      fmt.Fprintf(out, "%02X:%04X  %-9s %s\n", b, inst.Address, strings.Join(code, " "), inst.WithSymbols(symbols, b))
+      address += uint32(inst.Length())
+    }
+  }
+  if !dumped {
+    return fmt.Errorf("-start/-end aren't inside any one bank, 0000-3FFF or 4000-7FFF")
+  }
+  return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "jfeintzeig/gameboy/internal/cpu"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+)
+
+// exit codes
+const (
+  EXIT_PASS = 0
+  EXIT_FAIL = 1
+  EXIT_ERROR = 2
+)
+
+var (
+  file *string
+  bootrom *bool
+  bootromFile *string
+  model *string
+  frames *uint64
+  cycles *uint64
+  pc *string
+  serial *string
+  failSerial *string
+  testROM *bool
+  debug *bool
+  sym *string
+  trace *string
+  record *string
+  recordStems *bool
+)
+
+func init() {
+  file = flag.String("file","","path to file to load")
+  bootrom = flag.Bool("bootrom",false,"set to true to use bootrom")
+  bootromFile = flag.String("bootrom-file","","path to a DMG0/DMG/MGB/SGB/CGB boot ROM to run first (implies -bootrom)")
+  model = flag.String("model","DMG","hardware state to start in when skipping the boot ROM: DMG0, DMG, MGB, SGB, SGB2 or CGB")
+  frames = flag.Uint64("frames",0,"stop after this many frames")
+  cycles = flag.Uint64("cycles",0,"stop after this many M-cycles")
+  pc = flag.String("pc","","stop when the instruction at this hex address is about to run, e.g. 0x0150")
+  serial = flag.String("serial","","stop and pass when the serial output contains this, e.g. Passed")
+  failSerial = flag.String("fail-serial","","stop and fail when the serial output contains this, e.g. Failed")
+  testROM = flag.Bool("test-rom",false,"detect blargg/mooneye pass and fail reports automatically, giving up after -frames (default 3600)")
+  debug = flag.Bool("debug",false,"step through the ROM in the debugger instead, reading commands from stdin (try help)")
+  trace = flag.String("trace","","path of a gameboy-doctor log to write, one line per instruction (LY reads 0x90 while tracing)")
+  sym = flag.String("sym","","RGBDS/BGB .sym file with labels for -debug (default the ROM's .sym, if there is one)")
+  record = flag.String("record","","path of a WAV file to record audio to")
+  recordStems = flag.Bool("record-stems",false,"set to true to also record one WAV file per sound channel")
+}
+
+// runs a ROM with no window or audio until one of the limits is hit.
+// exits 0 if the PC or -serial was reached (or the frame/cycle limit
+// when those are the only limits), 1 if -fail-serial matched or we ran
+// out of frames/cycles first, and 2 if the emulator couldn't start or
+// crashed. with -test-rom it's 0 for a pass, 1 for a fail or timeout
+// and 2 for a crash.
+func main() {
+  flag.Parse()
+  os.Exit(run())
+}
+
+func run() int {
+  if *file == "" {
+    fmt.Fprintln(os.Stderr, "-file is required")
+    return EXIT_ERROR
+  }
+
+  limits := cpu.RunLimits{
+    Frames: *frames,
+    Cycles: *cycles,
+    Serial: *serial,
+    FailSerial: *failSerial,
+  }
+  if *pc != "" {
+    address, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(*pc), "0x"), 16, 16)
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "bad -pc %q: %v\n", *pc, err)
+      return EXIT_ERROR
+    }
+    limits.PC = uint16(address)
+    limits.StopAtPC = true
+  }
+
+  bootROMPath := *bootromFile
+  if *bootrom && bootROMPath == "" {
+    bootROMPath = "data/bootrom_dmg.gb"
+  }
+  startModel, err := cpu.ParseModel(*model)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+  gb, err := cpu.NewGameBoy(file, bootROMPath, startModel, true)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+
+  if *trace != "" {
+    if err := gb.StartTrace(*trace); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      return EXIT_ERROR
+    }
+    defer func() {
+      if err := gb.StopTrace(); err != nil {
+        fmt.Fprintf(os.Stderr, "couldn't finish the trace: %v\n", err)
+      }
+    }()
+  }
+
+  // nothing plays it, but the APU still makes the samples
+  if *record != "" {
+    if err := gb.StartRecording(*record, *recordStems); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      return EXIT_ERROR
+    }
+    defer func() {
+      if err := gb.StopRecording(); err != nil {
+        fmt.Fprintf(os.Stderr, "couldn't finish the recording: %v\n", err)
+      }
+    }()
+  }
+
+  if *debug {
+    debugger := cpu.NewDebugger(gb)
+    if err := debugger.LoadSymbols(*sym); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      return EXIT_ERROR
+    }
+    // ctrl-c stops a continue rather than the whole thing
+    interrupts := make(chan os.Signal, 1)
+    signal.Notify(interrupts, os.Interrupt)
+    go func() {
+      for range interrupts {
+        debugger.Interrupt()
+      }
+    }()
+    if err := debugger.REPL(os.Stdin, os.Stdout); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      return EXIT_ERROR
+    }
+    return EXIT_PASS
+  }
+
+  if *testROM {
+    maxFrames := *frames
+    if maxFrames == 0 {
+      maxFrames = 3600
+    }
+    result := gb.RunTestROM(maxFrames)
+    fmt.Println()
+    fmt.Printf("%s (%s) after %d cycles: %s\n", result.Status, result.Protocol, result.Cycles, result.Summary())
+    switch result.Status {
+    case cpu.TEST_PASS:
+      return EXIT_PASS
+    case cpu.TEST_ERROR:
+      return EXIT_ERROR
+    default:
+      return EXIT_FAIL
+    }
+  }
+
+  reason, err := gb.RunUntil(limits)
+  // serial output is printed as it arrives, without a newline at the end
+  fmt.Println()
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return EXIT_ERROR
+  }
+  fmt.Printf("stopped: %s after %d cycles\n", reason, gb.Cycles())
+
+  switch reason {
+  case cpu.STOP_PC, cpu.STOP_SERIAL:
+    return EXIT_PASS
+  case cpu.STOP_FAIL_SERIAL:
+    return EXIT_FAIL
+  default:
+    // running out of time only counts as a pass if we weren't waiting for anything
+    if limits.StopAtPC || limits.Serial != "" {
+      return EXIT_FAIL
+    }
+    return EXIT_PASS
+  }
+}
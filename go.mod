@@ -2,10 +2,11 @@ module jfeintzeig/gameboy
 
 go 1.21.3
 
+require github.com/hajimehoshi/ebiten/v2 v2.6.3
+
 require (
 	github.com/ebitengine/oto/v3 v3.1.0 // indirect
 	github.com/ebitengine/purego v0.5.0 // indirect
-	github.com/hajimehoshi/ebiten/v2 v2.6.3 // indirect
 	github.com/hajimehoshi/go-mp3 v0.3.4 // indirect
 	github.com/jezek/xgb v1.1.0 // indirect
 	golang.org/x/exp/shiny v0.0.0-20230817173708-d852ddb80c63 // indirect
@@ -0,0 +1,753 @@
+package cpu
+
+import (
+  "sync"
+)
+
+// https://gbdev.io/pandocs/Audio.html
+// https://gbdev.gg8.se/wiki/articles/Gameboy_sound_hardware
+
+// bits that always read back as 1, indexed by address - NR10
+var apuReadMasks = [0x17]uint8{
+  0x80, 0x3F, 0x00, 0xFF, 0xBF, // NR10-NR14
+  0xFF, 0x3F, 0x00, 0xFF, 0xBF, // unused, NR21-NR24
+  0x7F, 0xFF, 0x9F, 0xFF, 0xBF, // NR30-NR34
+  0xFF, 0xFF, 0x00, 0x00, 0xBF, // unused, NR41-NR44
+  0x00, 0x00, 0x70,             // NR50-NR52
+}
+
+var dutyTable = [4][8]uint8{
+  {0, 0, 0, 0, 0, 0, 0, 1}, // 12.5%
+  {1, 0, 0, 0, 0, 0, 0, 1}, // 25%
+  {1, 0, 0, 0, 0, 1, 1, 1}, // 50%
+  {0, 1, 1, 1, 1, 1, 1, 0}, // 75%
+}
+
+var noiseDivisors = [8]int32{8, 16, 32, 48, 64, 80, 96, 112}
+
+// Envelope is the volume envelope shared by the square
+// and noise channels (NRx2)
+type Envelope struct {
+  initialVolume uint8
+  increase bool
+  period uint8
+
+  volume uint8
+  timer uint8
+}
+
+func (e *Envelope) write(value uint8) {
+  e.initialVolume = value >> 4
+  e.increase = GetBitBool(value, 3)
+  e.period = value & 0x07
+}
+
+func (e *Envelope) trigger() {
+  e.volume = e.initialVolume
+  e.timer = e.period
+  if e.timer == 0 {
+    e.timer = 8
+  }
+}
+
+func (e *Envelope) clock() {
+  if e.period == 0 {
+    return
+  }
+  e.timer -= 1
+  if e.timer > 0 {
+    return
+  }
+  e.timer = e.period
+  if e.increase && e.volume < 15 {
+    e.volume += 1
+  } else if !e.increase && e.volume > 0 {
+    e.volume -= 1
+  }
+}
+
+// LengthCounter turns a channel off after a number of
+// 256Hz frame sequencer clocks
+type LengthCounter struct {
+  enabled bool
+  counter uint16
+  max uint16
+}
+
+func (l *LengthCounter) load(value uint16) {
+  l.counter = l.max - value
+}
+
+// returns true if the channel should be disabled
+func (l *LengthCounter) clock() bool {
+  if !l.enabled || l.counter == 0 {
+    return false
+  }
+  l.counter -= 1
+  return l.counter == 0
+}
+
+// writeNRx4 handles length enable + trigger, including the extra
+// length clock you get when enabling length during a frame sequencer
+// step that doesn't clock length. returns true if the channel should
+// be disabled
+func (l *LengthCounter) writeNRx4(value uint8, nextStepClocksLength bool) bool {
+  wasEnabled := l.enabled
+  l.enabled = GetBitBool(value, 6)
+  trigger := GetBitBool(value, 7)
+  disable := false
+
+  if !wasEnabled && l.enabled && !nextStepClocksLength && l.counter != 0 {
+    l.counter -= 1
+    if l.counter == 0 && !trigger {
+      disable = true
+    }
+  }
+
+  if trigger && l.counter == 0 {
+    l.counter = l.max
+    if l.enabled && !nextStepClocksLength {
+      l.counter -= 1
+    }
+  }
+  return disable
+}
+
+// SquareChannel is channel 1 (with sweep) or channel 2
+type SquareChannel struct {
+  enabled bool
+  dacEnabled bool
+
+  duty uint8
+  dutyPosition uint8
+  frequency uint16
+  frequencyTimer int32
+
+  length LengthCounter
+  envelope Envelope
+
+  // sweep, only used by channel 1
+  hasSweep bool
+  sweepPeriod uint8
+  sweepNegate bool
+  sweepShift uint8
+  sweepTimer uint8
+  sweepEnabled bool
+  sweepNegateUsed bool
+  shadowFrequency uint16
+}
+
+func (ch *SquareChannel) period() int32 {
+  return (2048 - int32(ch.frequency)) * 4
+}
+
+func (ch *SquareChannel) trigger() {
+  ch.enabled = ch.dacEnabled
+  ch.frequencyTimer = ch.period()
+  ch.envelope.trigger()
+
+  if ch.hasSweep {
+    ch.shadowFrequency = ch.frequency
+    ch.sweepTimer = ch.sweepPeriod
+    if ch.sweepTimer == 0 {
+      ch.sweepTimer = 8
+    }
+    ch.sweepEnabled = ch.sweepPeriod != 0 || ch.sweepShift != 0
+    ch.sweepNegateUsed = false
+    if ch.sweepShift != 0 {
+      ch.calculateSweep()
+    }
+  }
+}
+
+func (ch *SquareChannel) writeSweep(value uint8) {
+  ch.sweepPeriod = (value >> 4) & 0x07
+  ch.sweepShift = value & 0x07
+  negate := GetBitBool(value, 3)
+  // clearing negate after a subtraction was used disables the channel
+  if ch.sweepNegate && !negate && ch.sweepNegateUsed {
+    ch.enabled = false
+  }
+  ch.sweepNegate = negate
+}
+
+func (ch *SquareChannel) calculateSweep() uint16 {
+  delta := ch.shadowFrequency >> ch.sweepShift
+  var newFrequency uint16
+  if ch.sweepNegate {
+    newFrequency = ch.shadowFrequency - delta
+    ch.sweepNegateUsed = true
+  } else {
+    newFrequency = ch.shadowFrequency + delta
+  }
+  if newFrequency > 2047 {
+    ch.enabled = false
+  }
+  return newFrequency
+}
+
+func (ch *SquareChannel) clockSweep() {
+  ch.sweepTimer -= 1
+  if ch.sweepTimer > 0 {
+    return
+  }
+  ch.sweepTimer = ch.sweepPeriod
+  if ch.sweepTimer == 0 {
+    ch.sweepTimer = 8
+  }
+
+  if !ch.sweepEnabled || ch.sweepPeriod == 0 {
+    return
+  }
+  newFrequency := ch.calculateSweep()
+  if newFrequency <= 2047 && ch.sweepShift != 0 {
+    ch.shadowFrequency = newFrequency
+    ch.frequency = newFrequency
+    // overflow check again with the new frequency
+    ch.calculateSweep()
+  }
+}
+
+func (ch *SquareChannel) clockLength() {
+  if ch.length.clock() {
+    ch.enabled = false
+  }
+}
+
+func (ch *SquareChannel) doCycle() {
+  ch.frequencyTimer -= 4
+  for ch.frequencyTimer <= 0 {
+    ch.frequencyTimer += ch.period()
+    ch.dutyPosition = (ch.dutyPosition + 1) % 8
+  }
+}
+
+// output is the digital value 0-15 fed into the DAC
+func (ch *SquareChannel) output() uint8 {
+  if !ch.enabled || !ch.dacEnabled {
+    return 0
+  }
+  return dutyTable[ch.duty][ch.dutyPosition] * ch.envelope.volume
+}
+
+// WaveChannel is channel 3, which plays back the 32 4-bit
+// samples stored in wave RAM
+type WaveChannel struct {
+  enabled bool
+  dacEnabled bool
+
+  frequency uint16
+  frequencyTimer int32
+  volumeCode uint8
+  position uint8
+  sampleBuffer uint8
+
+  length LengthCounter
+
+  waveRAM [16]Register8
+}
+
+func (ch *WaveChannel) period() int32 {
+  return (2048 - int32(ch.frequency)) * 2
+}
+
+func (ch *WaveChannel) trigger() {
+  ch.enabled = ch.dacEnabled
+  ch.frequencyTimer = ch.period()
+  ch.position = 0
+}
+
+func (ch *WaveChannel) clockLength() {
+  if ch.length.clock() {
+    ch.enabled = false
+  }
+}
+
+func (ch *WaveChannel) doCycle() {
+  if !ch.enabled {
+    return
+  }
+  ch.frequencyTimer -= 4
+  for ch.frequencyTimer <= 0 {
+    ch.frequencyTimer += ch.period()
+    ch.position = (ch.position + 1) % 32
+    ch.sampleBuffer = ch.waveRAM[ch.position / 2].read()
+  }
+}
+
+func (ch *WaveChannel) output() uint8 {
+  if !ch.enabled || !ch.dacEnabled || ch.volumeCode == 0 {
+    return 0
+  }
+  var sample uint8
+  if ch.position % 2 == 0 {
+    sample = ch.sampleBuffer >> 4
+  } else {
+    sample = ch.sampleBuffer & 0x0F
+  }
+  return sample >> (ch.volumeCode - 1)
+}
+
+// while channel 3 is playing, wave RAM accesses go to the
+// byte currently being played
+func (ch *WaveChannel) readWaveRAM(address uint16) uint8 {
+  if ch.enabled {
+    return ch.waveRAM[ch.position / 2].read()
+  }
+  return ch.waveRAM[address - WAVE_RAM_START].read()
+}
+
+func (ch *WaveChannel) writeWaveRAM(address uint16, value uint8) {
+  if ch.enabled {
+    ch.waveRAM[ch.position / 2].write(value)
+    return
+  }
+  ch.waveRAM[address - WAVE_RAM_START].write(value)
+}
+
+// NoiseChannel is channel 4, a linear feedback shift register
+type NoiseChannel struct {
+  enabled bool
+  dacEnabled bool
+
+  clockShift uint8
+  widthMode7 bool
+  divisorCode uint8
+  frequencyTimer int32
+  lfsr uint16
+
+  length LengthCounter
+  envelope Envelope
+}
+
+func (ch *NoiseChannel) period() int32 {
+  return noiseDivisors[ch.divisorCode] << ch.clockShift
+}
+
+func (ch *NoiseChannel) trigger() {
+  ch.enabled = ch.dacEnabled
+  ch.frequencyTimer = ch.period()
+  ch.envelope.trigger()
+  ch.lfsr = 0x7FFF
+}
+
+func (ch *NoiseChannel) clockLength() {
+  if ch.length.clock() {
+    ch.enabled = false
+  }
+}
+
+func (ch *NoiseChannel) doCycle() {
+  ch.frequencyTimer -= 4
+  for ch.frequencyTimer <= 0 {
+    ch.frequencyTimer += ch.period()
+    // shift clocks 14 and 15 get no clocks
+    if ch.clockShift >= 14 {
+      continue
+    }
+    xor := (ch.lfsr & 0x01) ^ ((ch.lfsr >> 1) & 0x01)
+    ch.lfsr = (ch.lfsr >> 1) | (xor << 14)
+    if ch.widthMode7 {
+      ch.lfsr = (ch.lfsr &^ (1 << 6)) | (xor << 6)
+    }
+  }
+}
+
+func (ch *NoiseChannel) output() uint8 {
+  if !ch.enabled || !ch.dacEnabled {
+    return 0
+  }
+  return uint8(^ch.lfsr & 0x01) * ch.envelope.volume
+}
+
+type Apu struct {
+  bus Mediator
+
+  // raw register values for NR10-NR52, read back through apuReadMasks
+  registers [0x17]Register8
+
+  ch1 SquareChannel
+  ch2 SquareChannel
+  ch3 WaveChannel
+  ch4 NoiseChannel
+
+  powered bool
+
+  // frame sequencer, clocked by the falling edge of DIV bit 4 (512Hz)
+  frameSequencerStep uint8
+  lastDivBit bool
+
+  // sample output, see audio.go
+  output *AudioBuffer
+  sampleRate uint64
+  sampleCounter uint64
+  highPassFactor float64
+  capacitorLeft float64
+  capacitorRight float64
+
+  // see recorder.go
+  recorderMu sync.Mutex
+  recorder *AudioRecorder
+}
+
+func NewApu(busPointer *Bus) *Apu {
+  apu := Apu{}
+  apu.bus = busPointer
+
+  apu.ch1.hasSweep = true
+  apu.ch1.length.max = 64
+  apu.ch2.length.max = 64
+  apu.ch3.length.max = 256
+  apu.ch4.length.max = 64
+
+  // samples are always generated so a recording can be started
+  // without an audio device
+  apu.setSampleRate(AudioSampleRate)
+
+  return &apu
+}
+
+// length is clocked on steps 0, 2, 4 and 6
+func (a *Apu) nextStepClocksLength() bool {
+  return a.frameSequencerStep % 2 == 0
+}
+
+func (a *Apu) stepFrameSequencer() {
+  step := a.frameSequencerStep
+
+  if step % 2 == 0 {
+    a.ch1.clockLength()
+    a.ch2.clockLength()
+    a.ch3.clockLength()
+    a.ch4.clockLength()
+  }
+  if step == 2 || step == 6 {
+    a.ch1.clockSweep()
+  }
+  if step == 7 {
+    a.ch1.envelope.clock()
+    a.ch2.envelope.clock()
+    a.ch4.envelope.clock()
+  }
+
+  a.frameSequencerStep = (step + 1) % 8
+}
+
+func (a *Apu) doCycle() {
+  divBit := GetBitBool(a.bus.ReadFromBus(DIV), 4)
+
+  if a.powered {
+    if a.lastDivBit && !divBit {
+      a.stepFrameSequencer()
+    }
+    a.ch1.doCycle()
+    a.ch2.doCycle()
+    a.ch3.doCycle()
+    a.ch4.doCycle()
+  }
+  a.lastDivBit = divBit
+
+  // keep producing (silent) samples while powered off, since
+  // the audio device is what paces emulation
+  a.doSample()
+}
+
+func (e *Envelope) saveState(w *stateWriter) {
+  w.u8(e.initialVolume)
+  w.bool(e.increase)
+  w.u8(e.period)
+  w.u8(e.volume)
+  w.u8(e.timer)
+}
+
+func (e *Envelope) loadState(r *stateReader) {
+  e.initialVolume = r.u8()
+  e.increase = r.bool()
+  e.period = r.u8()
+  e.volume = r.u8()
+  e.timer = r.u8()
+}
+
+// max is fixed per channel, so it isn't saved
+func (l *LengthCounter) saveState(w *stateWriter) {
+  w.bool(l.enabled)
+  w.u16(l.counter)
+}
+
+func (l *LengthCounter) loadState(r *stateReader) {
+  l.enabled = r.bool()
+  l.counter = r.u16()
+}
+
+func (ch *SquareChannel) saveState(w *stateWriter) {
+  w.bool(ch.enabled)
+  w.bool(ch.dacEnabled)
+  w.u8(ch.duty)
+  w.u8(ch.dutyPosition)
+  w.u16(ch.frequency)
+  w.i32(ch.frequencyTimer)
+  ch.length.saveState(w)
+  ch.envelope.saveState(w)
+  w.u8(ch.sweepPeriod)
+  w.bool(ch.sweepNegate)
+  w.u8(ch.sweepShift)
+  w.u8(ch.sweepTimer)
+  w.bool(ch.sweepEnabled)
+  w.bool(ch.sweepNegateUsed)
+  w.u16(ch.shadowFrequency)
+}
+
+func (ch *SquareChannel) loadState(r *stateReader) {
+  ch.enabled = r.bool()
+  ch.dacEnabled = r.bool()
+  ch.duty = r.u8() & 0x03
+  ch.dutyPosition = r.u8() & 0x07
+  ch.frequency = r.u16()
+  ch.frequencyTimer = r.i32()
+  ch.length.loadState(r)
+  ch.envelope.loadState(r)
+  ch.sweepPeriod = r.u8()
+  ch.sweepNegate = r.bool()
+  ch.sweepShift = r.u8()
+  ch.sweepTimer = r.u8()
+  ch.sweepEnabled = r.bool()
+  ch.sweepNegateUsed = r.bool()
+  ch.shadowFrequency = r.u16()
+}
+
+func (ch *WaveChannel) saveState(w *stateWriter) {
+  w.bool(ch.enabled)
+  w.bool(ch.dacEnabled)
+  w.u16(ch.frequency)
+  w.i32(ch.frequencyTimer)
+  w.u8(ch.volumeCode)
+  w.u8(ch.position)
+  w.u8(ch.sampleBuffer)
+  ch.length.saveState(w)
+  w.registers(ch.waveRAM[:])
+}
+
+func (ch *WaveChannel) loadState(r *stateReader) {
+  ch.enabled = r.bool()
+  ch.dacEnabled = r.bool()
+  ch.frequency = r.u16()
+  ch.frequencyTimer = r.i32()
+  ch.volumeCode = r.u8() & 0x03
+  ch.position = r.u8() % 32
+  ch.sampleBuffer = r.u8()
+  ch.length.loadState(r)
+  r.registers(ch.waveRAM[:])
+}
+
+func (ch *NoiseChannel) saveState(w *stateWriter) {
+  w.bool(ch.enabled)
+  w.bool(ch.dacEnabled)
+  w.u8(ch.clockShift)
+  w.bool(ch.widthMode7)
+  w.u8(ch.divisorCode)
+  w.i32(ch.frequencyTimer)
+  w.u16(ch.lfsr)
+  ch.length.saveState(w)
+  ch.envelope.saveState(w)
+}
+
+func (ch *NoiseChannel) loadState(r *stateReader) {
+  ch.enabled = r.bool()
+  ch.dacEnabled = r.bool()
+  ch.clockShift = r.u8() & 0x0F
+  ch.widthMode7 = r.bool()
+  ch.divisorCode = r.u8() & 0x07
+  ch.frequencyTimer = r.i32()
+  ch.lfsr = r.u16()
+  ch.length.loadState(r)
+  ch.envelope.loadState(r)
+}
+
+// only the emulated hardware, the sample output and any
+// recording carry on as they were
+func (a *Apu) saveState(w *stateWriter) {
+  w.registers(a.registers[:])
+  a.ch1.saveState(w)
+  a.ch2.saveState(w)
+  a.ch3.saveState(w)
+  a.ch4.saveState(w)
+  w.bool(a.powered)
+  w.u8(a.frameSequencerStep)
+  w.bool(a.lastDivBit)
+}
+
+func (a *Apu) loadState(r *stateReader) {
+  r.registers(a.registers[:])
+  a.ch1.loadState(r)
+  a.ch2.loadState(r)
+  a.ch3.loadState(r)
+  a.ch4.loadState(r)
+  a.powered = r.bool()
+  a.frameSequencerStep = r.u8() % 8
+  a.lastDivBit = r.bool()
+}
+
+func (a *Apu) readNR52() uint8 {
+  var result uint8
+  result = SetBitBool(result, 7, a.powered)
+  result = SetBitBool(result, 3, a.ch4.enabled)
+  result = SetBitBool(result, 2, a.ch3.enabled)
+  result = SetBitBool(result, 1, a.ch2.enabled)
+  result = SetBitBool(result, 0, a.ch1.enabled)
+  return result
+}
+
+func (a *Apu) read(address uint16) uint8 {
+  switch {
+  case address >= WAVE_RAM_START && address <= WAVE_RAM_END:
+    return a.ch3.readWaveRAM(address)
+  case address == NR52:
+    return a.readNR52() | apuReadMasks[NR52 - NR10]
+  case address >= NR10 && address < NR52:
+    return a.registers[address - NR10].read() | apuReadMasks[address - NR10]
+  default:
+    // 0xFF27-0xFF2F are unused
+    return 0xFF
+  }
+}
+
+func (a *Apu) write(address uint16, value uint8) {
+  switch {
+  case address >= WAVE_RAM_START && address <= WAVE_RAM_END:
+    a.ch3.writeWaveRAM(address, value)
+    return
+  case address == NR52:
+    a.writeNR52(value)
+    return
+  case address > NR52:
+    return
+  }
+
+  if !a.powered {
+    // on DMG the length counters can still be written while powered off
+    switch address {
+    case NR11:
+      a.ch1.length.load(uint16(value & 0x3F))
+    case NR21:
+      a.ch2.length.load(uint16(value & 0x3F))
+    case NR31:
+      a.ch3.length.load(uint16(value))
+    case NR41:
+      a.ch4.length.load(uint16(value & 0x3F))
+    }
+    return
+  }
+
+  a.registers[address - NR10].write(value)
+
+  switch address {
+  // channel 1
+  case NR10:
+    a.ch1.writeSweep(value)
+  case NR11:
+    a.ch1.duty = value >> 6
+    a.ch1.length.load(uint16(value & 0x3F))
+  case NR12:
+    a.ch1.envelope.write(value)
+    a.ch1.dacEnabled = (value & 0xF8) != 0
+    if !a.ch1.dacEnabled {
+      a.ch1.enabled = false
+    }
+  case NR13:
+    a.ch1.frequency = (a.ch1.frequency & 0x700) | uint16(value)
+  case NR14:
+    a.ch1.frequency = (a.ch1.frequency & 0xFF) | (uint16(value & 0x07) << 8)
+    if a.ch1.length.writeNRx4(value, a.nextStepClocksLength()) {
+      a.ch1.enabled = false
+    }
+    if GetBitBool(value, 7) {
+      a.ch1.trigger()
+    }
+  // channel 2
+  case NR21:
+    a.ch2.duty = value >> 6
+    a.ch2.length.load(uint16(value & 0x3F))
+  case NR22:
+    a.ch2.envelope.write(value)
+    a.ch2.dacEnabled = (value & 0xF8) != 0
+    if !a.ch2.dacEnabled {
+      a.ch2.enabled = false
+    }
+  case NR23:
+    a.ch2.frequency = (a.ch2.frequency & 0x700) | uint16(value)
+  case NR24:
+    a.ch2.frequency = (a.ch2.frequency & 0xFF) | (uint16(value & 0x07) << 8)
+    if a.ch2.length.writeNRx4(value, a.nextStepClocksLength()) {
+      a.ch2.enabled = false
+    }
+    if GetBitBool(value, 7) {
+      a.ch2.trigger()
+    }
+  // channel 3
+  case NR30:
+    a.ch3.dacEnabled = GetBitBool(value, 7)
+    if !a.ch3.dacEnabled {
+      a.ch3.enabled = false
+    }
+  case NR31:
+    a.ch3.length.load(uint16(value))
+  case NR32:
+    a.ch3.volumeCode = (value >> 5) & 0x03
+  case NR33:
+    a.ch3.frequency = (a.ch3.frequency & 0x700) | uint16(value)
+  case NR34:
+    a.ch3.frequency = (a.ch3.frequency & 0xFF) | (uint16(value & 0x07) << 8)
+    if a.ch3.length.writeNRx4(value, a.nextStepClocksLength()) {
+      a.ch3.enabled = false
+    }
+    if GetBitBool(value, 7) {
+      a.ch3.trigger()
+    }
+  // channel 4
+  case NR41:
+    a.ch4.length.load(uint16(value & 0x3F))
+  case NR42:
+    a.ch4.envelope.write(value)
+    a.ch4.dacEnabled = (value & 0xF8) != 0
+    if !a.ch4.dacEnabled {
+      a.ch4.enabled = false
+    }
+  case NR43:
+    a.ch4.clockShift = value >> 4
+    a.ch4.widthMode7 = GetBitBool(value, 3)
+    a.ch4.divisorCode = value & 0x07
+  case NR44:
+    if a.ch4.length.writeNRx4(value, a.nextStepClocksLength()) {
+      a.ch4.enabled = false
+    }
+    if GetBitBool(value, 7) {
+      a.ch4.trigger()
+    }
+  }
+}
+
+func (a *Apu) writeNR52(value uint8) {
+  powered := GetBitBool(value, 7)
+  if a.powered && !powered {
+    // powering off clears every register except wave RAM, and
+    // on DMG the length counters survive
+    lengths := [4]uint16{a.ch1.length.counter, a.ch2.length.counter, a.ch3.length.counter, a.ch4.length.counter}
+    for address := uint16(NR10); address < NR52; address++ {
+      a.write(address, 0x00)
+    }
+    a.ch1.length.counter = lengths[0]
+    a.ch2.length.counter = lengths[1]
+    a.ch3.length.counter = lengths[2]
+    a.ch4.length.counter = lengths[3]
+    a.ch1.enabled = false
+    a.ch2.enabled = false
+    a.ch3.enabled = false
+    a.ch4.enabled = false
+  } else if !a.powered && powered {
+    a.frameSequencerStep = 0
+    a.ch1.dutyPosition = 0
+    a.ch2.dutyPosition = 0
+    a.ch3.sampleBuffer = 0
+  }
+  a.powered = powered
+}
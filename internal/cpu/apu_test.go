@@ -0,0 +1,213 @@
+package cpu
+
+import (
+  "testing"
+)
+
+// an APU on a flat bus, so tests can set DIV directly
+func newTestApu(powered bool) (*Apu, *testBus) {
+  bus := &testBus{}
+  a := NewApu(nil)
+  a.bus = bus
+  if powered {
+    a.write(NR52, 0x80)
+  }
+  return a, bus
+}
+
+func TestApuReadMasks(t *testing.T) {
+  a, _ := newTestApu(true)
+  for address := uint16(NR10); address < NR52; address++ {
+    a.write(address, 0x00)
+    if got, want := a.read(address), apuReadMasks[address - NR10]; got != want {
+      t.Errorf("%04X: wrote 00, read %02X, want %02X", address, got, want)
+    }
+    a.write(address, 0xFF)
+    if got := a.read(address); got != 0xFF {
+      t.Errorf("%04X: wrote FF, read %02X", address, got)
+    }
+  }
+
+  // the unused registers between NR52 and wave RAM
+  for address := uint16(NR52 + 1); address < WAVE_RAM_START; address++ {
+    a.write(address, 0x00)
+    if got := a.read(address); got != 0xFF {
+      t.Errorf("%04X: read %02X", address, got)
+    }
+  }
+
+  a, _ = newTestApu(false)
+  if got := a.read(NR52); got != 0x70 {
+    t.Errorf("NR52 is %02X powered off", got)
+  }
+  a.write(NR52, 0xFF)
+  if got := a.read(NR52); got != 0xF0 {
+    t.Errorf("NR52 is %02X powered on with nothing playing", got)
+  }
+  // channel 2 on, and the status bits aren't writable
+  a.write(NR22, 0xF0)
+  a.write(NR24, 0x80)
+  a.write(NR52, 0x80)
+  if got := a.read(NR52); got != 0xF2 {
+    t.Errorf("NR52 is %02X with channel 2 playing", got)
+  }
+}
+
+func TestApuPowerOff(t *testing.T) {
+  a, _ := newTestApu(true)
+  for address := uint16(NR10); address < NR52; address++ {
+    a.write(address, 0xFF)
+  }
+  a.write(NR11, 0x40 - 10)
+  a.write(NR21, 0x40 - 20)
+  a.write(NR31, 0x100 - 30)
+  a.write(NR41, 0x40 - 40)
+  a.write(WAVE_RAM_START, 0x5A)
+
+  a.write(NR52, 0x00)
+  for address := uint16(NR10); address < NR52; address++ {
+    if got, want := a.read(address), apuReadMasks[address - NR10]; got != want {
+      t.Errorf("%04X: read %02X after powering off, want %02X", address, got, want)
+    }
+  }
+  if a.ch1.enabled || a.ch2.enabled || a.ch3.enabled || a.ch4.enabled {
+    t.Error("channels still on")
+  }
+  // on DMG the lengths and wave RAM survive
+  lengths := [4]uint16{a.ch1.length.counter, a.ch2.length.counter, a.ch3.length.counter, a.ch4.length.counter}
+  if lengths != [4]uint16{10, 20, 30, 40} {
+    t.Errorf("lengths are %v after powering off", lengths)
+  }
+  if got := a.read(WAVE_RAM_START); got != 0x5A {
+    t.Errorf("wave RAM is %02X after powering off", got)
+  }
+
+  // only the lengths can be written while powered off
+  a.write(NR12, 0xF0)
+  a.write(NR50, 0x77)
+  a.write(NR21, 0x40 - 5)
+  if a.read(NR12) != apuReadMasks[NR12 - NR10] || a.read(NR50) != 0x00 {
+    t.Error("registers written while powered off")
+  }
+  if a.ch2.length.counter != 5 {
+    t.Errorf("NR21 length %d, want 5", a.ch2.length.counter)
+  }
+}
+
+func TestApuLengthEnableExtraClock(t *testing.T) {
+  tests := []struct {
+    name string
+    // the step the frame sequencer runs next, the odd ones don't
+    // clock length
+    step uint8
+    // length enabled before the write
+    wasEnabled bool
+    counter uint16
+    nr24 uint8
+    want uint16
+    enabled bool
+  }{
+    {"next step clocks length", 0, false, 10, 0x40, 10, true},
+    {"next step doesn't clock length", 1, false, 10, 0x40, 9, true},
+    {"clocked to 0 disables", 3, false, 1, 0x40, 0, false},
+    {"clocked to 0 but triggered", 3, false, 1, 0xC0, 63, true},
+    {"triggered from 0", 5, false, 0, 0xC0, 63, true},
+    {"triggered from 0 on an even step", 6, false, 0, 0xC0, 64, true},
+    {"length was already enabled", 1, true, 10, 0x40, 10, true},
+  }
+  for _, test := range tests {
+    a, _ := newTestApu(true)
+    a.write(NR22, 0xF0)
+    a.write(NR24, 0x80)
+    if test.wasEnabled {
+      a.write(NR24, 0x40)
+    }
+    a.ch2.length.counter = test.counter
+    a.frameSequencerStep = test.step
+    a.write(NR24, test.nr24)
+    if a.ch2.length.counter != test.want || a.ch2.enabled != test.enabled {
+      t.Errorf("%s: length %d and enabled %t, want %d and %t", test.name, a.ch2.length.counter, a.ch2.enabled, test.want, test.enabled)
+    }
+  }
+}
+
+func TestApuSweepOverflow(t *testing.T) {
+  tests := []struct {
+    name string
+    nr10 uint8
+    frequency uint16
+    // frame sequencer steps after the trigger
+    steps int
+    enabled bool
+  }{
+    // 0x700 + 0x700 >> 1 = 0xA80 is over 2047, which is checked on trigger
+    {"overflow on trigger", 0x11, 0x700, 0, false},
+    {"no overflow", 0x11, 0x400, 0, true},
+    // 0x600 + 0x300 overflows at the first sweep clock, on step 2
+    {"overflow when clocked", 0x12, 0x600, 3, false},
+    {"not clocked yet", 0x12, 0x600, 2, true},
+    // 0x400 -> 0x600 -> overflow on the check straight after
+    {"overflow on the second check", 0x11, 0x3FF, 3, false},
+    {"subtracting never overflows", 0x19, 0x7FF, 8, true},
+  }
+  for _, test := range tests {
+    a, _ := newTestApu(true)
+    a.write(NR10, test.nr10)
+    a.write(NR12, 0xF0)
+    a.write(NR13, uint8(test.frequency))
+    a.write(NR14, 0x80 | uint8(test.frequency >> 8))
+    for i := 0; i < test.steps; i++ {
+      a.stepFrameSequencer()
+    }
+    if a.ch1.enabled != test.enabled {
+      t.Errorf("%s: enabled %t, frequency %03X", test.name, a.ch1.enabled, a.ch1.frequency)
+    }
+  }
+}
+
+func TestApuFrameSequencerClock(t *testing.T) {
+  a, bus := newTestApu(true)
+  setDivBit := func(set bool) {
+    bus.memory[DIV] = SetBitBool(0, 4, set)
+    a.doCycle()
+  }
+
+  setDivBit(false)
+  setDivBit(true)
+  if a.frameSequencerStep != 0 {
+    t.Errorf("stepped to %d on a rising edge", a.frameSequencerStep)
+  }
+  setDivBit(true)
+  setDivBit(false)
+  if a.frameSequencerStep != 1 {
+    t.Errorf("step %d after a falling edge, want 1", a.frameSequencerStep)
+  }
+  setDivBit(false)
+  if a.frameSequencerStep != 1 {
+    t.Errorf("stepped to %d with DIV bit 4 staying clear", a.frameSequencerStep)
+  }
+
+  // nothing steps while powered off, and powering on starts from 0
+  a.write(NR52, 0x00)
+  setDivBit(true)
+  setDivBit(false)
+  if a.frameSequencerStep != 1 {
+    t.Errorf("stepped to %d powered off", a.frameSequencerStep)
+  }
+  a.write(NR52, 0x80)
+  if a.frameSequencerStep != 0 {
+    t.Errorf("step %d after powering on", a.frameSequencerStep)
+  }
+
+  // length is clocked by the steps, 256Hz
+  a.write(NR22, 0xF0)
+  a.write(NR21, 0x40 - 2)
+  a.write(NR24, 0xC0)
+  for i := 0; i < 4; i++ {
+    setDivBit(true)
+    setDivBit(false)
+  }
+  if a.ch2.enabled || a.ch2.length.counter != 0 {
+    t.Errorf("enabled %t with length %d after 2 length clocks", a.ch2.enabled, a.ch2.length.counter)
+  }
+}
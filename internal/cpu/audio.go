@@ -0,0 +1,185 @@
+package cpu
+
+import (
+  "encoding/binary"
+  "math"
+  "sync"
+  "time"
+)
+
+const AudioSampleRate = 48000
+
+// bytes per stereo frame: 2 channels of 16-bit little endian
+const audioFrameSize = 4
+
+// AudioBuffer is a ring buffer of 16-bit stereo PCM sitting between
+// the emulation goroutine (writer) and the audio device (reader).
+// It implements io.Reader so it can be handed to an audio.Player.
+type AudioBuffer struct {
+  mu sync.Mutex
+  data []byte
+  start int
+  length int
+
+  // emulation waits while more than this many frames are buffered
+  target int
+}
+
+func NewAudioBuffer(capacityFrames int, targetFrames int) *AudioBuffer {
+  return &AudioBuffer{
+    data: make([]byte, capacityFrames * audioFrameSize),
+    target: targetFrames,
+  }
+}
+
+// write drops the frame if the buffer is full, e.g. when running
+// faster than realtime
+func (b *AudioBuffer) write(left int16, right int16) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  if b.length + audioFrameSize > len(b.data) {
+    return
+  }
+  end := (b.start + b.length) % len(b.data)
+  binary.LittleEndian.PutUint16(b.data[end:], uint16(left))
+  binary.LittleEndian.PutUint16(b.data[end+2:], uint16(right))
+  b.length += audioFrameSize
+}
+
+// Read hands buffered frames to the audio device. On underrun it
+// returns a short stretch of silence instead of blocking the device.
+func (b *AudioBuffer) Read(p []byte) (int, error) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  n := len(p) - (len(p) % audioFrameSize)
+  if b.length == 0 {
+    n = min(n, 256 * audioFrameSize)
+    for i := 0; i < n; i++ {
+      p[i] = 0
+    }
+    return n, nil
+  }
+
+  n = min(n, b.length)
+  for i := 0; i < n; i++ {
+    p[i] = b.data[(b.start + i) % len(b.data)]
+  }
+  b.start = (b.start + n) % len(b.data)
+  b.length -= n
+  return n, nil
+}
+
+// Buffered returns the number of stereo frames waiting to be played
+func (b *AudioBuffer) Buffered() int {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.length / audioFrameSize
+}
+
+// waitForSpace blocks the emulation until the audio device has
+// drained the buffer below its target fill level. This is what makes
+// the audio device the clock master.
+func (b *AudioBuffer) waitForSpace() {
+  for b.Buffered() > b.target {
+    time.Sleep(time.Millisecond)
+  }
+}
+
+// EnableAudio makes the APU produce samples at sampleRate into a
+// ring buffer, and returns it for an audio player to consume
+func (cpu *Cpu) EnableAudio(sampleRate int) *AudioBuffer {
+  // ~170ms of capacity, ~50ms of target latency
+  buffer := NewAudioBuffer(sampleRate / 6, sampleRate / 20)
+  cpu.Bus.apu.setOutput(buffer, sampleRate)
+  return buffer
+}
+
+// DAC: digital 0-15 -> analog -1 to 1, or 0 if the DAC is off
+func dac(digital uint8, enabled bool) float64 {
+  if !enabled {
+    return 0
+  }
+  return float64(digital) / 7.5 - 1
+}
+
+func (a *Apu) setOutput(buffer *AudioBuffer, sampleRate int) {
+  a.output = buffer
+  a.setSampleRate(sampleRate)
+}
+
+func (a *Apu) setSampleRate(sampleRate int) {
+  a.sampleRate = uint64(sampleRate)
+  a.sampleCounter = 0
+  // the hardware's high-pass capacitor charge factor is
+  // 0.999958 per T-cycle, so scale it to our sample rate
+  a.highPassFactor = math.Pow(0.999958, float64(4 * ClockSpeed) / float64(sampleRate))
+}
+
+// analogOutputs are the DAC outputs of channels 1-4
+func (a *Apu) analogOutputs() [4]float64 {
+  return [4]float64{
+    dac(a.ch1.output(), a.ch1.dacEnabled),
+    dac(a.ch2.output(), a.ch2.dacEnabled),
+    dac(a.ch3.output(), a.ch3.dacEnabled),
+    dac(a.ch4.output(), a.ch4.dacEnabled),
+  }
+}
+
+// mix applies NR51 panning and NR50 master volume, returning
+// left and right in the range -1 to 1
+func (a *Apu) mix(outputs [4]float64) (float64, float64) {
+  panning := a.registers[NR51 - NR10].read()
+  volume := a.registers[NR50 - NR10].read()
+
+  var left, right float64
+  for i := uint8(0); i < 4; i++ {
+    if GetBitBool(panning, i + 4) {
+      left += outputs[i]
+    }
+    if GetBitBool(panning, i) {
+      right += outputs[i]
+    }
+  }
+
+  left = left / 4 * float64(((volume >> 4) & 0x07) + 1) / 8
+  right = right / 4 * float64((volume & 0x07) + 1) / 8
+  return left, right
+}
+
+func (a *Apu) highPass(in float64, capacitor *float64) float64 {
+  out := in - *capacitor
+  *capacitor = in - out * a.highPassFactor
+  return out
+}
+
+func toPCM(value float64) int16 {
+  value = max(-1, min(1, value))
+  return int16(value * math.MaxInt16)
+}
+
+// doSample is called once per M-cycle and emits a sample to the
+// audio device and/or recorder whenever we've crossed a sample period
+func (a *Apu) doSample() {
+  a.sampleCounter += a.sampleRate
+  if a.sampleCounter < ClockSpeed {
+    return
+  }
+  a.sampleCounter -= ClockSpeed
+
+  outputs := a.analogOutputs()
+
+  if a.output != nil {
+    left, right := a.mix(outputs)
+    left = a.highPass(left, &a.capacitorLeft)
+    right = a.highPass(right, &a.capacitorRight)
+    a.output.write(toPCM(left), toPCM(right))
+  }
+
+  a.recorderMu.Lock()
+  if a.recorder != nil {
+    a.recorder.record(a, outputs)
+  }
+  a.recorderMu.Unlock()
+}
@@ -0,0 +1,131 @@
+package cpu
+
+import (
+  "bytes"
+  "errors"
+  "io/fs"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// BatteryBacked cartridges keep their RAM when the power is off,
+// which we emulate with a .sav file next to the ROM
+type BatteryBacked interface {
+  hasBattery() bool
+  // just the RAM, see saveFileFooter for anything else in the file
+  sram() []byte
+  loadSRAM([]byte)
+}
+
+// saveFileFooter is for cartridges that save more than their RAM, the
+// MBC3 clock. it goes after the RAM in the .sav file. the first
+// footerStateSize bytes count towards deciding whether there's
+// anything new to save
+type saveFileFooter interface {
+  saveFileFooter() []byte
+  footerStateSize() int
+}
+
+// flush battery-backed RAM to disk this often, in emulated M-cycles
+const sramFlushInterval = 5 * ClockSpeed
+
+func registersToBytes(registers []Register8) []byte {
+  data := make([]byte, len(registers))
+  for i := range registers {
+    data[i] = registers[i].read()
+  }
+  return data
+}
+
+func bytesToRegisters(data []byte, registers []Register8) {
+  for i := 0; i < len(data) && i < len(registers); i++ {
+    registers[i].write(data[i])
+  }
+}
+
+// e.g. data/Zelda.gb -> data/Zelda.sav
+func SaveFilePath(romFilePath string) string {
+  return strings.TrimSuffix(romFilePath, filepath.Ext(romFilePath)) + ".sav"
+}
+
+// a missing save file just means a fresh game
+func loadSaveFile(battery BatteryBacked, path string) error {
+  data, err := os.ReadFile(path)
+  if errors.Is(err, fs.ErrNotExist) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  battery.loadSRAM(data)
+  return nil
+}
+
+func (cpu *Cpu) batteryBackedCartridge() (BatteryBacked, bool) {
+  battery, ok := cpu.Bus.cartridge.(BatteryBacked)
+  if !ok || !battery.hasBattery() {
+    return nil, false
+  }
+  return battery, true
+}
+
+// the whole .sav file, and the part of it that only changes when
+// the game does
+func saveFileData(battery BatteryBacked) ([]byte, []byte) {
+  data := battery.sram()
+  state := data
+  if footer, ok := battery.(saveFileFooter); ok {
+    extra := footer.saveFileFooter()
+    data = append(append([]byte(nil), data...), extra...)
+    state = data[:len(state) + min(len(extra), footer.footerStateSize())]
+  }
+  return data, state
+}
+
+// SaveRAM writes battery-backed cartridge RAM to the .sav file, in
+// the raw format other emulators use. It's a no-op for cartridges
+// without a battery. Safe to call from any goroutine but the one
+// running Execute.
+func (cpu *Cpu) SaveRAM() error {
+  var err error
+  cpu.betweenCycles(func() {
+    err = cpu.saveRAM()
+  })
+  return err
+}
+
+func (cpu *Cpu) saveRAM() error {
+  battery, ok := cpu.batteryBackedCartridge()
+  if !ok {
+    return nil
+  }
+  data, state := saveFileData(battery)
+  // write + rename so a crash mid-write can't corrupt the save
+  path := SaveFilePath(cpu.Bus.romFilePath)
+  if err := os.WriteFile(path + ".tmp", data, 0644); err != nil {
+    return err
+  }
+  if err := os.Rename(path + ".tmp", path); err != nil {
+    return err
+  }
+  cpu.lastSavedSRAM = state
+  return nil
+}
+
+// flushSRAM is called periodically from Execute, and only touches
+// the disk if the game wrote to its RAM, or the clock moved, since
+// the last save. there's no one to return an error to, so it's
+// logged and we try again next time
+func (cpu *Cpu) flushSRAM() {
+  battery, ok := cpu.batteryBackedCartridge()
+  if !ok {
+    return
+  }
+  if _, state := saveFileData(battery); bytes.Equal(state, cpu.lastSavedSRAM) {
+    return
+  }
+  if err := cpu.saveRAM(); err != nil {
+    log.Printf("saving %s: %v", SaveFilePath(cpu.Bus.romFilePath), err)
+  }
+}
@@ -0,0 +1,155 @@
+package cpu
+
+import (
+  "os"
+  "testing"
+)
+
+// cartridgeType at 0147, 32KB of ROM and 8KB of RAM
+func newBatteryTestGameBoy(t *testing.T, name string, cartridgeType uint8) *Cpu {
+  return newGameBoyWithCode(t, name, map[uint16][]byte{
+    0x0147: {cartridgeType, 0x00, 0x02},
+  })
+}
+
+func TestSaveFileRoundTrip(t *testing.T) {
+  gb := newBatteryTestGameBoy(t, "battery", 0x13)
+  path := SaveFilePath(gb.Bus.romFilePath)
+
+  gb.flushSRAM()
+  if _, err := os.Stat(path); !os.IsNotExist(err) {
+    t.Fatalf("wrote a save file with nothing written to RAM: %v", err)
+  }
+
+  gb.Bus.cartridge.write(0x0000, 0x0A)
+  gb.Bus.cartridge.write(0xA000, 0x42)
+  gb.Bus.cartridge.write(0xBFFF, 0x99)
+  gb.flushSRAM()
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(data) != 8*1024 || data[0] != 0x42 || data[0x1FFF] != 0x99 {
+    t.Fatalf("save file is %d bytes, starting %02X and ending %02X", len(data), data[0], data[len(data) - 1])
+  }
+
+  cartridge, _, err := NewCartridge(gb.Bus.romFilePath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cartridge.write(0x0000, 0x0A)
+  if a, b := cartridge.read(0xA000), cartridge.read(0xBFFF); a != 0x42 || b != 0x99 {
+    t.Errorf("read back %02X and %02X, want 42 and 99", a, b)
+  }
+}
+
+func TestSaveFileRTCFooter(t *testing.T) {
+  gb := newBatteryTestGameBoy(t, "batteryrtc", 0x10)
+  path := SaveFilePath(gb.Bus.romFilePath)
+
+  // halted, so loading doesn't catch up with the wall clock
+  c := gb.Bus.cartridge
+  c.write(0x0000, 0x0A)
+  c.write(0xA000, 0x42)
+  for register, value := range map[uint8]uint8{RTC_S: 12, RTC_M: 34, RTC_H: 5, RTC_DL: 0x67, RTC_DH: 0xC1} {
+    c.write(0x4000, register)
+    c.write(0xA000, value)
+  }
+  if err := gb.SaveRAM(); err != nil {
+    t.Fatal(err)
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(data) != 8*1024 + RTC_FOOTER_SIZE {
+    t.Fatalf("save file is %d bytes", len(data))
+  }
+
+  // only the footer's timestamp is different, so no need to write it
+  os.Remove(path)
+  gb.flushSRAM()
+  if _, err := os.Stat(path); !os.IsNotExist(err) {
+    t.Errorf("rewrote the save file with nothing written to RAM: %v", err)
+  }
+  os.WriteFile(path, data, 0644)
+
+  cartridge, _, err := NewCartridge(gb.Bus.romFilePath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  mbc3 := cartridge.(*MBC3)
+  rtc := mbc3.rtc
+  if rtc.seconds != 12 || rtc.minutes != 34 || rtc.hours != 5 || rtc.days != 0x167 || !rtc.halted || !rtc.dayCarry {
+    t.Errorf("clock read back as %+v", rtc)
+  }
+  if got, want := rtc.latched, [5]uint8{12, 34, 5, 0x67, 0xC1}; got != want {
+    t.Errorf("latched registers are % X, want % X", got, want)
+  }
+  mbc3.write(0x0000, 0x0A)
+  mbc3.write(0x4000, 0x00)
+  if a := mbc3.read(0xA000); a != 0x42 {
+    t.Errorf("RAM read back %02X, want 42", a)
+  }
+}
+
+func TestSaveFileRTCOnly(t *testing.T) {
+  // MBC3+TIMER+BATTERY, no RAM at all
+  gb := newGameBoyWithCode(t, "batteryrtconly", map[uint16][]byte{
+    0x0147: {0x0F, 0x00, 0x00},
+  })
+  path := SaveFilePath(gb.Bus.romFilePath)
+
+  gb.flushSRAM()
+  if _, err := os.Stat(path); !os.IsNotExist(err) {
+    t.Fatalf("wrote a save file with the clock where it was: %v", err)
+  }
+
+  gb.Bus.cartridge.(*MBC3).rtc.tick()
+  gb.flushSRAM()
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(data) != RTC_FOOTER_SIZE || data[0] != 1 {
+    t.Errorf("save file is %d bytes, with seconds at %02X", len(data), data[0])
+  }
+}
+
+func TestSaveFileRetry(t *testing.T) {
+  gb := newBatteryTestGameBoy(t, "batteryretry", 0x13)
+  path := SaveFilePath(gb.Bus.romFilePath)
+  // nothing can be renamed over a directory
+  if err := os.Mkdir(path, 0755); err != nil {
+    t.Fatal(err)
+  }
+
+  gb.Bus.cartridge.write(0x0000, 0x0A)
+  gb.Bus.cartridge.write(0xA000, 0x42)
+  gb.flushSRAM()
+  if err := gb.SaveRAM(); err == nil {
+    t.Error("saved over a directory")
+  }
+
+  // the next flush tries again
+  os.Remove(path)
+  gb.flushSRAM()
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if data[0] != 0x42 {
+    t.Errorf("save file starts %02X, want 42", data[0])
+  }
+}
+
+func TestBadSaveFile(t *testing.T) {
+  gb := newBatteryTestGameBoy(t, "batterybad", 0x13)
+  // a directory can't be read as a file
+  if err := os.Mkdir(SaveFilePath(gb.Bus.romFilePath), 0755); err != nil {
+    t.Fatal(err)
+  }
+  if _, _, err := NewCartridge(gb.Bus.romFilePath); err == nil {
+    t.Error("loaded a cartridge whose save file can't be read")
+  }
+}
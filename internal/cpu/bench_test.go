@@ -0,0 +1,90 @@
+package cpu
+
+import (
+  "flag"
+  "os"
+  "testing"
+)
+
+// e.g. go test ./internal/cpu -run '^$' -bench . -bench-rom ../gameboy_resources/Tetris.gb
+// or set GAMEBOY_BENCH_ROM
+var benchROM = flag.String("bench-rom", os.Getenv("GAMEBOY_BENCH_ROM"), "ROM for BenchmarkROM")
+
+// an op is one frame, so allocs/op is per frame too
+func benchmarkFrames(b *testing.B, gb *Cpu) {
+  // start-up isn't what's being measured
+  if _, err := gb.RunUntil(RunLimits{Frames: 1}); err != nil {
+    b.Fatal(err)
+  }
+  b.ReportAllocs()
+  b.ResetTimer()
+  if _, err := gb.RunUntil(RunLimits{Frames: uint64(b.N)}); err != nil {
+    b.Fatal(err)
+  }
+  b.ReportMetric(float64(b.N) / b.Elapsed().Seconds(), "frames/s")
+}
+
+// something for every part of the hot path: the LCD on with 40
+// sprites, a VBlank interrupt every frame and the CPU never halting
+func newBenchGameBoy(tb testing.TB) *Cpu {
+  return newGameBoyWithCode(tb, "bench", map[uint16][]byte{
+    0x0040: {0xD9}, // RETI
+    0x0150: {
+      0xF3,             // 0150 DI
+      0xAF,             // 0151 XOR A
+      0xE0, 0x40,       // 0152 LDH (LCDC),A
+      0x21, 0x00, 0xFE, // 0154 LD HL,$FE00
+      0x0E, 0x28,       // 0157 LD C,40
+      0x3E, 0x10,       // 0159 LD A,$10
+      0x22,             // 015B LD (HL+),A, Y
+      0x22,             // 015C LD (HL+),A, X
+      0x36, 0x01,       // 015D LD (HL),$01, one of the logo's tiles
+      0x23,             // 015F INC HL
+      0x36, 0x00,       // 0160 LD (HL),$00
+      0x23,             // 0162 INC HL
+      0xC6, 0x03,       // 0163 ADD A,$03
+      0x0D,             // 0165 DEC C
+      0x20, 0xF3,       // 0166 JR NZ,$015B
+      0x3E, 0x93,       // 0168 LD A,$93, LCD, sprites and BG on
+      0xE0, 0x40,       // 016A LDH (LCDC),A
+      0x3E, 0x01,       // 016C LD A,$01
+      0xE0, 0xFF,       // 016E LDH (IE),A
+      0x21, 0x00, 0xC0, // 0170 LD HL,$C000
+      0xFB,             // 0173 EI
+      0x2C,             // 0174 INC L
+      0x77,             // 0175 LD (HL),A
+      0x3C,             // 0176 INC A
+      0x20, 0xFB,       // 0177 JR NZ,$0174
+      0x18, 0xF9,       // 0179 JR $0174
+    },
+  })
+}
+
+func BenchmarkFrames(b *testing.B) {
+  benchmarkFrames(b, newBenchGameBoy(b))
+}
+
+// keeps BenchmarkFrames' 0 allocs/op from creeping back up
+func TestFrameAllocs(t *testing.T) {
+  gb := newBenchGameBoy(t)
+  if _, err := gb.RunUntil(RunLimits{Frames: 1}); err != nil {
+    t.Fatal(err)
+  }
+  allocs := testing.AllocsPerRun(10, func() {
+    gb.RunUntil(RunLimits{Frames: 1})
+  })
+  if allocs > 0 {
+    t.Errorf("%.0f allocations a frame", allocs)
+  }
+}
+
+func BenchmarkROM(b *testing.B) {
+  if *benchROM == "" {
+    b.Skip("no ROM, set -bench-rom or GAMEBOY_BENCH_ROM")
+  }
+  gb, err := NewGameBoy(benchROM, "", DMG, true)
+  if err != nil {
+    b.Fatal(err)
+  }
+  benchmarkFrames(b, gb)
+}
@@ -0,0 +1,110 @@
+package cpu
+
+import (
+  "crypto/md5"
+  "encoding/hex"
+  "fmt"
+  "os"
+)
+
+// https://gbdev.io/pandocs/Power_Up_Sequence.html
+
+type Model uint8
+
+const (
+  DMG0 Model = iota
+  DMG
+  MGB
+  SGB
+  SGB2
+  CGB
+)
+
+func (m Model) String() string {
+  switch m {
+  case DMG0:
+    return "DMG0"
+  case DMG:
+    return "DMG"
+  case MGB:
+    return "MGB"
+  case SGB:
+    return "SGB"
+  case SGB2:
+    return "SGB2"
+  case CGB:
+    return "CGB"
+  default:
+    return "unknown"
+  }
+}
+
+const (
+  DMG_BOOT_ROM_SIZE = 0x100
+  // 0x000-0x0FF and 0x200-0x8FF, the cartridge header shows through in between
+  CGB_BOOT_ROM_SIZE = 0x900
+)
+
+// md5 of the known dumps. anything else of the right size is
+// assumed to be a patched or homebrew DMG/CGB boot ROM
+var bootROMHashes = map[string]Model{
+  "a8f84a0ac44da5d3f0ee19f9cea80a8c": DMG0,
+  "32fbbd84168d3482956eb3c5051637f5": DMG,
+  "71a378e71ff30b2d8a1f02bf5c7896aa": MGB,
+  "d574d4f9c12f305074798f54c091a8b4": SGB,
+  "e0430bca9925fb9882148fd2dc2418c1": SGB2,
+  "dbfce9db9deaa2567f6a84fde55f9680": CGB,
+  "7c773f3c0b01cb73bca8e83227287b7f": CGB,
+}
+
+type BootROM struct {
+  data []Register8
+  model Model
+}
+
+// LoadBootROM reads a boot ROM dump and works out which model
+// it's from by its hash, falling back to its size
+func LoadBootROM(path string) (*BootROM, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("can't read boot ROM: %w", err)
+  }
+
+  bootROM := BootROM{}
+  sum := md5.Sum(data)
+  if model, ok := bootROMHashes[hex.EncodeToString(sum[:])]; ok {
+    bootROM.model = model
+  } else {
+    switch len(data) {
+    case DMG_BOOT_ROM_SIZE:
+      bootROM.model = DMG
+    case CGB_BOOT_ROM_SIZE:
+      bootROM.model = CGB
+    default:
+      return nil, fmt.Errorf("%s is %d bytes, boot ROMs are %d (DMG/MGB/SGB) or %d (CGB) bytes", path, len(data), DMG_BOOT_ROM_SIZE, CGB_BOOT_ROM_SIZE)
+    }
+  }
+  if (bootROM.model == CGB) != (len(data) == CGB_BOOT_ROM_SIZE) {
+    return nil, fmt.Errorf("%s is %d bytes, which doesn't match a %s boot ROM", path, len(data), bootROM.model)
+  }
+
+  bootROM.data = make([]Register8, len(data))
+  bytesToRegisters(data, bootROM.data)
+  return &bootROM, nil
+}
+
+func (b *BootROM) Model() Model {
+  return b.model
+}
+
+// whether the boot ROM covers address while it's mapped in
+func (b *BootROM) maps(address uint16) bool {
+  if address < 0x100 {
+    return true
+  }
+  return address >= 0x200 && int(address) < len(b.data)
+}
+
+func (b *BootROM) read(address uint16) uint8 {
+  return b.data[address].read()
+}
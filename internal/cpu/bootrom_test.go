@@ -0,0 +1,100 @@
+package cpu
+
+import (
+  "crypto/md5"
+  "encoding/hex"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// size bytes, all fill apart from a marker at the start
+func writeBootROM(t *testing.T, size int, fill uint8) (string, []byte) {
+  data := make([]byte, size)
+  for i := range data {
+    data[i] = fill
+  }
+  if size > 0 {
+    data[0] = 0x31
+  }
+  path := filepath.Join(t.TempDir(), "boot.bin")
+  if err := os.WriteFile(path, data, 0644); err != nil {
+    t.Fatal(err)
+  }
+  return path, data
+}
+
+// there are no real dumps to test with, so this adds a made up image's
+// hash to the known ones for the length of the test
+func knownBootROM(t *testing.T, data []byte, model Model) {
+  sum := md5.Sum(data)
+  hash := hex.EncodeToString(sum[:])
+  bootROMHashes[hash] = model
+  t.Cleanup(func() {
+    delete(bootROMHashes, hash)
+  })
+}
+
+func TestLoadBootROM(t *testing.T) {
+  tests := []struct {
+    name string
+    size int
+    // -1 for an unknown hash
+    known int
+    want Model
+  }{
+    {"unknown DMG sized", DMG_BOOT_ROM_SIZE, -1, DMG},
+    {"unknown CGB sized", CGB_BOOT_ROM_SIZE, -1, CGB},
+    {"DMG0 by hash", DMG_BOOT_ROM_SIZE, int(DMG0), DMG0},
+    {"MGB by hash", DMG_BOOT_ROM_SIZE, int(MGB), MGB},
+    {"SGB by hash", DMG_BOOT_ROM_SIZE, int(SGB), SGB},
+    {"SGB2 by hash", DMG_BOOT_ROM_SIZE, int(SGB2), SGB2},
+    {"CGB by hash", CGB_BOOT_ROM_SIZE, int(CGB), CGB},
+  }
+  for i, test := range tests {
+    path, data := writeBootROM(t, test.size, uint8(i))
+    if test.known >= 0 {
+      knownBootROM(t, data, Model(test.known))
+    }
+    bootROM, err := LoadBootROM(path)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    if bootROM.Model() != test.want {
+      t.Errorf("%s: model %s, want %s", test.name, bootROM.Model(), test.want)
+    }
+    if bootROM.read(0x0000) != 0x31 || bootROM.read(uint16(test.size - 1)) != uint8(i) {
+      t.Errorf("%s: contents didn't load", test.name)
+    }
+    // the CGB one skips the cartridge header
+    cgb := test.size == CGB_BOOT_ROM_SIZE
+    if !bootROM.maps(0x00FF) || bootROM.maps(0x0100) || bootROM.maps(0x01FF) || bootROM.maps(0x0200) != cgb || bootROM.maps(0x08FF) != cgb || bootROM.maps(0x0900) {
+      t.Errorf("%s: maps the wrong addresses", test.name)
+    }
+  }
+}
+
+func TestLoadBootROMErrors(t *testing.T) {
+  if _, err := LoadBootROM(filepath.Join(t.TempDir(), "missing.bin")); err == nil {
+    t.Error("loaded a boot ROM that doesn't exist")
+  }
+  for _, size := range []int{0, 0xFF, 0x101, 0x200, 0x8FF, 0x1000} {
+    path, _ := writeBootROM(t, size, 0x00)
+    if _, err := LoadBootROM(path); err == nil {
+      t.Errorf("loaded a %d byte boot ROM", size)
+    }
+  }
+
+  // a known hash has to come with the right size too
+  path, data := writeBootROM(t, DMG_BOOT_ROM_SIZE, 0x77)
+  knownBootROM(t, data, CGB)
+  if _, err := LoadBootROM(path); err == nil {
+    t.Error("loaded a DMG sized CGB boot ROM")
+  }
+  path, data = writeBootROM(t, CGB_BOOT_ROM_SIZE, 0x78)
+  knownBootROM(t, data, SGB)
+  if _, err := LoadBootROM(path); err == nil {
+    t.Error("loaded a CGB sized SGB boot ROM")
+  }
+}
@@ -2,12 +2,9 @@ package cpu
 
 import (
   "fmt"
-	"log"
   "os"
 )
 
-const BOOT_ROM_FILEPATH = "/Users/jfeintzeig/projects/2023/gameboy/data/bootrom_dmg.gb"
-
 const (
   DIV = 0xFF04
   TIMA = 0xFF05
@@ -31,6 +28,29 @@ const (
   IE = 0xFFFF
   IF = 0xFF0F
   DMA = 0xFF46
+  NR10 = 0xFF10
+  NR11 = 0xFF11
+  NR12 = 0xFF12
+  NR13 = 0xFF13
+  NR14 = 0xFF14
+  NR21 = 0xFF16
+  NR22 = 0xFF17
+  NR23 = 0xFF18
+  NR24 = 0xFF19
+  NR30 = 0xFF1A
+  NR31 = 0xFF1B
+  NR32 = 0xFF1C
+  NR33 = 0xFF1D
+  NR34 = 0xFF1E
+  NR41 = 0xFF20
+  NR42 = 0xFF21
+  NR43 = 0xFF22
+  NR44 = 0xFF23
+  NR50 = 0xFF24
+  NR51 = 0xFF25
+  NR52 = 0xFF26
+  WAVE_RAM_START = 0xFF30
+  WAVE_RAM_END = 0xFF3F
 )
 
 type Mediator interface {
@@ -44,11 +64,15 @@ type Bus struct {
   hram [0x7F]Register8
   ppu *Ppu
   timers *Timers
+  apu *Apu
   joypad *Joypad
   romFilePath string
   cartridge Cartridge
-  bootROM Cartridge
+  header CartridgeHeader
+  bootROM *BootROM
   isBootROMMapped bool
+  // gameboy-doctor's logs are made with LY always reading 0x90, see trace.go
+  stubLY bool
 
   rIF Register8
   rIE Register8
@@ -61,20 +85,15 @@ type Bus struct {
 
 func (bus *Bus) ReadFromBus(address uint16) uint8 {
   switch {
-    case address < 0x100:
-      if bus.isBootROMMapped {
-        return bus.bootROM.read(address)
-      } else {
-        return bus.cartridge.read(address)
-      }
-    case address >= 0x100 && address < 0x8000:
+    case bus.isBootROMMapped && bus.bootROM.maps(address):
+      return bus.bootROM.read(address)
+    case address < 0x8000:
       return bus.cartridge.read(address)
     case address >= 0x8000 && address <= 0x9FFF:
       mode := Mode(bus.ReadFromBus(STAT) & 0x03)
       if mode == M3 {
-        // TODO
+        // TODO: VRAM is inaccessible in M3 and should read 0xFF
         return bus.ppu.read(address)
-        return 0xFF
       } else {
         return bus.ppu.read(address)
       }
@@ -87,14 +106,17 @@ func (bus *Bus) ReadFromBus(address uint16) uint8 {
     case address >= OAM_START && address <= OAM_END:
       mode := Mode(bus.ReadFromBus(STAT) & 0x03)
       if mode == M2 || mode == M3 {
-        // TODO
+        // TODO: OAM is inaccessible in M2/M3 and should read 0xFF
         return bus.ppu.read(address)
-        return 0xFF
       } else {
         return bus.ppu.read(address)
       }
     case (address == DIV || address == TIMA || address == TMA || address == TAC):
       return bus.timers.read(address)
+    case address >= NR10 && address <= WAVE_RAM_END:
+      return bus.apu.read(address)
+    case address == LY && bus.stubLY:
+      return 0x90
     case (address == LCDC || address == STAT || address == LY || address == LYC || address == SCX || address == SCY || address == WX || address == WY || address == BGP || address == OBP0 || address == OBP1):
       return bus.ppu.read(address)
     case address == P1:
@@ -138,6 +160,8 @@ func (bus *Bus) WriteToBus(address uint16, value uint8) {
       }
     case (address == DIV || address == TIMA || address == TMA || address == TAC):
       bus.timers.write(address, value)
+    case address >= NR10 && address <= WAVE_RAM_END:
+      bus.apu.write(address, value)
     case (address == LCDC || address == STAT || address == LY || address == LYC || address == SCX || address == SCY || address == WX || address == WY || address == BGP || address == OBP0 || address == OBP1):
       bus.ppu.write(address, value)
     case address == BANK:
@@ -163,6 +187,8 @@ func (bus *Bus) WriteToBus(address uint16, value uint8) {
 }
 
 func (bus *Bus) doCycle() {
+  bus.cartridge.doCycle()
+
   if !bus.dmaInProgress {
     return
   }
@@ -185,7 +211,8 @@ func (bus *Bus) doCycle() {
   }
 }
 
-func NewBus(romFilePath string, useBootROM bool) *Bus {
+// bootROMPath can be empty to start straight at 0x100
+func NewBus(romFilePath string, bootROMPath string) (*Bus, error) {
   bus := Bus{}
 
   // returns a *Ppu
@@ -195,27 +222,87 @@ func NewBus(romFilePath string, useBootROM bool) *Bus {
   timers := Timers{}
   timers.bus = &bus
   bus.timers = &timers
+  bus.apu = NewApu(&bus)
   bus.joypad = NewJoypad()
   bus.joypad.bus = &bus
 
   bus.romFilePath = romFilePath
-  bus.cartridge = NewCartridge(romFilePath, false)
-  bus.bootROM = NewCartridge(BOOT_ROM_FILEPATH, true)
-  bus.isBootROMMapped = useBootROM
+  cartridge, header, err := NewCartridge(romFilePath)
+  if err != nil {
+    return nil, err
+  }
+  bus.cartridge = cartridge
+  bus.header = header
+
+  if bootROMPath != "" {
+    bootROM, err := LoadBootROM(bootROMPath)
+    if err != nil {
+      return nil, err
+    }
+    bus.bootROM = bootROM
+    bus.isBootROMMapped = true
+  }
 
   bus.dmaInProgress = false
 
-  return &bus
+  return &bus, nil
+}
+
+func (bus *Bus) CartridgeHeader() CartridgeHeader {
+  return bus.header
+}
+
+func (bus *Bus) saveState(w *stateWriter) {
+  w.registers(bus.wram[:])
+  w.registers(bus.hram[:])
+  // IO registers that nothing else owns, e.g. serial and BANK
+  w.registers(bus.memory[0xFEA0:0xFF80])
+  w.bool(bus.isBootROMMapped)
+  w.u8(bus.rIF.read())
+  w.u8(bus.rIE.read())
+  w.bool(bus.dmaInProgress)
+  w.u16(bus.dmaStartAddress)
+  w.u8(bus.dmaCounter)
+}
+
+func (bus *Bus) loadState(r *stateReader) {
+  r.registers(bus.wram[:])
+  r.registers(bus.hram[:])
+  r.registers(bus.memory[0xFEA0:0xFF80])
+  bus.isBootROMMapped = r.bool()
+  if r.err == nil && bus.isBootROMMapped && bus.bootROM == nil {
+    r.fail(fmt.Errorf("save state was made while running a boot ROM, start with the same boot ROM to load it"))
+  }
+  bus.rIF.write(r.u8())
+  bus.rIE.write(r.u8())
+  bus.dmaInProgress = r.bool()
+  bus.dmaStartAddress = r.u16()
+  bus.dmaCounter = r.u8()
 }
 
 type Cartridge interface {
   read(uint16) uint8
   write(uint16, uint8)
+  // for hardware on the cartridge that runs off the clock, e.g. the MBC3 RTC
+  doCycle()
+  // banking and RAM, for save states. ROM isn't included
+  saveState(*stateWriter)
+  loadState(*stateReader)
+}
+
+// cartridges that can switch ROM banks. currentROMBank is the bank
+// mapped at address, for the debugger's banked breakpoints
+type bankedCartridge interface {
+  currentROMBank(address uint16) uint16
 }
 
 
 type NoMBC struct {
   rawCartridgeData []Register8
+
+  // ROM+RAM(+BATTERY) carts, 0x08 and 0x09
+  ram []Register8
+  battery bool
 }
 
 func (c *NoMBC) read(address uint16) uint8 {
@@ -223,6 +310,10 @@ func (c *NoMBC) read(address uint16) uint8 {
   case address <= 0x7FFF:
     return c.rawCartridgeData[address].read()
   case address >= 0xA000 && address <= 0xBFFF:
+    idx := int(address - 0xA000)
+    if idx < len(c.ram) {
+      return c.ram[idx].read()
+    }
     return 0xFF
   default:
     return 0xFF
@@ -230,8 +321,35 @@ func (c *NoMBC) read(address uint16) uint8 {
 }
 
 func (c *NoMBC) write(address uint16, value uint8) {
-  //NoMBC is read-only
-  return
+  //NoMBC ROM is read-only
+  if address >= 0xA000 && address <= 0xBFFF {
+    idx := int(address - 0xA000)
+    if idx < len(c.ram) {
+      c.ram[idx].write(value)
+    }
+  }
+}
+
+func (c *NoMBC) doCycle() {}
+
+func (c *NoMBC) hasBattery() bool {
+  return c.battery
+}
+
+func (c *NoMBC) sram() []byte {
+  return registersToBytes(c.ram)
+}
+
+func (c *NoMBC) loadSRAM(data []byte) {
+  bytesToRegisters(data, c.ram)
+}
+
+func (c *NoMBC) saveState(w *stateWriter) {
+  w.registers(c.ram)
+}
+
+func (c *NoMBC) loadState(r *stateReader) {
+  r.registers(c.ram)
 }
 
 type MBC1 struct {
@@ -245,6 +363,7 @@ type MBC1 struct {
   isRAMEnabled bool
 
   ram []Register8
+  battery bool
 }
 
 func (c *MBC1) romsizemask() uint8 {
@@ -264,36 +383,50 @@ func (c *MBC1) romsizemask() uint8 {
 
 }
 
+// bank mapped at 0x0000-0x3FFF, only ever not 0 on 1MB+ carts in mode 1
+func (c *MBC1) zeroBank() uint8 {
+  if c.mode == 0 {
+    return 0
+  }
+  if c.romSize < 1024*1024 {
+    return 0
+  } else if c.romSize == 1024*1024 {
+    return GetBit(c.ramBank,0) << 5
+  } else if c.romSize == 2*1024*1024 {
+    return c.ramBank << 5
+  } else {
+    panic("unknown rom size for MBC1 reads")
+  }
+}
+
+// bank mapped at 0x4000-0x7FFF
+func (c *MBC1) highBank() uint8 {
+  highbanknumber := c.romBank & c.romsizemask()
+  if c.romSize == 1024*1024 {
+    highbanknumber = SetBit(highbanknumber, 5, c.ramBank & 0x01)
+  }
+  if c.romSize == 2*1024*1024 {
+    highbanknumber = SetBit(highbanknumber, 5, c.ramBank & 0x01)
+    highbanknumber = SetBit(highbanknumber, 6, c.ramBank & 0x02)
+  }
+  return highbanknumber
+}
+
+func (c *MBC1) currentROMBank(address uint16) uint16 {
+  if address <= 0x3FFF {
+    return uint16(c.zeroBank())
+  }
+  return uint16(c.highBank())
+}
+
 func (c *MBC1) read(address uint16) uint8 {
   var idx uint16
   switch {
   case address <= 0x3FFF:
-    if c.mode == 0 {
-      idx = address
-    } else {
-      var zerobanknumber uint8
-      if c.romSize < 1024*1024 {
-        zerobanknumber = 0
-      } else if c.romSize == 1024*1024 {
-        zerobanknumber = GetBit(c.ramBank,0) << 5
-      } else if c.romSize == 2*1024*1024 {
-        zerobanknumber = c.ramBank << 5
-      } else {
-        panic("unknown rom size for MBC1 reads")
-      }
-      idx = 0x4000 * uint16(zerobanknumber) + address
-    }
+    idx = 0x4000 * uint16(c.zeroBank()) + address
     return c.rawCartridgeData[idx].read()
   case address >= 0x4000 && address <= 0x7FFF:
-    highbanknumber := c.romBank & c.romsizemask()
-    if c.romSize == 1024*1024 {
-      highbanknumber = SetBit(highbanknumber, 5, c.ramBank & 0x01)
-    }
-    if c.romSize == 2*1024*1024 {
-      highbanknumber = SetBit(highbanknumber, 5, c.ramBank & 0x01)
-      highbanknumber = SetBit(highbanknumber, 6, c.ramBank & 0x02)
-    }
-    idx = 0x4000 * uint16(highbanknumber) + (address - 0x4000)
+    idx = 0x4000 * uint16(c.highBank()) + (address - 0x4000)
     return c.rawCartridgeData[idx].read()
   case address >= 0xA000 && address <= 0xBFFF:
     if c.isRAMEnabled {
@@ -349,60 +482,94 @@ func (c *MBC1) write(address uint16, value uint8) {
   }
 }
 
-func NewCartridge(romFilePath string, bootrom bool) Cartridge {
-  fi, err := os.Stat(romFilePath)
-  fSize := fi.Size()
+func (c *MBC1) doCycle() {}
+
+func (c *MBC1) hasBattery() bool {
+  return c.battery
+}
+
+func (c *MBC1) sram() []byte {
+  return registersToBytes(c.ram)
+}
+
+func (c *MBC1) loadSRAM(data []byte) {
+  bytesToRegisters(data, c.ram)
+}
+
+func (c *MBC1) saveState(w *stateWriter) {
+  w.u8(c.romBank)
+  w.u8(c.ramBank)
+  w.u8(c.mode)
+  w.bool(c.isRAMEnabled)
+  w.registers(c.ram)
+}
+
+func (c *MBC1) loadState(r *stateReader) {
+  c.romBank = r.u8()
+  c.ramBank = r.u8()
+  c.mode = r.u8()
+  c.isRAMEnabled = r.bool()
+  r.registers(c.ram)
+}
+
+func NewCartridge(romFilePath string) (Cartridge, CartridgeHeader, error) {
   data, err := os.ReadFile(romFilePath)
   if err != nil {
-    log.Fatal("can't find file")
+    return nil, CartridgeHeader{}, fmt.Errorf("can't read ROM: %w", err)
   }
 
-  cartridgeData := make([]Register8, fSize)
+  cartridgeData := make([]Register8, len(data))
   // implicit: index of array is address in memory :eek:
   for address, element := range data {
     cartridgeData[address].write(element)
   }
 
-  if bootrom {
-    return &NoMBC{rawCartridgeData: cartridgeData}
+  header, err := ParseCartridgeHeader(data)
+  if err != nil {
+    return nil, header, err
+  }
+  cartridgeType := header.CartridgeType
+  romSize := header.ROMSize
+  // go by the file if the header doesn't say
+  if !header.ROMSizeValid() {
+    romSize = uint32(len(data))
   }
 
-  cartridgeType := cartridgeData[0x147].read()
-  var romSize uint32 = 32 * 1024 * (1 << cartridgeData[0x148].read())
-
-  // https://gbdev.io/pandocs/The_Cartridge_Header.html#0149--ram-size
-  ramSizeIndicator := cartridgeData[0x149].read()
   var ramSize uint32
-  ramCartridgeType := map[int]bool{0x02: true, 0x03: true, 0x08: true, 0x09: true, 0x0C: true, 0x0D: true, 0x10: true, 0x12: true, 0x13: true, 0x1A: true, 0x1B: true, 0x1D: true, 0x1E: true}
-  if _, ok := ramCartridgeType[int(cartridgeType)]; !ok {
-    ramSize = 0
-  } else {
-    switch ramSizeIndicator {
-    case 0x00, 0x01:
-      ramSize = 0
-    case 0x02:
-      ramSize = 8*1024
-    case 0x03:
-      ramSize = 32*1024
-    case 0x04:
-      ramSize = 128*1024
-    case 0x05:
-      ramSize = 64*1024
-    default:
-      fmt.Printf("unknown ram size!\n")
-      ramSize = 0
-  }
+  battery := header.HasBattery()
+  if header.HasRAM() {
+    ramSize = header.RAMSize
   }
 
+  var cartridge Cartridge
   if cartridgeType == 0x00 {
-    return &NoMBC{rawCartridgeData: cartridgeData}
+    cartridge = &NoMBC{rawCartridgeData: cartridgeData}
+  } else if cartridgeType == 0x08 || cartridgeType == 0x09 {
+    ram := make([]Register8, ramSize)
+    cartridge = &NoMBC{rawCartridgeData: cartridgeData, ram: ram, battery: battery}
   } else if cartridgeType == 0x01 {
     ramSize = 0x00
-    return &MBC1{rawCartridgeData: cartridgeData, romSize: romSize, ramSize: uint16(ramSize), romBank: 1}
+    cartridge = &MBC1{rawCartridgeData: cartridgeData, romSize: romSize, ramSize: uint16(ramSize), romBank: 1}
   } else if cartridgeType <= 0x03 {
     ram := make([]Register8, ramSize)
-    return &MBC1{rawCartridgeData: cartridgeData, romSize: romSize, ramSize: uint16(ramSize), romBank: 1, ram: ram}
+    cartridge = &MBC1{rawCartridgeData: cartridgeData, romSize: romSize, ramSize: uint16(ramSize), romBank: 1, ram: ram, battery: battery}
+  } else if cartridgeType == 0x05 || cartridgeType == 0x06 {
+    cartridge = NewMBC2(cartridgeData, battery)
+  } else if cartridgeType >= 0x0F && cartridgeType <= 0x13 {
+    hasRTC := cartridgeType == 0x0F || cartridgeType == 0x10
+    cartridge = NewMBC3(cartridgeData, romSize, ramSize, hasRTC, battery)
+  } else if cartridgeType >= 0x19 && cartridgeType <= 0x1E {
+    hasRumble := cartridgeType >= 0x1C
+    cartridge = NewMBC5(cartridgeData, romSize, ramSize, hasRumble, battery)
   } else {
-    panic("unknown MBC type!")
+    return nil, header, fmt.Errorf("unsupported cartridge type %02X (%s)", cartridgeType, header.CartridgeTypeName())
+  }
+
+  if battery, ok := cartridge.(BatteryBacked); ok && battery.hasBattery() {
+    // carrying on would overwrite the save with a blank one
+    if err := loadSaveFile(battery, SaveFilePath(romFilePath)); err != nil {
+      return nil, header, fmt.Errorf("couldn't load save file: %w", err)
+    }
   }
+  return cartridge, header, nil
 }
@@ -1,8 +1,13 @@
 package cpu
 
 import (
+  "bufio"
   "encoding/hex"
   "fmt"
+  "jfeintzeig/gameboy/internal/disasm"
+  "os"
+  "sync"
+  "sync/atomic"
   "time"
 )
 
@@ -60,12 +65,12 @@ func (t *Timers) writeTma(value uint8) {
 }
 
 func (t *Timers) readTAC() uint8 {
-  var cs uint8
+  // the top 5 bits are unused and read as 1s
+  var cs uint8 = 0xF8
   switch t.timaMask {
-    case 1023: cs = 0x00
-    case 15: cs = 0x01
-    case 63: cs = 0x02
-    case 255: cs = 0x03
+    case 15: cs |= 0x01
+    case 63: cs |= 0x02
+    case 255: cs |= 0x03
   }
 
   return SetBitBool(cs, 2, t.timaEnabled)
@@ -91,7 +96,6 @@ func (t *Timers) readDiv() uint8 {
 
 func (t *Timers) writeDiv(value uint8) {
   // TODO: deal with edge cases
-  // TODO: implement STOP instruction
   // if MSB of timer changes from 1 to 0, tima increases
   msb := t.divCounter & t.timaMask
   switch t.timaMask {
@@ -118,6 +122,26 @@ func (t *Timers) writeTima(value uint8) {
   }
 }
 
+func (t *Timers) saveState(w *stateWriter) {
+  w.u8(t.tima.read())
+  w.u8(t.tma.read())
+  w.u16(t.divCounter)
+  w.u16(t.timaMask)
+  w.bool(t.timaEnabled)
+  w.bool(t.justOverflowed)
+  w.bool(t.afterJustOverflowed)
+}
+
+func (t *Timers) loadState(r *stateReader) {
+  t.tima.write(r.u8())
+  t.tma.write(r.u8())
+  t.divCounter = r.u16()
+  t.timaMask = r.u16()
+  t.timaEnabled = r.bool()
+  t.justOverflowed = r.bool()
+  t.afterJustOverflowed = r.bool()
+}
+
 // TODO: other weird edge cases w/writing to DIV or TAC
 func (t *Timers) doCycle() {
   //fmt.Printf("counter: %d, div: %X, tima: %X, mask: %X, enabled: %t, tma: %X, tac: %X, int: %X\n",t.divCounter, t.readDiv(), t.tima.read(), t.timaMask, t.timaEnabled, t.tma.read(), t.readTAC(), t.bus.ReadFromBus(0xFF0F))
@@ -149,137 +173,153 @@ func (t *Timers) doCycle() {
   }
 }
 
+// OpcodeToInstruction is the entry for op in opcodeTable
 func (cpu *Cpu) OpcodeToInstruction(op Opcode) *Instruction {
-      // TODO: improve? i can go from op -> stringcode if all
-      // params are specified. if not, maybe i can fall back to
-      // fewer and fewer params to catch them all?
-      var inst Instruction
-      if op.Prefixed {
-        switch {
-          case op.X == 0:
-            inst = cpu.InstructionMap["CBX0"]
-          case op.X == 1:
-            inst = cpu.InstructionMap["CBX1"]
-          case op.X == 2:
-            inst = cpu.InstructionMap["CBX2"]
-          case op.X == 3:
-            inst = cpu.InstructionMap["CBX3"]
-          default:
-            err := fmt.Sprintf("CB-prefixed not implemented, instr: %v",op)
-            panic(err)
-        }
-        return &inst
-      } else {
+  return &opcodeTable[opcodeIndex(op)]
+}
 
-        switch {
-        case (op.X == 0) && (op.Z == 0) && (op.Y == 0):
-          inst = cpu.InstructionMap["X0Z0Y0"]
-        case (op.X == 0) && (op.Z == 0) && (op.Y == 1):
-          inst = cpu.InstructionMap["X0Z0Y1"]
-        case (op.X == 0) && (op.Z == 0) && (op.Y == 2):
-          inst = cpu.InstructionMap["X0Z0Y2"]
-        case (op.X == 0) && (op.Z == 0) && (op.Y == 3):
-          inst = cpu.InstructionMap["X0Z0Y3"]
-        case (op.X == 0) && (op.Z == 0) && (op.Y >= 4):
-          inst = cpu.InstructionMap["X0Z0Ygte4"]
-        case (op.X == 0) && (op.Z == 1) && (op.Q == 0):
-          inst = cpu.InstructionMap["X0Z1Q0"]
-        case (op.X == 0) && (op.Z == 1) && (op.Q == 1):
-          inst = cpu.InstructionMap["X0Z1Q1"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 0) && (op.Q == 0):
-          inst = cpu.InstructionMap["X0Z2P0Q0"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 1) && (op.Q == 0):
-          inst = cpu.InstructionMap["X0Z2P1Q0"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 2) && (op.Q == 0):
-          inst = cpu.InstructionMap["X0Z2P2Q0"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 3) && (op.Q == 0):
-          inst = cpu.InstructionMap["X0Z2P3Q0"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 0) && (op.Q == 1):
-          inst = cpu.InstructionMap["X0Z2P0Q1"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 1) && (op.Q == 1):
-          inst = cpu.InstructionMap["X0Z2P1Q1"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 2) && (op.Q == 1):
-          inst = cpu.InstructionMap["X0Z2P2Q1"]
-        case (op.X == 0) && (op.Z == 2) && (op.P == 3) && (op.Q == 1):
-          inst = cpu.InstructionMap["X0Z2P3Q1"]
-        case (op.X == 0) && (op.Z == 3):
-          inst = cpu.InstructionMap["X0Z3"]
-        case (op.X == 0) && (op.Z == 4):
-          inst = cpu.InstructionMap["X0Z4"]
-        case (op.X == 0) && (op.Z == 5):
-          inst = cpu.InstructionMap["X0Z5"]
-        case (op.X == 0) && (op.Z == 6):
-          inst = cpu.InstructionMap["X0Z6"]
-        case (op.X == 0) && (op.Z == 7) && (op.Y <= 3):
-          inst = cpu.InstructionMap["X0Z7Ylte3"]
-        case (op.X == 0) && (op.Z == 7) && (op.Y == 4):
-          inst = cpu.InstructionMap["X0Z7Y4"]
-        case (op.X == 0) && (op.Z == 7) && (op.Y == 5):
-          inst = cpu.InstructionMap["X0Z7Y5"]
-        case (op.X == 0) && (op.Z == 7) && (op.Y == 6):
-          inst = cpu.InstructionMap["X0Z7Y6"]
-        case (op.X == 0) && (op.Z == 7) && (op.Y == 7):
-          inst = cpu.InstructionMap["X0Z7Y7"]
-        case (op.X == 1) && !(op.Z == 6 && op.Y == 6):
-          inst = cpu.InstructionMap["X1"]
-        case (op.X == 1) && (op.Z == 6) && (op.Y == 6):
-          inst = cpu.InstructionMap["X1Z6Y6"]
-        case op.X == 2:
-          inst = cpu.InstructionMap["X2"]
-          return &inst
-        case (op.X == 3) && (op.Z == 0) && (op.Y <= 3):
-          inst = cpu.InstructionMap["X3Z0Ylte3"]
-        case (op.X == 3) && (op.Z == 0) && (op.Y == 4):
-          inst = cpu.InstructionMap["X3Z0Y4"]
-        case (op.X == 3) && (op.Z == 0) && (op.Y == 5):
-          inst = cpu.InstructionMap["X3Z0Y5"]
-        case (op.X == 3) && (op.Z == 0) && (op.Y == 6):
-          inst = cpu.InstructionMap["X3Z0Y6"]
-        case (op.X == 3) && (op.Z == 0) && (op.Y == 7):
-          inst = cpu.InstructionMap["X3Z0Y7"]
-        case (op.X == 3) && (op.Z == 1) && (op.Q == 0):
-          inst = cpu.InstructionMap["X3Z1Q0"]
-        case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 0):
-          inst = cpu.InstructionMap["X3Z1Q1P0"]
-        case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 1):
-          inst = cpu.InstructionMap["X3Z1Q1P1"]
-        case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 2):
-          inst = cpu.InstructionMap["X3Z1Q1P2"]
-        case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 3):
-          inst = cpu.InstructionMap["X3Z1Q1P3"]
-        case (op.X == 3) && (op.Z == 2) && (op.Y <= 3):
-          inst = cpu.InstructionMap["X3Z2Ylte3"]
-        case (op.X == 3) && (op.Z == 2) && (op.Y == 4):
-          inst = cpu.InstructionMap["X3Z2Y4"]
-        case (op.X == 3) && (op.Z == 2) && (op.Y == 5):
-          inst = cpu.InstructionMap["X3Z2Y5"]
-        case (op.X == 3) && (op.Z == 2) && (op.Y == 6):
-          inst = cpu.InstructionMap["X3Z2Y6"]
-        case (op.X == 3) && (op.Z == 2) && (op.Y == 7):
-          inst = cpu.InstructionMap["X3Z2Y7"]
-        case (op.X == 3) && (op.Z == 3) && (op.Y == 0):
-          inst = cpu.InstructionMap["X3Z3Y0"]
-        case (op.X == 3) && (op.Y == 6) && (op.Z == 3):
-          inst = cpu.InstructionMap["X3Y6Z3"]
-        case (op.X == 3) && (op.Y == 7) && (op.Z == 3):
-          inst = cpu.InstructionMap["X3Y7Z3"]
-        case (op.X == 3) && (op.Z == 4) && (op.Y <= 3):
-          inst = cpu.InstructionMap["X3Z4Ylte3"]
-        case (op.X == 3) && (op.Z == 5) && (op.Q == 0):
-          inst = cpu.InstructionMap["X3Z5Q0"]
-        case (op.X == 3) && (op.Z == 5) && (op.P == 0) && (op.Q == 1):
-          inst = cpu.InstructionMap["X3Z5P0Q1"]
-        case (op.X == 3) && (op.Z == 6):
-          inst = cpu.InstructionMap["X3Z6"]
-        case (op.X == 3) && (op.Z == 7):
-          inst = cpu.InstructionMap["X3Z7"]
-        default:
-          fmt.Printf("unimplemented opcode: PC:%04X SP:%04X OC:%v\n", cpu.PC.read(), cpu.SP.read(), cpu.CurrentOpcode)
-          err := fmt.Sprintf("not implemented, instr: %v", op)
-          panic(err)
-        }
-        return &inst
-      }
+// every opcode's Instruction, 00-FF then CB 00-FF, and names for all
+// the micro-ops, built once at startup. in init because the micro-ops
+// look themselves up in the table
+var opcodeTable [0x200]Instruction
+var microOps microOpTable
+
+func init() {
+  opcodeTable, microOps = buildOpcodeTable()
+}
+
+func buildOpcodeTable() ([0x200]Instruction, microOpTable) {
+  groups, ops := makeInstructions()
+  var table [0x200]Instruction
+  for i := range table {
+    op := ByteToOpcode(uint8(i), i >= 0x100)
+    info := disasm.Opcodes[op.Full]
+    if op.Prefixed {
+      info = disasm.CBOpcodes[op.Full]
+    }
+    table[i] = Instruction{
+      mnemonic: info.Mnemonic,
+      nBytes: uint8(info.Length),
+      cycles: uint8(info.Cycles),
+      cyclesNotTaken: uint8(info.CyclesNotTaken),
+    }
+    if group, ok := groups[instructionKey(op)]; ok {
+      table[i].operations = group.operations
+    }
+  }
+  return table, newMicroOpTable(ops)
+}
+
+// the makeInstructions group op belongs to, or "" if it's one of the
+// opcodes that doesn't exist
+func instructionKey(op Opcode) string {
+  if op.Prefixed {
+    return fmt.Sprintf("CBX%d", op.X)
+  }
+
+  switch {
+  case (op.X == 0) && (op.Z == 0) && (op.Y == 0):
+    return "X0Z0Y0"
+  case (op.X == 0) && (op.Z == 0) && (op.Y == 1):
+    return "X0Z0Y1"
+  case (op.X == 0) && (op.Z == 0) && (op.Y == 2):
+    return "X0Z0Y2"
+  case (op.X == 0) && (op.Z == 0) && (op.Y == 3):
+    return "X0Z0Y3"
+  case (op.X == 0) && (op.Z == 0) && (op.Y >= 4):
+    return "X0Z0Ygte4"
+  case (op.X == 0) && (op.Z == 1) && (op.Q == 0):
+    return "X0Z1Q0"
+  case (op.X == 0) && (op.Z == 1) && (op.Q == 1):
+    return "X0Z1Q1"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 0) && (op.Q == 0):
+    return "X0Z2P0Q0"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 1) && (op.Q == 0):
+    return "X0Z2P1Q0"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 2) && (op.Q == 0):
+    return "X0Z2P2Q0"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 3) && (op.Q == 0):
+    return "X0Z2P3Q0"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 0) && (op.Q == 1):
+    return "X0Z2P0Q1"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 1) && (op.Q == 1):
+    return "X0Z2P1Q1"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 2) && (op.Q == 1):
+    return "X0Z2P2Q1"
+  case (op.X == 0) && (op.Z == 2) && (op.P == 3) && (op.Q == 1):
+    return "X0Z2P3Q1"
+  case (op.X == 0) && (op.Z == 3):
+    return "X0Z3"
+  case (op.X == 0) && (op.Z == 4):
+    return "X0Z4"
+  case (op.X == 0) && (op.Z == 5):
+    return "X0Z5"
+  case (op.X == 0) && (op.Z == 6):
+    return "X0Z6"
+  case (op.X == 0) && (op.Z == 7) && (op.Y <= 3):
+    return "X0Z7Ylte3"
+  case (op.X == 0) && (op.Z == 7) && (op.Y == 4):
+    return "X0Z7Y4"
+  case (op.X == 0) && (op.Z == 7) && (op.Y == 5):
+    return "X0Z7Y5"
+  case (op.X == 0) && (op.Z == 7) && (op.Y == 6):
+    return "X0Z7Y6"
+  case (op.X == 0) && (op.Z == 7) && (op.Y == 7):
+    return "X0Z7Y7"
+  case (op.X == 1) && !(op.Z == 6 && op.Y == 6):
+    return "X1"
+  case (op.X == 1) && (op.Z == 6) && (op.Y == 6):
+    return "X1Z6Y6"
+  case op.X == 2:
+    return "X2"
+  case (op.X == 3) && (op.Z == 0) && (op.Y <= 3):
+    return "X3Z0Ylte3"
+  case (op.X == 3) && (op.Z == 0) && (op.Y == 4):
+    return "X3Z0Y4"
+  case (op.X == 3) && (op.Z == 0) && (op.Y == 5):
+    return "X3Z0Y5"
+  case (op.X == 3) && (op.Z == 0) && (op.Y == 6):
+    return "X3Z0Y6"
+  case (op.X == 3) && (op.Z == 0) && (op.Y == 7):
+    return "X3Z0Y7"
+  case (op.X == 3) && (op.Z == 1) && (op.Q == 0):
+    return "X3Z1Q0"
+  case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 0):
+    return "X3Z1Q1P0"
+  case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 1):
+    return "X3Z1Q1P1"
+  case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 2):
+    return "X3Z1Q1P2"
+  case (op.X == 3) && (op.Z == 1) && (op.Q == 1) && (op.P == 3):
+    return "X3Z1Q1P3"
+  case (op.X == 3) && (op.Z == 2) && (op.Y <= 3):
+    return "X3Z2Ylte3"
+  case (op.X == 3) && (op.Z == 2) && (op.Y == 4):
+    return "X3Z2Y4"
+  case (op.X == 3) && (op.Z == 2) && (op.Y == 5):
+    return "X3Z2Y5"
+  case (op.X == 3) && (op.Z == 2) && (op.Y == 6):
+    return "X3Z2Y6"
+  case (op.X == 3) && (op.Z == 2) && (op.Y == 7):
+    return "X3Z2Y7"
+  case (op.X == 3) && (op.Z == 3) && (op.Y == 0):
+    return "X3Z3Y0"
+  case (op.X == 3) && (op.Y == 6) && (op.Z == 3):
+    return "X3Y6Z3"
+  case (op.X == 3) && (op.Y == 7) && (op.Z == 3):
+    return "X3Y7Z3"
+  case (op.X == 3) && (op.Z == 4) && (op.Y <= 3):
+    return "X3Z4Ylte3"
+  case (op.X == 3) && (op.Z == 5) && (op.Q == 0):
+    return "X3Z5Q0"
+  case (op.X == 3) && (op.Z == 5) && (op.P == 0) && (op.Q == 1):
+    return "X3Z5P0Q1"
+  case (op.X == 3) && (op.Z == 6):
+    return "X3Z6"
+  case (op.X == 3) && (op.Z == 7):
+    return "X3Z7"
+  }
+  return ""
 }
 
 func (cpu *Cpu) AddOpsToQueue(inst *Instruction) {
@@ -292,22 +332,36 @@ func (cpu *Cpu) FetchAndDecode() {
     // IncrementPC is initialized as `false` (b/c we want to start at 0x0)
     // and is also set to `false` by some instructions which set the PC
     // internally, e.g. `call`
-    // if isHalted, we don't increment PC, so we keep executing the HALT instr
-    oc := ByteToOpcode(cpu.Bus.ReadFromBus(cpu.PC.read()), false)
+    oc := ByteToOpcode(cpu.mem.ReadFromBus(cpu.PC.read()), false)
 
+    // HALT bug: PC doesn't move past this opcode, so it's read again as
+    // the first operand (or the CB suffix). the micro-ops read operands
+    // from PC+1, so backing PC up by one does that
+    haltBug := cpu.haltBug
+    cpu.haltBug = false
     if oc.Full == 0xCB {
-      cpu.PC.inc()
-      oc = ByteToOpcode(cpu.Bus.ReadFromBus(cpu.PC.read()), true)
+      if !haltBug {
+        cpu.PC.inc()
+      }
+      oc = ByteToOpcode(cpu.mem.ReadFromBus(cpu.PC.read()), true)
+    } else if haltBug {
+      cpu.PC.dec()
     }
 
     inst := cpu.OpcodeToInstruction(oc)
+    if inst.operations == nil {
+      // locks up a real one
+      panic(fmt.Sprintf("illegal opcode %02X at PC %04X", oc.Full, cpu.PC.read()))
+    }
     cpu.AddOpsToQueue(inst)
     cpu.CurrentOpcode = oc
 }
 
 func (cpu *Cpu) LogSerial() {
-  if cpu.Bus.ReadFromBus(0xFF02) != 0x0 {
+  // bit 7 of SC starts a transfer
+  if sc := cpu.Bus.ReadFromBus(0xFF02); GetBitBool(sc, 7) {
     serial := cpu.Bus.ReadFromBus(0xFF01)
+    cpu.serialOutput = append(cpu.serialOutput, serial)
     hexString := fmt.Sprintf("%X",serial)
     ascii, err := hex.DecodeString(hexString)
     if err != nil {
@@ -315,134 +369,197 @@ func (cpu *Cpu) LogSerial() {
     } else {
       fmt.Printf("%s",ascii)
     }
-    cpu.Bus.WriteToBus(0xFF02, 0x0)
+    cpu.Bus.WriteToBus(0xFF02, SetBitBool(sc, 7, false))
   }
 }
 
 // https://gbdev.io/pandocs/Interrupts.html#interrupts
-func (cpu *Cpu) DoInterrupts() {
-  cpu.justDidInterrupt = false
-  if !cpu.IME {
-    return
-  }
-
-  // hardcoded addresses of interrupt service routines
-  jumpFunctions := []func(*Cpu){
-    func (cpu *Cpu) {cpu.PC.write(0x40)},
-    func (cpu *Cpu) {cpu.PC.write(0x48)},
-    func (cpu *Cpu) {cpu.PC.write(0x50)},
-    func (cpu *Cpu) {cpu.PC.write(0x58)},
-    func (cpu *Cpu) {cpu.PC.write(0x60)},
-  }
-
-  interruptEnable := cpu.Bus.ReadFromBus(0xFFFF)
-  interruptFlags := cpu.Bus.ReadFromBus(0xFF0F)
-
-  interruptsToService := interruptFlags & interruptEnable
-
-  // priority from bit 0 -> 3
-  for _, index := range []uint8{0,1,2,3} {
-    isRequested := (interruptsToService >> index) & 0x01
-    if isRequested == 0x01 {
-      //fmt.Printf("serving interrupt IME:%t IE:%08b IF:%08b PC:%04X GC:%d\n", cpu.IME, cpu.Bus.ReadFromBus(IE), cpu.Bus.ReadFromBus(IF), cpu.PC.read(), cpu.globalCounter)
-      cpu.justDidInterrupt = true
-      // reset flag bit
-      mask := uint8(1 << index)
-      mask = ^mask
-      cpu.Bus.WriteToBus(IF, interruptFlags & mask)
-      // reset IME
-      cpu.IME = false
-      // push handling routine to queue
-      // 5 cycles: 2 no_op, push PC to stack, set PC to hardcoded address
-      cpu.ExecutionQueue.Push(no_op)
-      cpu.ExecutionQueue.Push(no_op)
-      cpu.ExecutionQueue.Push(int_call_push_hi)
-      cpu.ExecutionQueue.Push(int_call_push_lo)
-      cpu.ExecutionQueue.Push(jumpFunctions[index])
-      //fmt.Printf("interrupt %d PC %04X SP %04X OC %02X Stack %02X %02X %02X %02X EQ %v\n", index, cpu.PC.read(), cpu.SP.read(), cpu.CurrentOpcode.Full,
-      //  cpu.Bus.ReadFromBus(cpu.SP.read()),
-      //  cpu.Bus.ReadFromBus(cpu.SP.read()+1),
-      //  cpu.Bus.ReadFromBus(cpu.SP.read()+2),
-      //  cpu.Bus.ReadFromBus(cpu.SP.read()+3),
-      //  cpu.ExecutionQueue,
-      //  )
-      return
+// called instead of fetching the next instruction, which is where the
+// CPU checks for interrupts. dispatch takes 5 M-cycles: 2 waiting,
+// pushing PC high then low, then jumping. which interrupt it is isn't
+// settled until the second push, see int_call_push_lo
+func (cpu *Cpu) DoInterrupts() bool {
+  if !cpu.IME || !cpu.interruptPending() {
+    return false
+  }
+  cpu.IME = false
+  // EI right before a HALT with an interrupt pending: the HALT bug
+  // hits the return address instead, so the handler comes back to
+  // the HALT
+  if cpu.haltBug {
+    cpu.haltBug = false
+    cpu.PC.dec()
+  }
+  cpu.ExecutionQueue.Push(no_op)
+  cpu.ExecutionQueue.Push(no_op)
+  cpu.ExecutionQueue.Push(int_call_push_hi)
+  cpu.ExecutionQueue.Push(int_call_push_lo)
+  cpu.ExecutionQueue.Push(int_jump)
+  return true
+}
+
+// everything but the CPU, once per M-cycle
+// they tick before the CPU's half of the cycle, so an interrupt they
+// request is seen by a fetch in the same cycle
+func (cpu *Cpu) tickPeripherals() {
+  cpu.LogSerial()
+  // TODO: refactor all this into Bus.doCycle()
+  // STOP freezes DIV, the timers and the LCD. the APU keeps going so
+  // audio still paces run, and the joypad so it can wake up
+  if !cpu.isStopped {
+    cpu.Bus.timers.doCycle()
+  }
+  cpu.Bus.apu.doCycle()
+  cpu.Bus.joypad.doCycle()
+  cpu.Bus.doCycle()
+  if !cpu.isStopped {
+    cpu.Bus.ppu.doCycle()
+  }
+}
+
+// fetches the next instruction once the last one has finished,
+// returning whether it did
+func (cpu *Cpu) fetchIfIdle() bool {
+  if cpu.ExecutionQueue.Length() > 0 {
+    return false
+  }
+  // halted: nothing's fetched until an interrupt is pending, and waking
+  // up takes a cycle. then with IME=1 it's dispatched, otherwise the
+  // instruction after HALT is fetched
+  if cpu.isHalted {
+    if cpu.interruptPending() {
+      cpu.isHalted = false
+    }
+    cpu.ExecutionQueue.Push(no_op)
+    cpu.betweenInstructions = true
+    return false
+  }
+  // stopped: only a button press on a selected line wakes it up, which
+  // also requests the joypad interrupt
+  if cpu.isStopped {
+    if cpu.mem.ReadFromBus(P1) & 0x0F != 0x0F {
+      cpu.isStopped = false
     }
+    cpu.ExecutionQueue.Push(no_op)
+    cpu.betweenInstructions = true
+    return false
+  }
+  cpu.SetIME()
+  if cpu.DoInterrupts() {
+    cpu.betweenInstructions = true
+    return false
+  }
+  cpu.betweenInstructions = false
+  if cpu.trace != nil {
+    cpu.traceInstruction()
+  }
+  cpu.FetchAndDecode()
+  return true
+}
+
+// whether any enabled interrupt is requested, which is what wakes
+// HALT whatever IME is
+func (cpu *Cpu) interruptPending() bool {
+  registers := cpu.interruptRegisters()
+  return registers.ReadFromBus(IE) & registers.ReadFromBus(IF) & 0x1F != 0
+}
+
+// IE and IF are wired straight to the CPU's interrupt logic, so it
+// doesn't go through cpu.mem and set off watchpoints every cycle.
+// the SM83 tests don't have a Bus, only cpu.mem
+func (cpu *Cpu) interruptRegisters() Mediator {
+  if cpu.Bus == nil {
+    return cpu.mem
   }
+  return cpu.Bus
+}
+
+// one M-cycle of the current instruction
+func (cpu *Cpu) runMicroOp() {
+  microop := cpu.ExecutionQueue.Pop()
+  microop(cpu)
 }
 
 func (cpu *Cpu) Execute(forever bool, nCyles uint64) {
+  cpu.run(func(bool) bool {
+    return !forever && cpu.globalCounter == nCyles
+  })
+}
+
+// run steps the machine one M-cycle at a time until stop returns true.
+// stop is checked every cycle, with instructionBoundary set on cycles
+// where an instruction has just been fetched and not started yet
+func (cpu *Cpu) run(stop func(instructionBoundary bool) bool) {
   var counter uint64 = 0
   var loopsPerFrame uint64 = cpu.ClockSpeed / 60
   timePerFrame := time.Duration(16.74 * 1e6)
   start := time.Now()
 
-  startLogging := false
+  cpu.tasksMu.Lock()
+  cpu.running = true
+  cpu.tasksMu.Unlock()
+  defer func() {
+    cpu.tasksMu.Lock()
+    cpu.running = false
+    cpu.tasksMu.Unlock()
+    // anyone still waiting in betweenCycles
+    cpu.runTasks()
+  }()
 
   for {
-    cpu.DoInterrupts()
-    cpu.LogSerial()
-    // TODO: refactor all this into Bus.doCycle()
-    cpu.Bus.timers.doCycle()
-    cpu.Bus.joypad.doCycle()
-    cpu.Bus.doCycle()
-    // TODO: need to figure out _when_ to do interrupts!!!
-    // Timers -> Int -> PPU -> CPU: acid2 has no background, appears to hit LC_08 but not LC_10
-    //    why? looks like i never get LYC == LY int again, even though PPU appears to fire it by
-    //    setting IF. confirm in PPU logging that IE and IF look good at LYC=16. weird thing
-    //    is that the LYC == LY @ 08 interrupt appears to work as desired. so what's wrong?
-    //    ohh maybe RETI not setting IME correctly?
-    //    OK SetIME is broken: i assume PC will be incremented but RETI goes somewhere completely different,
-    //    which actually just runs HALT in a loop until an interrupt is fired+handled, but interrupt will never
-    //    be handled because IME is still false because PC was never incremented. need to refactor SetIME and EI
-    //    and RETI so it waits one instruction, not a specific PC
-    //    
-    // Timers -> PPU -> Int -> CPU: acid2 stuck in HALT after jumping to LC_08
-    cpu.Bus.ppu.doCycle()
-
-    if cpu.ExecutionQueue.Length() < 1 {
-        cpu.SetIME()
-        cpu.FetchAndDecode()
-        //if cpu.CurrentOpcode.Full == 0xC5 {
-        //  startLogging = true
-        //}
-        if cpu.PC.read() == 0x4879 {
-          startLogging = false
-        }
-        if startLogging {
-        fmt.Printf("PC %04X %s SP %04X OC %02X Stack: %02X %02X %02X %02X %02X %02X %02X %02X\n",
-          cpu.PC.read(), cpu.OpcodeToInstruction(cpu.CurrentOpcode).name, cpu.SP.read(), cpu.CurrentOpcode.Full,
-          cpu.Bus.ReadFromBus(cpu.SP.read()),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+1),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+2),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+3),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+4),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+5),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+6),
-          cpu.Bus.ReadFromBus(cpu.SP.read()+7),
-          )
-        }
+    // save states etc. from other goroutines
+    if cpu.hasTasks.Load() {
+      cpu.runTasks()
+    }
+    // while rewinding, see rewind.go. only tasks run
+    if cpu.paused.Load() {
+      time.Sleep(time.Millisecond)
+      counter = 0
+      start = time.Now()
+      continue
     }
 
-    if !forever && cpu.globalCounter == nCyles {
-      break
+    // stop broke out of the last run half way through this cycle, after
+    // the peripherals had ticked and the instruction was fetched, so
+    // only the micro-op is left
+    if cpu.midCycle {
+      cpu.midCycle = false
+    } else {
+      cpu.tickPeripherals()
+      if stop(cpu.fetchIfIdle()) {
+        cpu.midCycle = true
+        break
+      }
     }
 
-    microop := cpu.ExecutionQueue.Pop()
-    microop(cpu)
+    cpu.runMicroOp()
     counter++
 
-    // time true-up once per frame
+    // throttle once per frame: if audio is playing, the audio device
+    // is the clock master and we wait for it to drain the sample buffer,
+    // otherwise we sleep off whatever wall clock time is left
     if !cpu.fast && counter > loopsPerFrame {
-      delta := time.Now().Sub(start)
-      if delta < timePerFrame {
-        time.Sleep(timePerFrame - delta) // remaining time
+      if cpu.Bus.apu.output != nil {
+        cpu.Bus.apu.output.waitForSpace()
+      } else {
+        delta := time.Now().Sub(start)
+        if delta < timePerFrame {
+          time.Sleep(timePerFrame - delta) // remaining time
+        }
       }
       counter = 0
       start = time.Now()
     }
 
     cpu.globalCounter += 1
+
+    if cpu.globalCounter % sramFlushInterval == 0 {
+      cpu.flushSRAM()
+    }
+
+    if cpu.rewind != nil {
+      cpu.captureRewind()
+    }
   }
 }
 
@@ -470,21 +587,59 @@ type Cpu struct {
   rpTable []*Register16
   rp2Table []*Register16
 
-  InstructionMap map[string]Instruction
 
   ExecutionQueue Fifo[func(*Cpu)]
 
   Bus *Bus
+  // what the CPU reads and writes through. the Bus, except in tests
+  mem Mediator
 
   // Interrupts, maybe encapsulate this in a handler
   IMECountdown int8
   IME bool
   isHalted bool
-  justDidInterrupt bool
+  isStopped bool
+  // see run
+  midCycle bool
+  // see FetchAndDecode
+  haltBug bool
+  // where the interrupt being dispatched jumps to, see int_call_push_lo
+  interruptVector uint16
 
   fast bool
+  model Model
 
   globalCounter uint64
+
+  // the RAM and clock last written to the .sav file, see battery.go
+  lastSavedSRAM []byte
+
+  // everything sent over the serial port so far
+  serialOutput []byte
+
+  // work other goroutines need done between M-cycles, see betweenCycles
+  tasksMu sync.Mutex
+  tasks []func()
+  hasTasks atomic.Bool
+  running bool
+
+  // whether the micro-ops running are interrupt dispatch or time spent
+  // halted or stopped rather than an instruction, for profile.go. not
+  // in save states, it's only for looking at
+  betweenInstructions bool
+
+  // gameboy-doctor log, see trace.go
+  trace *bufio.Writer
+  traceFile *os.File
+
+  // see rewind.go
+  rewind *rewindBuffer
+  rewindInterval uint64
+  paused atomic.Bool
+}
+
+func (cpu *Cpu) Model() Model {
+  return cpu.model
 }
 
 func (cpu *Cpu) getFlagZ() uint8 {
@@ -541,14 +696,14 @@ func (cpu *Cpu) ReadNN() uint16 {
   // we want to pull 2 bytes _following_ pc
   // without changing PC
   // GB memory is little endian! so we switch the order here
-  return (uint16(cpu.Bus.ReadFromBus(cpu.PC.read()+2)) << 8) | uint16(cpu.Bus.ReadFromBus(cpu.PC.read()+1))
+  return (uint16(cpu.mem.ReadFromBus(cpu.PC.read()+2)) << 8) | uint16(cpu.mem.ReadFromBus(cpu.PC.read()+1))
 }
 
 func (cpu *Cpu) ReadN() uint8 {
   // pc is location of current opcode
   // we want to pull byte _following_ pc
   // without changing PC
-  return cpu.Bus.ReadFromBus(cpu.PC.read()+1)
+  return cpu.mem.ReadFromBus(cpu.PC.read()+1)
 }
 
 func (cpu *Cpu) ReadD() int8 {
@@ -614,8 +769,9 @@ func NewRegister16(hi *Register8, lo *Register8) Register16 {
   return reg16
 }
 
-func NewGameBoy(romFilePath *string, useBootRom bool, fast bool) *Cpu {
-  gb := Cpu{}
+// just the CPU, with no memory attached
+func newCpu() *Cpu {
+  gb := &Cpu{}
 
   gb.AF = NewRegister16(&gb.A, &gb.F)
   gb.BC = NewRegister16(&gb.B, &gb.C)
@@ -631,25 +787,36 @@ func NewGameBoy(romFilePath *string, useBootRom bool, fast bool) *Cpu {
   gb.ClockSpeed = ClockSpeed
   gb.rpTable = []*Register16{&gb.BC, &gb.DE, &gb.HL, &gb.SP}
   gb.rp2Table = []*Register16{&gb.BC, &gb.DE, &gb.HL, &gb.AF}
-  gb.InstructionMap = MakeInstructionMap()
+  // IME starts off, and stays off until EI/RETI
+  gb.IMECountdown = -1
+  return gb
+}
+
+// bootROMPath is the boot ROM to run first, or empty to skip it
+// and start in the state model's boot ROM would have left behind.
+// with a boot ROM the model comes from the boot ROM instead
+func NewGameBoy(romFilePath *string, bootROMPath string, model Model, fast bool) (*Cpu, error) {
+  gb := newCpu()
 
   // returns a *Bus
-  bus := NewBus(*romFilePath, useBootRom)
+  bus, err := NewBus(*romFilePath, bootROMPath)
+  if err != nil {
+    return nil, err
+  }
   gb.Bus = bus
+  gb.mem = bus
 
   gb.fast = fast
 
-  if !useBootRom {
-    gb.A.write(0x01)
-    gb.F.write(0xB0)
-    gb.B.write(0x00)
-    gb.C.write(0x13)
-    gb.D.write(0x00)
-    gb.E.write(0xD8)
-    gb.H.write(0x01)
-    gb.L.write(0x4D)
-    gb.SP.write(0xFFFE)
-    gb.PC.write(0x0100)
-  }
-  return &gb
+  if battery, ok := gb.batteryBackedCartridge(); ok {
+    _, gb.lastSavedSRAM = saveFileData(battery)
+  }
+
+  if bus.bootROM != nil {
+    gb.model = bus.bootROM.Model()
+  } else {
+    gb.model = model
+    gb.skipBootROM(model)
+  }
+  return gb, nil
 }
@@ -0,0 +1,564 @@
+package cpu
+
+import (
+  "errors"
+  "fmt"
+  "io/fs"
+  "jfeintzeig/gameboy/internal/disasm"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync/atomic"
+)
+
+// Debugger runs the machine in little steps and stops it on breakpoints
+// and watchpoints. it drives run directly, so nothing else should be
+// calling Execute or RunUntil while it's attached. breakpoints are checked
+// on instruction boundaries, i.e. once an instruction has been fetched and
+// before its first micro-op. watchpoints see every access the CPU makes
+// through cpu.mem, which the debugger wraps, and stop the machine the
+// cycle after the access. DMA and the PPU talk to the Bus directly so they
+// don't trigger them.
+
+type DebugStopReason int
+
+const (
+  // the step asked for finished
+  DEBUG_STEP DebugStopReason = iota
+  DEBUG_BREAKPOINT
+  DEBUG_WATCHPOINT
+  DEBUG_INTERRUPTED
+  DEBUG_CRASH
+)
+
+// DebugStop says why the machine stopped
+type DebugStop struct {
+  Reason DebugStopReason
+  Breakpoint *Breakpoint
+  Watchpoint *Watchpoint
+
+  // the access that hit the watchpoint
+  Address uint16
+  Value uint8
+  Write bool
+
+  // what the emulator panicked with
+  Err error
+}
+
+func (s DebugStop) String() string {
+  switch s.Reason {
+  case DEBUG_BREAKPOINT:
+    return fmt.Sprintf("breakpoint %d: %s", s.Breakpoint.ID, s.Breakpoint)
+  case DEBUG_WATCHPOINT:
+    access := "read"
+    if s.Write {
+      access = "write"
+    }
+    return fmt.Sprintf("watchpoint %d: %s %04X = %02X", s.Watchpoint.ID, access, s.Address, s.Value)
+  case DEBUG_INTERRUPTED:
+    return "interrupted"
+  case DEBUG_CRASH:
+    return fmt.Sprintf("emulator crashed: %v", s.Err)
+  default:
+    return ""
+  }
+}
+
+type Breakpoint struct {
+  ID int
+  // without an address the condition is checked before every instruction
+  HasAddress bool
+  Address uint16
+  // ROM bank the address has to be in, -1 for any
+  Bank int
+  Condition Condition
+  Hits int
+}
+
+func (bp *Breakpoint) String() string {
+  var parts []string
+  if bp.HasAddress {
+    if bp.Bank >= 0 {
+      parts = append(parts, fmt.Sprintf("%02X:%04X", bp.Bank, bp.Address))
+    } else {
+      parts = append(parts, fmt.Sprintf("%04X", bp.Address))
+    }
+  }
+  if len(bp.Condition) > 0 {
+    parts = append(parts, "if " + bp.Condition.String())
+  }
+  return strings.Join(parts, " ")
+}
+
+type Watchpoint struct {
+  ID int
+  // inclusive
+  Start uint16
+  End uint16
+  Read bool
+  Write bool
+  Hits int
+}
+
+func (wp *Watchpoint) String() string {
+  access := ""
+  if wp.Read {
+    access += "r"
+  }
+  if wp.Write {
+    access += "w"
+  }
+  if wp.Start == wp.End {
+    return fmt.Sprintf("%04X %s", wp.Start, access)
+  }
+  return fmt.Sprintf("%04X-%04X %s", wp.Start, wp.End, access)
+}
+
+// Condition is comparisons against registers that all have to hold,
+// e.g. A == 03 && HL >= C000
+type Condition []comparison
+
+type comparison struct {
+  register string
+  op string
+  value uint16
+}
+
+var comparisonPattern = regexp.MustCompile(`^\s*([A-Za-z]+)\s*(==|!=|<=|>=|<|>)\s*(\S+)\s*$`)
+
+// ParseCondition reads "REG OP VALUE" comparisons joined by &&. REG is
+// A F B C D E H L AF BC DE HL SP PC or LY, OP is one of == != < <= > >=
+// and VALUE is a number as in ParseNumber
+func ParseCondition(s string) (Condition, error) {
+  var condition Condition
+  for _, part := range strings.Split(s, "&&") {
+    match := comparisonPattern.FindStringSubmatch(part)
+    if match == nil {
+      return nil, fmt.Errorf("can't read condition %q, expected e.g. A == 3F", strings.TrimSpace(part))
+    }
+    register := strings.ToUpper(match[1])
+    width, ok := registerWidths[register]
+    if !ok {
+      return nil, fmt.Errorf("unknown register %s", match[1])
+    }
+    value, err := ParseNumber(match[3])
+    if err != nil {
+      return nil, err
+    }
+    if width == 8 && value > 0xFF {
+      return nil, fmt.Errorf("%s is 8 bits, can't be %X", register, value)
+    }
+    condition = append(condition, comparison{register, match[2], value})
+  }
+  return condition, nil
+}
+
+func (c Condition) String() string {
+  var parts []string
+  for _, cmp := range c {
+    if registerWidths[cmp.register] == 8 {
+      parts = append(parts, fmt.Sprintf("%s %s %02X", cmp.register, cmp.op, cmp.value))
+    } else {
+      parts = append(parts, fmt.Sprintf("%s %s %04X", cmp.register, cmp.op, cmp.value))
+    }
+  }
+  return strings.Join(parts, " && ")
+}
+
+func (c Condition) holds(cpu *Cpu) bool {
+  for _, cmp := range c {
+    value := cpu.registerValue(cmp.register)
+    var ok bool
+    switch cmp.op {
+    case "==":
+      ok = value == cmp.value
+    case "!=":
+      ok = value != cmp.value
+    case "<":
+      ok = value < cmp.value
+    case "<=":
+      ok = value <= cmp.value
+    case ">":
+      ok = value > cmp.value
+    case ">=":
+      ok = value >= cmp.value
+    }
+    if !ok {
+      return false
+    }
+  }
+  return true
+}
+
+var registerWidths = map[string]int{
+  "A": 8, "F": 8, "B": 8, "C": 8, "D": 8, "E": 8, "H": 8, "L": 8, "LY": 8,
+  "AF": 16, "BC": 16, "DE": 16, "HL": 16, "SP": 16, "PC": 16,
+}
+
+func (cpu *Cpu) registerValue(name string) uint16 {
+  pair := func(hi *Register8, lo *Register8) uint16 {
+    return uint16(hi.read()) << 8 | uint16(lo.read())
+  }
+  switch name {
+  case "A":
+    return uint16(cpu.A.read())
+  case "F":
+    return uint16(cpu.F.read())
+  case "B":
+    return uint16(cpu.B.read())
+  case "C":
+    return uint16(cpu.C.read())
+  case "D":
+    return uint16(cpu.D.read())
+  case "E":
+    return uint16(cpu.E.read())
+  case "H":
+    return uint16(cpu.H.read())
+  case "L":
+    return uint16(cpu.L.read())
+  case "LY":
+    return uint16(cpu.Bus.ppu.LY.read())
+  case "AF":
+    return pair(&cpu.A, &cpu.F)
+  case "BC":
+    return pair(&cpu.B, &cpu.C)
+  case "DE":
+    return pair(&cpu.D, &cpu.E)
+  case "HL":
+    return pair(&cpu.H, &cpu.L)
+  case "SP":
+    return cpu.SP.read()
+  case "PC":
+    return cpu.instructionAddress()
+  default:
+    panic("unknown register " + name)
+  }
+}
+
+// ParseNumber reads hex, which is what everything on the Game Boy is
+// written in, with an optional $ or 0x in front. # means decimal
+func ParseNumber(s string) (uint16, error) {
+  base := 16
+  switch {
+  case strings.HasPrefix(s, "#"):
+    s, base = s[1:], 10
+  case strings.HasPrefix(s, "$"):
+    s = s[1:]
+  case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+    s = s[2:]
+  }
+  value, err := strconv.ParseUint(s, base, 16)
+  if err != nil {
+    return 0, fmt.Errorf("not a 16 bit number: %q", s)
+  }
+  return uint16(value), nil
+}
+
+// the ROM bank mapped at address, or -1 outside ROM
+func (cpu *Cpu) romBankAt(address uint16) int {
+  if address > 0x7FFF {
+    return -1
+  }
+  if banked, ok := cpu.Bus.cartridge.(bankedCartridge); ok {
+    return int(banked.currentROMBank(address))
+  }
+  if address <= 0x3FFF {
+    return 0
+  }
+  return 1
+}
+
+type Debugger struct {
+  cpu *Cpu
+  // the Bus, without watchpoints, for looking at memory
+  inner Mediator
+
+  breakpoints []*Breakpoint
+  watchpoints []*Watchpoint
+  nextID int
+
+  // set by the watch bus, picked up at the next cycle
+  hit *DebugStop
+  interrupted atomic.Bool
+  // whether the last stop was on an instruction boundary
+  atBoundary bool
+  // labels, if there's a .sym file
+  symbols *disasm.Symbols
+  // where the instruction that's running started, PC moves on
+  // as its operands are read
+  current uint16
+
+  // see profile.go. per opcode, indexed like opcodeTable
+  profile [0x200]opcodeCounter
+}
+
+// watchBus sits between the CPU and the Bus and reports accesses
+// to watched addresses to the Debugger
+type watchBus struct {
+  inner Mediator
+  d *Debugger
+}
+
+func (w *watchBus) ReadFromBus(address uint16) uint8 {
+  value := w.inner.ReadFromBus(address)
+  w.d.checkWatchpoints(address, value, false)
+  return value
+}
+
+func (w *watchBus) WriteToBus(address uint16, value uint8) {
+  w.inner.WriteToBus(address, value)
+  w.d.checkWatchpoints(address, value, true)
+}
+
+// NewDebugger attaches a debugger to cpu
+func NewDebugger(cpu *Cpu) *Debugger {
+  d := &Debugger{cpu: cpu, inner: cpu.mem, nextID: 1}
+  cpu.mem = &watchBus{inner: cpu.mem, d: d}
+  return d
+}
+
+// LoadSymbols reads labels for breakpoints and disassembly from a
+// .sym file. with no path it tries the one next to the ROM, and it not
+// being there isn't an error
+func (d *Debugger) LoadSymbols(path string) error {
+  optional := path == ""
+  if optional {
+    path = disasm.SymbolsPath(d.cpu.Bus.romFilePath)
+  }
+  symbols, err := disasm.LoadSymbols(path)
+  if optional && errors.Is(err, fs.ErrNotExist) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  d.symbols = symbols
+  return nil
+}
+
+func (d *Debugger) checkWatchpoints(address uint16, value uint8, write bool) {
+  // first one wins if an instruction hits a few
+  if d.hit != nil {
+    return
+  }
+  for _, wp := range d.watchpoints {
+    if address < wp.Start || address > wp.End || (write && !wp.Write) || (!write && !wp.Read) {
+      continue
+    }
+    wp.Hits++
+    d.hit = &DebugStop{Reason: DEBUG_WATCHPOINT, Watchpoint: wp, Address: address, Value: value, Write: write}
+    return
+  }
+}
+
+// Break adds a breakpoint on the instruction at address. bank is the
+// ROM bank it has to be in, or -1 for any. condition can be nil
+func (d *Debugger) Break(address uint16, bank int, condition Condition) (*Breakpoint, error) {
+  if bank >= 0 && address > 0x7FFF {
+    return nil, fmt.Errorf("%04X isn't in ROM, it can't have a bank", address)
+  }
+  bp := &Breakpoint{ID: d.nextID, HasAddress: true, Address: address, Bank: bank, Condition: condition}
+  d.nextID++
+  d.breakpoints = append(d.breakpoints, bp)
+  return bp, nil
+}
+
+// BreakIf stops before any instruction where condition holds
+func (d *Debugger) BreakIf(condition Condition) (*Breakpoint, error) {
+  if len(condition) == 0 {
+    return nil, fmt.Errorf("no condition")
+  }
+  bp := &Breakpoint{ID: d.nextID, Bank: -1, Condition: condition}
+  d.nextID++
+  d.breakpoints = append(d.breakpoints, bp)
+  return bp, nil
+}
+
+// Watch stops after the CPU reads and/or writes anything in start-end
+func (d *Debugger) Watch(start uint16, end uint16, read bool, write bool) (*Watchpoint, error) {
+  if end < start {
+    return nil, fmt.Errorf("range %04X-%04X is backwards", start, end)
+  }
+  if !read && !write {
+    return nil, fmt.Errorf("watchpoint needs to watch reads, writes or both")
+  }
+  wp := &Watchpoint{ID: d.nextID, Start: start, End: end, Read: read, Write: write}
+  d.nextID++
+  d.watchpoints = append(d.watchpoints, wp)
+  return wp, nil
+}
+
+// Delete removes the breakpoint or watchpoint with this id
+func (d *Debugger) Delete(id int) bool {
+  for i, bp := range d.breakpoints {
+    if bp.ID == id {
+      d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+      return true
+    }
+  }
+  for i, wp := range d.watchpoints {
+    if wp.ID == id {
+      d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+      return true
+    }
+  }
+  return false
+}
+
+func (d *Debugger) Breakpoints() []*Breakpoint {
+  return d.breakpoints
+}
+
+func (d *Debugger) Watchpoints() []*Watchpoint {
+  return d.watchpoints
+}
+
+// Interrupt stops whatever is running at the next cycle. Safe to call
+// from any goroutine, e.g. on ctrl-c
+func (d *Debugger) Interrupt() {
+  d.interrupted.Store(true)
+}
+
+func (d *Debugger) breakpointHere() *Breakpoint {
+  pc := d.cpu.instructionAddress()
+  for _, bp := range d.breakpoints {
+    if bp.HasAddress && (bp.Address != pc || (bp.Bank >= 0 && bp.Bank != d.cpu.romBankAt(pc))) {
+      continue
+    }
+    if !bp.Condition.holds(d.cpu) {
+      continue
+    }
+    bp.Hits++
+    return bp
+  }
+  return nil
+}
+
+// resume runs until a breakpoint, watchpoint or Interrupt, or until done
+// says the step is finished. done sees every cycle like run's stop does
+func (d *Debugger) resume(done func(instructionBoundary bool) bool) (stop DebugStop) {
+  d.hit = nil
+  d.interrupted.Store(false)
+  defer func() {
+    if r := recover(); r != nil {
+      d.atBoundary = false
+      stop = DebugStop{Reason: DEBUG_CRASH, Err: fmt.Errorf("%v", r)}
+    }
+  }()
+
+  d.cpu.run(func(instructionBoundary bool) bool {
+    d.profileCycle(instructionBoundary)
+    d.atBoundary = instructionBoundary
+    if instructionBoundary {
+      d.current = d.cpu.instructionAddress()
+    }
+    if d.hit != nil {
+      stop = *d.hit
+      d.hit = nil
+      return true
+    }
+    if instructionBoundary {
+      if bp := d.breakpointHere(); bp != nil {
+        stop = DebugStop{Reason: DEBUG_BREAKPOINT, Breakpoint: bp}
+        return true
+      }
+    }
+    if d.interrupted.Load() {
+      stop = DebugStop{Reason: DEBUG_INTERRUPTED}
+      return true
+    }
+    if done(instructionBoundary) {
+      stop = DebugStop{Reason: DEBUG_STEP}
+      return true
+    }
+    return false
+  })
+  return stop
+}
+
+// Continue runs until something stops it
+func (d *Debugger) Continue() DebugStop {
+  return d.resume(func(bool) bool {
+    return false
+  })
+}
+
+// Step runs until n more instructions have been fetched, so it stops
+// before the nth one from here. interrupt dispatch counts as one
+func (d *Debugger) Step(n int) DebugStop {
+  count := 0
+  return d.resume(func(instructionBoundary bool) bool {
+    if instructionBoundary {
+      count++
+    }
+    return count >= n
+  })
+}
+
+// StepCycles runs n M-cycles
+func (d *Debugger) StepCycles(n int) DebugStop {
+  count := 0
+  return d.resume(func(bool) bool {
+    count++
+    return count >= n
+  })
+}
+
+// CALL, CALL cc and RST, and how long they are
+func callLength(op Opcode) (uint16, bool) {
+  if op.Prefixed {
+    return 0, false
+  }
+  switch {
+  case op.Full == 0xCD, op.Full == 0xC4, op.Full == 0xCC, op.Full == 0xD4, op.Full == 0xDC:
+    return 3, true
+  case op.X == 3 && op.Z == 7:
+    return 1, true
+  }
+  return 0, false
+}
+
+// RET, RETI and RET cc
+func isReturn(op Opcode) bool {
+  if op.Prefixed {
+    return false
+  }
+  switch op.Full {
+  case 0xC9, 0xD9, 0xC0, 0xC8, 0xD0, 0xD8:
+    return true
+  }
+  return false
+}
+
+// StepOver is Step(1), except that calls run until they come back
+func (d *Debugger) StepOver() DebugStop {
+  length, isCall := callLength(d.cpu.CurrentOpcode)
+  if !d.atBoundary || !isCall {
+    return d.Step(1)
+  }
+  returnAddress := d.cpu.instructionAddress() + length
+  sp := d.cpu.SP.read()
+  // SP as well, so recursion doesn't stop in a deeper call
+  return d.resume(func(instructionBoundary bool) bool {
+    return instructionBoundary && d.cpu.instructionAddress() == returnAddress && d.cpu.SP.read() >= sp
+  })
+}
+
+// StepOut runs until the current function returns, stopping on the
+// instruction after the call
+func (d *Debugger) StepOut() DebugStop {
+  sp := d.cpu.SP.read()
+  // the instruction that's about to run or is part way through
+  last := d.cpu.CurrentOpcode
+  return d.resume(func(instructionBoundary bool) bool {
+    if !instructionBoundary {
+      return false
+    }
+    finished := last
+    last = d.cpu.CurrentOpcode
+    // a return that popped past where we started. RET cc that isn't
+    // taken leaves SP alone, and so does an interrupt handler's RETI
+    return isReturn(finished) && d.cpu.SP.read() > sp
+  })
+}
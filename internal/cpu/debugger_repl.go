@@ -0,0 +1,402 @@
+package cpu
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "jfeintzeig/gameboy/internal/disasm"
+  "strconv"
+  "strings"
+)
+
+const debuggerHelp = `commands, numbers are hex unless they start with #, and
+addresses can be labels from the .sym file:
+  c, continue          run until a breakpoint or watchpoint (ctrl-c stops it)
+  s, step [N]          run N instructions
+  cycle [N]            run N M-cycles
+  n, next              step, but run calls until they return
+  finish               run until the current function returns
+  b, break ADDR        stop before the instruction at ADDR
+  b, break BB:ADDR     ... only when ROM bank BB is mapped there
+  b, break ADDR if C   ... only when condition C holds, e.g. A == 3F && HL >= C000
+  b, break if C        stop before any instruction where C holds
+  w, watch ADDR[-END] [r|w|rw]
+                       stop after the CPU reads and/or writes there, writes by default
+  d, delete ID         remove a breakpoint or watchpoint
+  l, list              show breakpoints and watchpoints
+  r, regs              show the CPU registers
+  x, mem ADDR [LEN]    show memory
+  dis [ADDR] [N]       disassemble N instructions from ADDR, or from PC
+  stack [N]            show N words from the top of the stack
+  ppu                  show the PPU registers and state
+  profile [N]          show the N opcodes that have taken the most cycles
+  profile reset        start counting again
+  q, quit              exit
+an empty line repeats the last command`
+
+// REPL reads debugger commands from in until quit or the end of in
+func (d *Debugger) REPL(in io.Reader, out io.Writer) error {
+  scanner := bufio.NewScanner(in)
+  d.printLocation(out)
+  last := ""
+  for {
+    fmt.Fprint(out, "(gb) ")
+    if !scanner.Scan() {
+      fmt.Fprintln(out)
+      return scanner.Err()
+    }
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" {
+      line = last
+    }
+    if line == "" {
+      continue
+    }
+    last = line
+    if quit := d.command(line, out); quit {
+      return nil
+    }
+  }
+}
+
+func (d *Debugger) command(line string, out io.Writer) bool {
+  fields := strings.Fields(line)
+  args := fields[1:]
+  // optional count for the stepping commands
+  count := func(fallback int) (int, bool) {
+    if len(args) == 0 {
+      return fallback, true
+    }
+    n, err := strconv.Atoi(args[0])
+    if err != nil || n < 1 {
+      fmt.Fprintf(out, "not a count: %s\n", args[0])
+      return 0, false
+    }
+    return n, true
+  }
+
+  switch fields[0] {
+  case "h", "help", "?":
+    fmt.Fprintln(out, debuggerHelp)
+  case "q", "quit", "exit":
+    return true
+  case "c", "continue":
+    d.report(d.Continue(), out)
+  case "s", "step":
+    if n, ok := count(1); ok {
+      d.report(d.Step(n), out)
+    }
+  case "cycle":
+    if n, ok := count(1); ok {
+      d.report(d.StepCycles(n), out)
+    }
+  case "n", "next":
+    d.report(d.StepOver(), out)
+  case "finish":
+    d.report(d.StepOut(), out)
+  case "b", "break":
+    if bp, err := d.breakCommand(strings.TrimSpace(strings.TrimPrefix(line, fields[0]))); err != nil {
+      fmt.Fprintln(out, err)
+    } else {
+      fmt.Fprintf(out, "breakpoint %d: %s\n", bp.ID, bp)
+    }
+  case "w", "watch":
+    if wp, err := d.watchCommand(args); err != nil {
+      fmt.Fprintln(out, err)
+    } else {
+      fmt.Fprintf(out, "watchpoint %d: %s\n", wp.ID, wp)
+    }
+  case "d", "delete":
+    if len(args) != 1 {
+      fmt.Fprintln(out, "usage: delete ID")
+      break
+    }
+    id, err := strconv.Atoi(args[0])
+    if err != nil || !d.Delete(id) {
+      fmt.Fprintf(out, "no breakpoint or watchpoint %s\n", args[0])
+    }
+  case "l", "list":
+    for _, bp := range d.breakpoints {
+      fmt.Fprintf(out, "%3d  break %-30s hits %d\n", bp.ID, bp, bp.Hits)
+    }
+    for _, wp := range d.watchpoints {
+      fmt.Fprintf(out, "%3d  watch %-30s hits %d\n", wp.ID, wp, wp.Hits)
+    }
+  case "r", "regs":
+    d.printRegisters(out)
+  case "x", "mem":
+    d.memCommand(args, out)
+  case "stack":
+    if n, ok := count(8); ok {
+      d.printStack(n, out)
+    }
+  case "ppu":
+    d.printPpu(out)
+  case "dis":
+    d.disCommand(args, out)
+  case "profile":
+    if len(args) == 1 && args[0] == "reset" {
+      d.ResetProfile()
+    } else if n, ok := count(20); ok {
+      d.printProfile(n, out)
+    }
+  default:
+    fmt.Fprintf(out, "unknown command %s, try help\n", fields[0])
+  }
+  return false
+}
+
+// ADDR, BB:ADDR, either with "if COND", or just "if COND"
+func (d *Debugger) breakCommand(spec string) (*Breakpoint, error) {
+  location, conditionText, hasCondition := strings.Cut(" " + spec + " ", " if ")
+  location = strings.TrimSpace(location)
+  var condition Condition
+  if hasCondition {
+    var err error
+    if condition, err = ParseCondition(conditionText); err != nil {
+      return nil, err
+    }
+  }
+  if location == "" {
+    if !hasCondition {
+      return nil, fmt.Errorf("usage: break ADDR|BB:ADDR [if COND], or break if COND")
+    }
+    return d.BreakIf(condition)
+  }
+
+  bank := -1
+  if bankText, addressText, ok := strings.Cut(location, ":"); ok {
+    b, err := ParseNumber(bankText)
+    if err != nil {
+      return nil, err
+    }
+    bank = int(b)
+    location = addressText
+  } else if d.symbols != nil {
+    // labels in switchable banks only mean something in their bank
+    if symbolBank, address, ok := d.symbols.Address(location); ok {
+      if address >= 0x4000 && address <= 0x7FFF {
+        bank = symbolBank
+      }
+      return d.Break(address, bank, condition)
+    }
+  }
+  address, err := d.parseAddress(location)
+  if err != nil {
+    return nil, err
+  }
+  return d.Break(address, bank, condition)
+}
+
+func (d *Debugger) watchCommand(args []string) (*Watchpoint, error) {
+  if len(args) < 1 || len(args) > 2 {
+    return nil, fmt.Errorf("usage: watch ADDR[-END] [r|w|rw]")
+  }
+  startText, endText, isRange := strings.Cut(args[0], "-")
+  start, err := d.parseAddress(startText)
+  if err != nil {
+    return nil, err
+  }
+  end := start
+  if isRange {
+    if end, err = d.parseAddress(endText); err != nil {
+      return nil, err
+    }
+  }
+  read, write := false, true
+  if len(args) == 2 {
+    switch args[1] {
+    case "r":
+      read, write = true, false
+    case "w":
+    case "rw", "wr":
+      read = true
+    default:
+      return nil, fmt.Errorf("watch r, w or rw, not %s", args[1])
+    }
+  }
+  return d.Watch(start, end, read, write)
+}
+
+// a number, or a label
+func (d *Debugger) parseAddress(s string) (uint16, error) {
+  if d.symbols != nil {
+    if _, address, ok := d.symbols.Address(s); ok {
+      return address, nil
+    }
+  }
+  return ParseNumber(s)
+}
+
+func (d *Debugger) disCommand(args []string, out io.Writer) {
+  if len(args) > 2 {
+    fmt.Fprintln(out, "usage: dis [ADDR] [N]")
+    return
+  }
+  address := d.cpu.instructionAddress()
+  if !d.atBoundary && d.cpu.ExecutionQueue.Length() > 0 {
+    address = d.current
+  }
+  n := 10
+  if len(args) > 0 {
+    var err error
+    if address, err = d.parseAddress(args[0]); err != nil {
+      fmt.Fprintln(out, err)
+      return
+    }
+  }
+  if len(args) > 1 {
+    count, err := strconv.Atoi(args[1])
+    if err != nil || count < 1 {
+      fmt.Fprintf(out, "not a count: %s\n", args[1])
+      return
+    }
+    n = count
+  }
+  for i := 0; i < n; i++ {
+    address += d.printInstruction(address, "", out)
+  }
+}
+
+func (d *Debugger) memCommand(args []string, out io.Writer) {
+  if len(args) < 1 || len(args) > 2 {
+    fmt.Fprintln(out, "usage: mem ADDR [LEN]")
+    return
+  }
+  address, err := d.parseAddress(args[0])
+  if err != nil {
+    fmt.Fprintln(out, err)
+    return
+  }
+  length := uint16(0x40)
+  if len(args) == 2 {
+    if length, err = ParseNumber(args[1]); err != nil {
+      fmt.Fprintln(out, err)
+      return
+    }
+  }
+  for i := uint16(0); i < length; i += 16 {
+    fmt.Fprintf(out, "%04X ", address + i)
+    for j := i; j < i + 16 && j < length; j++ {
+      fmt.Fprintf(out, " %02X", d.inner.ReadFromBus(address + j))
+    }
+    fmt.Fprintln(out)
+    // wrapped around the top of memory
+    if uint32(address) + uint32(i) + 16 > 0xFFFF {
+      break
+    }
+  }
+}
+
+func (d *Debugger) report(stop DebugStop, out io.Writer) {
+  if s := stop.String(); s != "" {
+    fmt.Fprintln(out, s)
+  }
+  d.printLocation(out)
+}
+
+// where the CPU is and what it's about to run
+func (d *Debugger) printLocation(out io.Writer) {
+  cpu := d.cpu
+  pc := cpu.instructionAddress()
+  if !d.atBoundary {
+    if cpu.ExecutionQueue.Length() == 0 {
+      fmt.Fprintf(out, "%04X  next instruction not fetched yet\n", cpu.PC.read())
+      return
+    }
+    pc = d.current
+  }
+  state := ""
+  if cpu.isHalted {
+    state = "  (halted)"
+  } else if cpu.isStopped {
+    state = "  (stopped)"
+  } else if !d.atBoundary {
+    state = fmt.Sprintf("  (%d cycles left)", cpu.ExecutionQueue.Length())
+  }
+  d.printInstruction(pc, state, out)
+}
+
+// one line of disassembly, with a label line above it if there is one.
+// returns how long the instruction was
+func (d *Debugger) printInstruction(address uint16, suffix string, out io.Writer) uint16 {
+  inst := disasm.Decode(d.inner.ReadFromBus, address)
+  var code []string
+  for _, b := range inst.Bytes {
+    code = append(code, fmt.Sprintf("%02X", b))
+  }
+  bankText := ""
+  bank := d.cpu.romBankAt(address)
+  if bank >= 0 {
+    bankText = fmt.Sprintf("%02X:", bank)
+  }
+  if d.symbols != nil {
+    if name, ok := d.symbols.Name(bank, address); ok {
+      fmt.Fprintf(out, "%s:\n", name)
+    }
+  }
+  fmt.Fprintf(out, "%s%04X  %-9s %s%s\n", bankText, address, strings.Join(code, " "), inst.WithSymbols(d.symbols, bank), suffix)
+  return uint16(inst.Length())
+}
+
+func (d *Debugger) printRegisters(out io.Writer) {
+  cpu := d.cpu
+  f := cpu.F.read()
+  flags := []byte("----")
+  for i, name := range "ZNHC" {
+    if GetBitBool(f, uint8(7 - i)) {
+      flags[i] = byte(name)
+    }
+  }
+  fmt.Fprintf(out, "AF %04X  BC %04X  DE %04X  HL %04X  SP %04X  PC %04X  %s\n",
+    cpu.registerValue("AF"), cpu.registerValue("BC"), cpu.registerValue("DE"), cpu.registerValue("HL"),
+    cpu.SP.read(), cpu.instructionAddress(), flags)
+  fmt.Fprintf(out, "IME %t  halted %t  stopped %t  IE %02X  IF %02X  cycle %d\n",
+    cpu.IME, cpu.isHalted, cpu.isStopped, d.inner.ReadFromBus(IE), d.inner.ReadFromBus(IF), cpu.globalCounter)
+}
+
+func (d *Debugger) printStack(n int, out io.Writer) {
+  sp := d.cpu.SP.read()
+  for i := 0; i < n; i++ {
+    address := sp + uint16(2 * i)
+    value := uint16(d.inner.ReadFromBus(address + 1)) << 8 | uint16(d.inner.ReadFromBus(address))
+    fmt.Fprintf(out, "%04X  %04X\n", address, value)
+  }
+}
+
+func (d *Debugger) printProfile(n int, out io.Writer) {
+  profile := d.Profile()
+  var total uint64
+  for _, p := range profile {
+    total += p.Cycles
+  }
+  if total == 0 {
+    fmt.Fprintln(out, "nothing has run yet")
+    return
+  }
+  fmt.Fprintf(out, "%-6s %-16s %5s %12s %12s %6s\n", "opcode", "", "M", "count", "cycles", "")
+  for _, p := range profile[:min(n, len(profile))] {
+    opcode := fmt.Sprintf("%02X", p.Opcode)
+    if p.Prefixed {
+      opcode = "CB " + opcode
+    }
+    timing := fmt.Sprint(p.CyclesTaken)
+    if p.CyclesNotTaken != p.CyclesTaken {
+      timing = fmt.Sprintf("%d/%d", p.CyclesTaken, p.CyclesNotTaken)
+    }
+    fmt.Fprintf(out, "%-6s %-16s %5s %12d %12d %5.1f%%\n", opcode, p.Mnemonic, timing, p.Count, p.Cycles, 100 * float64(p.Cycles) / float64(total))
+  }
+}
+
+func (d *Debugger) printPpu(out io.Writer) {
+  ppu := d.cpu.Bus.ppu
+  reg := func(address uint16) uint8 {
+    return d.inner.ReadFromBus(address)
+  }
+  fmt.Fprintf(out, "LCDC %02X  STAT %02X  LY %02X  LYC %02X  mode %d  dots %d\n",
+    reg(0xFF40), reg(0xFF41), reg(0xFF44), reg(0xFF45), ppu.currentMode, ppu.nDots)
+  fmt.Fprintf(out, "SCX %02X  SCY %02X  WX %02X  WY %02X  window line %d\n",
+    reg(0xFF43), reg(0xFF42), reg(0xFF4B), reg(0xFF4A), ppu.windowLineCounter)
+  fmt.Fprintf(out, "BGP %02X  OBP0 %02X  OBP1 %02X  sprites on line %d\n",
+    reg(0xFF47), reg(0xFF48), reg(0xFF49), len(ppu.SpriteBuffer))
+}
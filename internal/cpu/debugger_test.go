@@ -0,0 +1,145 @@
+package cpu
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+// calls a function that increments C000, forever
+//   0150 LD SP, DFFE
+//   0153 CALL 0160
+//   0156 INC A
+//   0157 JR 0153
+//   0160 LD HL, C000
+//   0163 INC (HL)
+//   0164 RET
+func newDebuggerTestGameBoy(t *testing.T) (*Cpu, *Debugger) {
+  path := writeROM(t, "debugger", map[uint16][]byte{
+    0x150: {0x31, 0xFE, 0xDF, 0xCD, 0x60, 0x01, 0x3C, 0x18, 0xFA},
+    0x160: {0x21, 0x00, 0xC0, 0x34, 0xC9},
+  })
+  gb, err := NewGameBoy(&path, "", DMG, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return gb, NewDebugger(gb)
+}
+
+func expectStop(t *testing.T, gb *Cpu, stop DebugStop, reason DebugStopReason, pc uint16) {
+  t.Helper()
+  if stop.Reason != reason {
+    t.Fatalf("stopped with %q, reason %d, want %d", stop, stop.Reason, reason)
+  }
+  if got := gb.instructionAddress(); got != pc {
+    t.Fatalf("stopped at %04X, want %04X", got, pc)
+  }
+}
+
+func TestDebuggerStepping(t *testing.T) {
+  gb, d := newDebuggerTestGameBoy(t)
+
+  bp, _ := d.Break(0x0160, -1, nil)
+  expectStop(t, gb, d.Continue(), DEBUG_BREAKPOINT, 0x0160)
+  expectStop(t, gb, d.Step(1), DEBUG_STEP, 0x0163)
+  expectStop(t, gb, d.StepOut(), DEBUG_STEP, 0x0156)
+  if gb.SP.read() != 0xDFFE {
+    t.Errorf("SP is %04X after returning", gb.SP.read())
+  }
+
+  expectStop(t, gb, d.Step(2), DEBUG_STEP, 0x0153)
+  // straight over the breakpoint's function...
+  d.Delete(bp.ID)
+  expectStop(t, gb, d.StepOver(), DEBUG_STEP, 0x0156)
+  if got := gb.Bus.ReadFromBus(0xC000); got != 2 {
+    t.Errorf("C000 is %d after two calls", got)
+  }
+  // ...unless it's still there
+  d.Step(2)
+  d.Break(0x0163, -1, nil)
+  expectStop(t, gb, d.StepOver(), DEBUG_BREAKPOINT, 0x0163)
+}
+
+func TestDebuggerBankedAndConditionalBreakpoints(t *testing.T) {
+  gb, d := newDebuggerTestGameBoy(t)
+
+  // 0156 is in bank 0, so this one never hits
+  banked, _ := d.Break(0x0156, 1, nil)
+  condition, err := ParseCondition("A == 5 && SP >= DFFE")
+  if err != nil {
+    t.Fatal(err)
+  }
+  bp, _ := d.Break(0x0157, 0, condition)
+  for i := 1; i <= 2; i++ {
+    // the second time round is after A wraps
+    expectStop(t, gb, d.Continue(), DEBUG_BREAKPOINT, 0x0157)
+    if bp.Hits != i || gb.A.read() != 5 {
+      t.Errorf("conditional breakpoint hit %d times, A is %02X", bp.Hits, gb.A.read())
+    }
+  }
+  if banked.Hits != 0 {
+    t.Errorf("breakpoint on bank 1 hit in bank 0")
+  }
+
+  if _, err := ParseCondition("Q == 1"); err == nil {
+    t.Error("parsed a condition on register Q")
+  }
+  if _, err := ParseCondition("A == 100"); err == nil {
+    t.Error("compared A with 16 bits")
+  }
+}
+
+func TestDebuggerWatchpoints(t *testing.T) {
+  gb, d := newDebuggerTestGameBoy(t)
+
+  d.Watch(0xC000, 0xC000, false, true)
+  for i := 1; i <= 3; i++ {
+    stop := d.Continue()
+    if stop.Reason != DEBUG_WATCHPOINT || !stop.Write || stop.Address != 0xC000 || stop.Value != uint8(i) {
+      t.Fatalf("stopped with %q", stop)
+    }
+  }
+  // the cycle after the write, with RET fetched
+  expectStop(t, gb, DebugStop{Reason: DEBUG_WATCHPOINT}, DEBUG_WATCHPOINT, 0x0164)
+
+  // looking at memory doesn't trigger them
+  var out bytes.Buffer
+  d.command("mem C000 1", &out)
+  if d.hit != nil || !strings.Contains(out.String(), "C000  03") {
+    t.Errorf("mem printed %q", out.String())
+  }
+}
+
+func TestDebuggerCycleStepsMatchRunning(t *testing.T) {
+  gb, d := newDebuggerTestGameBoy(t)
+  for i := 0; i < 1000; i++ {
+    d.StepCycles(1)
+  }
+  want, _ := newDebuggerTestGameBoy(t)
+  runCycles(want, gb.globalCounter)
+  if !bytes.Equal(gb.SaveState(), want.SaveState()) {
+    t.Error("stepping one cycle at a time went somewhere else")
+  }
+}
+
+func TestDebuggerREPL(t *testing.T) {
+  _, d := newDebuggerTestGameBoy(t)
+  in := strings.NewReader("break 160 if A == 1\nc\nfinish\n\nregs\nlist\nbogus\nq\nc\n")
+  var out bytes.Buffer
+  if err := d.REPL(in, &out); err != nil {
+    t.Fatal(err)
+  }
+  for _, want := range []string{
+    "breakpoint 1: 0160 if A == 01",
+    "00:0160  21 00 C0  LD HL,$C000",
+    "00:0156  3C        INC A",
+    // the empty line finished again, which runs until A wraps round
+    "PC 0160",
+    "hits 2",
+    "unknown command bogus",
+  } {
+    if !strings.Contains(out.String(), want) {
+      t.Errorf("no %q in:\n%s", want, out.String())
+    }
+  }
+}
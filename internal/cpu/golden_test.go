@@ -0,0 +1,191 @@
+package cpu
+
+import (
+  "flag"
+  "image"
+  "image/color"
+  "image/png"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// screenshot tests for PPU test ROMs. the ROMs and reference images
+// come from a checkout of each suite under -resources (the
+// gameboy_resources directory from the README). mooneye's PPU ROMs have
+// no reference images, they report pass/fail in the registers like the
+// rest of mooneye, so TestMooneyePPU checks those with RunTestROM
+//   go test ./internal/cpu -run 'TestGolden|TestMooneyePPU' -resources ../gameboy_resources
+var (
+  resourcesDir = flag.String("resources", resourcesDefault(), "directory the test suites are checked out in")
+  goldenOut = flag.String("golden-out", filepath.Join(os.TempDir(), "gameboy-golden"), "where to write actual and diff images on failure")
+)
+
+func resourcesDefault() string {
+  if dir := os.Getenv("GAMEBOY_RESOURCES"); dir != "" {
+    return dir
+  }
+  // tests run in internal/cpu
+  return "../../../gameboy_resources"
+}
+
+type goldenSuite struct {
+  name string
+  // glob under -resources
+  roms string
+  // reference image under -resources, %s is the ROM name without
+  // extension
+  reference string
+  // give up waiting for the LD B,B breakpoint after this many frames
+  maxFrames uint64
+}
+
+var goldenSuites = []goldenSuite{
+  {"dmg-acid2", "dmg-acid2/dmg-acid2.gb", "dmg-acid2/img/reference-dmg.png", 300},
+  {"mealybug", "mealybug-tearoom-tests/build/ppu/*.gb", "mealybug-tearoom-tests/expected/DMG-blob/%s.png", 300},
+}
+
+func TestGolden(t *testing.T) {
+  if _, err := os.Stat(*resourcesDir); err != nil {
+    t.Skipf("no test suites in %s, set -resources or GAMEBOY_RESOURCES", *resourcesDir)
+  }
+
+  for _, suite := range goldenSuites {
+    roms, _ := filepath.Glob(filepath.Join(*resourcesDir, suite.roms))
+    for _, rom := range roms {
+      name := strings.TrimSuffix(filepath.Base(rom), filepath.Ext(rom))
+      t.Run(suite.name + "/" + name, func(t *testing.T) {
+        reference := filepath.Join(*resourcesDir, strings.ReplaceAll(suite.reference, "%s", name))
+
+        path := rom
+        gb, err := NewGameBoy(&path, "", DMG, true)
+        if err != nil {
+          t.Fatal(err)
+        }
+        actual := runToScreenshot(t, gb, suite.maxFrames)
+
+        expected, err := readPNG(reference)
+        if err != nil {
+          t.Fatal(err)
+        }
+
+        diff, mismatches := diffShades(expected, actual)
+        if mismatches > 0 {
+          actualPath := filepath.Join(*goldenOut, suite.name, name + "-actual.png")
+          diffPath := filepath.Join(*goldenOut, suite.name, name + "-diff.png")
+          if err := writePNG(actualPath, actual); err != nil {
+            t.Log(err)
+          }
+          if err := writePNG(diffPath, diff); err != nil {
+            t.Log(err)
+          }
+          t.Errorf("%d pixels differ from %s, see %s", mismatches, reference, diffPath)
+        }
+      })
+    }
+  }
+}
+
+const MOONEYE_PPU_ROMS = "mts-20221022-1430-8d742b9/acceptance/ppu/*.gb"
+
+func TestMooneyePPU(t *testing.T) {
+  roms, _ := filepath.Glob(filepath.Join(*resourcesDir, MOONEYE_PPU_ROMS))
+  if len(roms) == 0 {
+    t.Skipf("no mooneye PPU ROMs in %s, set -resources or GAMEBOY_RESOURCES", *resourcesDir)
+  }
+  for _, rom := range roms {
+    t.Run(strings.TrimSuffix(filepath.Base(rom), filepath.Ext(rom)), func(t *testing.T) {
+      path := rom
+      gb, err := NewGameBoy(&path, "", DMG, true)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if result := gb.RunTestROM(600); result.Status != TEST_PASS || result.Protocol != "mooneye" {
+        t.Errorf("%s (%s): %s", result.Status, result.Protocol, result.Summary())
+      }
+    })
+  }
+}
+
+// runs until the ROM hits LD B,B (which acid2 and mealybug both
+// use to say they're done) and then a couple more frames, so the whole
+// screen has been redrawn since
+func runToScreenshot(t *testing.T, gb *Cpu, maxFrames uint64) image.Image {
+  defer func() {
+    if r := recover(); r != nil {
+      t.Fatalf("emulator crashed at PC %04X: %v", gb.PC.read(), r)
+    }
+  }()
+
+  var doneAt uint64
+  done := false
+  gb.run(func(instructionBoundary bool) bool {
+    if !done && instructionBoundary && gb.CurrentOpcode.Full == MOONEYE_BREAKPOINT && !gb.CurrentOpcode.Prefixed {
+      done = true
+      doneAt = gb.globalCounter
+    }
+    if done {
+      return gb.globalCounter - doneAt >= 2 * CYCLES_PER_FRAME
+    }
+    return gb.globalCounter >= maxFrames * CYCLES_PER_FRAME
+  })
+  if !done {
+    t.Logf("no LD B,B after %d frames, comparing the screen anyway", maxFrames)
+  }
+  return gb.ScreenImage()
+}
+
+// shade 0 (white) to 3 (black), so references drawn with other
+// palettes, e.g. greenish ones, still compare
+func shadeAt(img image.Image, x int, y int) uint8 {
+  r, g, b, _ := img.At(img.Bounds().Min.X + x, img.Bounds().Min.Y + y).RGBA()
+  luminance := (299 * r + 587 * g + 114 * b) / 1000 >> 8
+  return 3 - uint8((luminance + 42) / 85)
+}
+
+// the diff shows matching pixels faded out and mismatches in red
+func diffShades(expected image.Image, actual image.Image) (*image.RGBA, int) {
+  diff := image.NewRGBA(image.Rect(0, 0, SCREEN_WIDTH, SCREEN_HEIGHT))
+  mismatches := 0
+  if expected.Bounds().Dx() != SCREEN_WIDTH || expected.Bounds().Dy() != SCREEN_HEIGHT {
+    return diff, SCREEN_WIDTH * SCREEN_HEIGHT
+  }
+  for y := 0; y < SCREEN_HEIGHT; y++ {
+    for x := 0; x < SCREEN_WIDTH; x++ {
+      want := shadeAt(expected, x, y)
+      if shadeAt(actual, x, y) != want {
+        mismatches++
+        diff.Set(x, y, color.RGBA{0xFF, 0x00, 0x00, 0xFF})
+      } else {
+        faded := 0xFF - 0x20 * want
+        diff.Set(x, y, color.RGBA{faded, faded, faded, 0xFF})
+      }
+    }
+  }
+  return diff, mismatches
+}
+
+func readPNG(path string) (image.Image, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  return png.Decode(f)
+}
+
+func writePNG(path string, img image.Image) error {
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return err
+  }
+  f, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  if err := png.Encode(f, img); err != nil {
+    f.Close()
+    return err
+  }
+  return f.Close()
+}
@@ -0,0 +1,244 @@
+package cpu
+
+import (
+  "testing"
+)
+
+// the boot ROM leaves VBlank requested in IF, so every program sets IF
+// itself first. the VBlank handler at 0040 does LD B,$42; RETI
+func newHaltTestGameBoy(t *testing.T, name string, code []byte) *Cpu {
+  return newGameBoyWithCode(t, name, map[uint16][]byte{
+    0x0040: {0x06, 0x42, 0xD9},
+    0x0150: code,
+  })
+}
+
+// the HALT programs all end in JR $FE at 015B
+func runHaltTest(t *testing.T, name string, code []byte) *Cpu {
+  gb := newHaltTestGameBoy(t, name, code)
+  reason, err := gb.RunUntil(RunLimits{PC: 0x015B, StopAtPC: true, Frames: 3})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if reason != STOP_PC {
+    t.Fatalf("never got past HALT, PC %04X", gb.PC.read())
+  }
+  return gb
+}
+
+func TestHaltWakesWithoutIME(t *testing.T) {
+  gb := runHaltTest(t, "haltime0", []byte{
+    0xF3,       // 0150 DI
+    0xAF,       // 0151 XOR A
+    0xE0, 0x0F, // 0152 LDH (IF),A
+    0x3E, 0x01, // 0154 LD A,$01
+    0xE0, 0xFF, // 0156 LDH (IE),A
+    0x76,       // 0158 HALT
+    0x06, 0x99, // 0159 LD B,$99
+    0x18, 0xFE, // 015B JR $FE
+  })
+  if b := gb.B.read(); b != 0x99 {
+    t.Errorf("B is %02X, the interrupt was dispatched with IME=0", b)
+  }
+  if gb.Bus.ReadFromBus(IF) & 0x01 == 0 {
+    t.Error("VBlank isn't requested any more")
+  }
+  // waited for VBlank rather than going straight through
+  if gb.globalCounter < 1000 {
+    t.Errorf("woke up after %d cycles", gb.globalCounter)
+  }
+}
+
+func TestHaltWithIME(t *testing.T) {
+  gb := runHaltTest(t, "haltime1", []byte{
+    0x3E, 0x01, // 0150 LD A,$01
+    0xE0, 0xFF, // 0152 LDH (IE),A
+    0xAF,       // 0154 XOR A
+    0xE0, 0x0F, // 0155 LDH (IF),A
+    0xFB,       // 0157 EI
+    0x00,       // 0158 NOP
+    0x76,       // 0159 HALT
+    0x48,       // 015A LD C,B
+    0x18, 0xFE, // 015B JR $FE
+  })
+  if c := gb.C.read(); c != 0x42 {
+    t.Errorf("C is %02X, the handler didn't run before the instruction after HALT", c)
+  }
+  if sp := gb.SP.read(); sp != 0xFFFE {
+    t.Errorf("SP is %04X after returning", sp)
+  }
+}
+
+func TestHaltBug(t *testing.T) {
+  setup := []byte{
+    0xF3,       // 0150 DI
+    0x3E, 0x01, // 0151 LD A,$01
+    0xE0, 0xFF, // 0153 LDH (IE),A
+    0xE0, 0x0F, // 0155 LDH (IF),A
+    0xAF,       // 0157 XOR A
+    0x76,       // 0158 HALT, with VBlank pending and IME=0
+  }
+
+  // the INC A after HALT runs twice
+  gb := runHaltTest(t, "haltbug1", append(append([]byte(nil), setup...),
+    0x3C,       // 0159 INC A
+    0x47,       // 015A LD B,A
+    0x18, 0xFE, // 015B JR $FE
+  ))
+  if b := gb.B.read(); b != 2 {
+    t.Errorf("B is %d, want 2", b)
+  }
+
+  // LD A,$14 reads its own opcode as the operand, then 14 is INC D
+  gb = runHaltTest(t, "haltbug2", append(append([]byte(nil), setup...),
+    0x3E, 0x14, // 0159 LD A,$14
+    0x18, 0xFE, // 015B JR $FE
+  ))
+  if a, d := gb.A.read(), gb.D.read(); a != 0x3E || d != 0x01 {
+    t.Errorf("A is %02X and D %02X, want 3E and 01", a, d)
+  }
+}
+
+func TestHaltDoesntFetch(t *testing.T) {
+  // nothing enabled in IE, so this never wakes up
+  path := writeROM(t, "haltforever", map[uint16][]byte{
+    0x0150: {0xF3, 0xAF, 0xE0, 0xFF, 0x76, 0x00},
+  })
+  gb, err := NewGameBoy(&path, "", DMG, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  d := NewDebugger(gb)
+  d.Break(0x0154, -1, nil)
+  d.Continue()
+  // HALT is a single cycle, and there's no boundary after it to step to
+  d.StepCycles(1)
+  if !gb.isHalted {
+    t.Fatal("didn't halt")
+  }
+
+  d.Watch(0x0000, 0x7FFF, true, false)
+  if stop := d.StepCycles(2 * CYCLES_PER_FRAME); stop.Reason != DEBUG_STEP {
+    t.Errorf("stopped with %q while halted", stop)
+  }
+  if pc := gb.PC.read(); pc != 0x0155 {
+    t.Errorf("PC moved to %04X while halted", pc)
+  }
+}
+
+// runs until STOP has stopped the clock, then checks nothing moves
+func runUntilStopped(t *testing.T, gb *Cpu) {
+  if _, err := gb.RunUntil(RunLimits{Cycles: 1000}); err != nil {
+    t.Fatal(err)
+  }
+  if !gb.isStopped {
+    t.Fatalf("didn't stop, PC %04X", gb.PC.read())
+  }
+  if div := gb.Bus.timers.divCounter; div != 0 {
+    t.Errorf("DIV counter is %04X, want it reset", div)
+  }
+  ly := gb.Bus.ppu.LY.read()
+  gb.RunUntil(RunLimits{Frames: 1})
+  if !gb.isStopped {
+    t.Fatal("woke up with no button pressed")
+  }
+  if div := gb.Bus.timers.divCounter; div != 0 {
+    t.Errorf("DIV counter moved to %04X while stopped", div)
+  }
+  if gb.Bus.ppu.LY.read() != ly {
+    t.Error("LY moved while stopped")
+  }
+}
+
+func TestStop(t *testing.T) {
+  gb := newHaltTestGameBoy(t, "stop", []byte{
+    0xF3,       // 0150 DI
+    0xAF,       // 0151 XOR A
+    0xE0, 0x0F, // 0152 LDH (IF),A
+    0xE0, 0xFF, // 0154 LDH (IE),A
+    0xE0, 0x00, // 0156 LDH (P1),A, both button groups
+    0x10,       // 0158 STOP
+    0x04,       // 0159 INC B, skipped
+    0x0E, 0x77, // 015A LD C,$77
+    0x18, 0xFE, // 015C JR $FE
+  })
+  b := gb.B.read()
+  runUntilStopped(t, gb)
+  if pc := gb.PC.read(); pc != 0x015A {
+    t.Errorf("PC is %04X, STOP should be two bytes", pc)
+  }
+
+  gb.SetKey("a", true, false)
+  reason, err := gb.RunUntil(RunLimits{PC: 0x015C, StopAtPC: true, Cycles: 100})
+  if err != nil || reason != STOP_PC {
+    t.Fatalf("didn't wake up on a button press: %v %v", reason, err)
+  }
+  if gb.B.read() != b || gb.C.read() != 0x77 {
+    t.Errorf("B is %02X and C %02X, want %02X and 77", gb.B.read(), gb.C.read(), b)
+  }
+  if gb.Bus.ReadFromBus(IF) & 0x10 == 0 {
+    t.Error("no joypad interrupt requested")
+  }
+}
+
+func TestStopInterruptPending(t *testing.T) {
+  // with IME=0 the pending interrupt isn't dispatched, STOP just
+  // stops being two bytes
+  gb := newHaltTestGameBoy(t, "stopint", []byte{
+    0xF3,       // 0150 DI
+    0x3E, 0x01, // 0151 LD A,$01
+    0xE0, 0xFF, // 0153 LDH (IE),A
+    0xE0, 0x0F, // 0155 LDH (IF),A
+    0xAF,       // 0157 XOR A
+    0xE0, 0x00, // 0158 LDH (P1),A
+    0x10,       // 015A STOP
+    0x04,       // 015B INC B
+    0x18, 0xFE, // 015C JR $FE
+  })
+  b := gb.B.read()
+  runUntilStopped(t, gb)
+  if pc := gb.PC.read(); pc != 0x015B {
+    t.Errorf("PC is %04X, STOP should be one byte", pc)
+  }
+
+  gb.SetKey("start", true, false)
+  if reason, _ := gb.RunUntil(RunLimits{PC: 0x015C, StopAtPC: true, Cycles: 100}); reason != STOP_PC {
+    t.Fatal("didn't wake up on a button press")
+  }
+  if gb.B.read() != b + 1 {
+    t.Errorf("B is %02X, INC B didn't run", gb.B.read())
+  }
+}
+
+func TestStopButtonHeld(t *testing.T) {
+  // with a button held STOP HALTs instead, and still skips a byte
+  gb := newHaltTestGameBoy(t, "stopheld", []byte{
+    0xF3,       // 0150 DI
+    0xAF,       // 0151 XOR A
+    0xE0, 0x0F, // 0152 LDH (IF),A
+    0xE0, 0x00, // 0154 LDH (P1),A
+    0x3C,       // 0156 INC A
+    0xE0, 0xFF, // 0157 LDH (IE),A, VBlank
+    0x10,       // 0159 STOP
+    0x04,       // 015A INC B, skipped
+    0x0E, 0x77, // 015B LD C,$77
+    0x18, 0xFE, // 015D JR $FE
+  })
+  gb.SetKey("a", true, false)
+  b := gb.B.read()
+  if _, err := gb.RunUntil(RunLimits{Cycles: 1000}); err != nil {
+    t.Fatal(err)
+  }
+  if gb.isStopped || !gb.isHalted {
+    t.Fatalf("stopped %t, halted %t", gb.isStopped, gb.isHalted)
+  }
+
+  // then VBlank wakes it like any HALT
+  reason, _ := gb.RunUntil(RunLimits{PC: 0x015D, StopAtPC: true, Frames: 2})
+  if reason != STOP_PC {
+    t.Fatal("never woke up from HALT")
+  }
+  if gb.B.read() != b || gb.C.read() != 0x77 {
+    t.Errorf("B is %02X and C %02X, want %02X and 77", gb.B.read(), gb.C.read(), b)
+  }
+}
@@ -0,0 +1,242 @@
+package cpu
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+  "strings"
+)
+
+// https://gbdev.io/pandocs/The_Cartridge_Header.html
+
+const HEADER_END = 0x150
+
+var nintendoLogo = []byte{
+  0xCE, 0xED, 0x66, 0x66, 0xCC, 0x0D, 0x00, 0x0B, 0x03, 0x73, 0x00, 0x83, 0x00, 0x0C, 0x00, 0x0D,
+  0x00, 0x08, 0x11, 0x1F, 0x88, 0x89, 0x00, 0x0E, 0xDC, 0xCC, 0x6E, 0xE6, 0xDD, 0xDD, 0xD9, 0x99,
+  0xBB, 0xBB, 0x67, 0x63, 0x6E, 0x0E, 0xEC, 0xCC, 0xDD, 0xDC, 0x99, 0x9F, 0xBB, 0xB9, 0x33, 0x3E,
+}
+
+var cartridgeTypeNames = map[uint8]string{
+  0x00: "ROM ONLY",
+  0x01: "MBC1",
+  0x02: "MBC1+RAM",
+  0x03: "MBC1+RAM+BATTERY",
+  0x05: "MBC2",
+  0x06: "MBC2+BATTERY",
+  0x08: "ROM+RAM",
+  0x09: "ROM+RAM+BATTERY",
+  0x0B: "MMM01",
+  0x0C: "MMM01+RAM",
+  0x0D: "MMM01+RAM+BATTERY",
+  0x0F: "MBC3+TIMER+BATTERY",
+  0x10: "MBC3+TIMER+RAM+BATTERY",
+  0x11: "MBC3",
+  0x12: "MBC3+RAM",
+  0x13: "MBC3+RAM+BATTERY",
+  0x19: "MBC5",
+  0x1A: "MBC5+RAM",
+  0x1B: "MBC5+RAM+BATTERY",
+  0x1C: "MBC5+RUMBLE",
+  0x1D: "MBC5+RUMBLE+RAM",
+  0x1E: "MBC5+RUMBLE+RAM+BATTERY",
+  0x20: "MBC6",
+  0x22: "MBC7+SENSOR+RUMBLE+RAM+BATTERY",
+  0xFC: "POCKET CAMERA",
+  0xFD: "BANDAI TAMA5",
+  0xFE: "HuC3",
+  0xFF: "HuC1+RAM+BATTERY",
+}
+
+var ramCartridgeTypes = map[uint8]bool{0x02: true, 0x03: true, 0x08: true, 0x09: true, 0x0C: true, 0x0D: true, 0x10: true, 0x12: true, 0x13: true, 0x1A: true, 0x1B: true, 0x1D: true, 0x1E: true}
+var batteryCartridgeTypes = map[uint8]bool{0x03: true, 0x06: true, 0x09: true, 0x0D: true, 0x0F: true, 0x10: true, 0x13: true, 0x1B: true, 0x1E: true, 0x22: true, 0xFF: true}
+
+// RAM size byte at 0x149 -> bytes
+var ramSizes = map[uint8]uint32{
+  0x00: 0,
+  0x01: 0, // unused, some homebrew sets it
+  0x02: 8*1024,
+  0x03: 32*1024,
+  0x04: 128*1024,
+  0x05: 64*1024,
+}
+
+// CartridgeHeader is the parsed contents of 0x100-0x14F
+type CartridgeHeader struct {
+  Title string
+  ManufacturerCode string
+  CGBFlag uint8
+  SGBFlag uint8
+  NewLicenseeCode string
+  OldLicenseeCode uint8
+  CartridgeType uint8
+  // the size bytes at 0x148 and 0x149, and what they mean. the sizes
+  // are 0 for codes we don't know, see ROMSizeValid and RAMSizeValid
+  ROMSizeCode uint8
+  RAMSizeCode uint8
+  ROMSize uint32
+  RAMSize uint32
+  DestinationCode uint8
+  Version uint8
+  HeaderChecksum uint8
+  GlobalChecksum uint16
+
+  // computed from the ROM, to compare with the stored ones
+  computedHeaderChecksum uint8
+  computedGlobalChecksum uint16
+  logoValid bool
+  romSizeValid bool
+  ramSizeValid bool
+}
+
+func ParseCartridgeHeader(data []byte) (CartridgeHeader, error) {
+  h := CartridgeHeader{}
+  if len(data) < HEADER_END {
+    return h, fmt.Errorf("ROM is %d bytes, too small to contain a header", len(data))
+  }
+
+  h.CGBFlag = data[0x143]
+  isCGB := h.CGBFlag == 0x80 || h.CGBFlag == 0xC0
+
+  // originally the title was 16 bytes. CGB carts use the last byte
+  // for the CGB flag and newer ones the 4 before it for a manufacturer code
+  title := data[0x134:0x144]
+  if isCGB {
+    title = data[0x134:0x143]
+    h.ManufacturerCode = printable(data[0x13F:0x143])
+  }
+  if idx := bytes.IndexByte(title, 0); idx >= 0 {
+    title = title[:idx]
+  }
+  h.Title = strings.TrimSpace(printable(title))
+
+  h.NewLicenseeCode = printable(data[0x144:0x146])
+  h.SGBFlag = data[0x146]
+  h.CartridgeType = data[0x147]
+  h.ROMSizeCode = data[0x148]
+  h.RAMSizeCode = data[0x149]
+  // 32KB to 8MB, doubling each time
+  if h.ROMSizeCode <= 0x08 {
+    h.ROMSize = 32 * 1024 << h.ROMSizeCode
+    h.romSizeValid = true
+  }
+  h.RAMSize, h.ramSizeValid = ramSizes[h.RAMSizeCode]
+  h.DestinationCode = data[0x14A]
+  h.OldLicenseeCode = data[0x14B]
+  h.Version = data[0x14C]
+  h.HeaderChecksum = data[0x14D]
+  h.GlobalChecksum = uint16(data[0x14E]) << 8 | uint16(data[0x14F])
+
+  for address := 0x134; address <= 0x14C; address++ {
+    h.computedHeaderChecksum = h.computedHeaderChecksum - data[address] - 1
+  }
+  for address, value := range data {
+    if address != 0x14E && address != 0x14F {
+      h.computedGlobalChecksum += uint16(value)
+    }
+  }
+  h.logoValid = bytes.Equal(data[0x104:0x134], nintendoLogo)
+
+  return h, nil
+}
+
+// ReadCartridgeHeader parses the header of the ROM at romFilePath
+// without setting up the rest of the emulator
+func ReadCartridgeHeader(romFilePath string) (CartridgeHeader, error) {
+  data, err := os.ReadFile(romFilePath)
+  if err != nil {
+    return CartridgeHeader{}, err
+  }
+  return ParseCartridgeHeader(data)
+}
+
+func printable(data []byte) string {
+  var sb strings.Builder
+  for _, c := range data {
+    if c >= 0x20 && c < 0x7F {
+      sb.WriteByte(c)
+    }
+  }
+  return sb.String()
+}
+
+// the boot ROM locks up if this doesn't match
+func (h CartridgeHeader) HeaderChecksumValid() bool {
+  return h.HeaderChecksum == h.computedHeaderChecksum
+}
+
+// nothing checks this on real hardware
+func (h CartridgeHeader) GlobalChecksumValid() bool {
+  return h.GlobalChecksum == h.computedGlobalChecksum
+}
+
+// the boot ROM also locks up if this doesn't match
+func (h CartridgeHeader) LogoValid() bool {
+  return h.logoValid
+}
+
+// whether the ROM size byte is one we know, otherwise ROMSize is 0
+func (h CartridgeHeader) ROMSizeValid() bool {
+  return h.romSizeValid
+}
+
+// whether the RAM size byte is one we know, otherwise RAMSize is 0
+func (h CartridgeHeader) RAMSizeValid() bool {
+  return h.ramSizeValid
+}
+
+func (h CartridgeHeader) CartridgeTypeName() string {
+  if name, ok := cartridgeTypeNames[h.CartridgeType]; ok {
+    return name
+  }
+  return "UNKNOWN"
+}
+
+// whether the cartridge has external RAM at 0xA000. the RAM size
+// byte is only trusted for these
+func (h CartridgeHeader) HasRAM() bool {
+  return ramCartridgeTypes[h.CartridgeType]
+}
+
+func (h CartridgeHeader) HasBattery() bool {
+  return batteryCartridgeTypes[h.CartridgeType]
+}
+
+// Licensee is the new licensee code if the old one says to use it
+func (h CartridgeHeader) Licensee() string {
+  if h.OldLicenseeCode == 0x33 {
+    return h.NewLicenseeCode
+  }
+  return fmt.Sprintf("%02X", h.OldLicenseeCode)
+}
+
+func (h CartridgeHeader) String() string {
+  validity := func(valid bool) string {
+    if valid {
+      return "ok"
+    }
+    return "BAD"
+  }
+  size := func(bytes uint32, code uint8, valid bool) string {
+    if valid {
+      return fmt.Sprintf("%d KiB", bytes / 1024)
+    }
+    return fmt.Sprintf("unknown (%02X)", code)
+  }
+
+  var sb strings.Builder
+  fmt.Fprintf(&sb, "Title:             %s\n", h.Title)
+  fmt.Fprintf(&sb, "Manufacturer code: %s\n", h.ManufacturerCode)
+  fmt.Fprintf(&sb, "CGB flag:          %02X\n", h.CGBFlag)
+  fmt.Fprintf(&sb, "SGB flag:          %02X\n", h.SGBFlag)
+  fmt.Fprintf(&sb, "Licensee:          %s\n", h.Licensee())
+  fmt.Fprintf(&sb, "Cartridge type:    %02X (%s)\n", h.CartridgeType, h.CartridgeTypeName())
+  fmt.Fprintf(&sb, "ROM size:          %s\n", size(h.ROMSize, h.ROMSizeCode, h.romSizeValid))
+  fmt.Fprintf(&sb, "RAM size:          %s\n", size(h.RAMSize, h.RAMSizeCode, h.ramSizeValid))
+  fmt.Fprintf(&sb, "Destination:       %02X\n", h.DestinationCode)
+  fmt.Fprintf(&sb, "Version:           %02X\n", h.Version)
+  fmt.Fprintf(&sb, "Header checksum:   %02X (%s)\n", h.HeaderChecksum, validity(h.HeaderChecksumValid()))
+  fmt.Fprintf(&sb, "Global checksum:   %04X (%s)\n", h.GlobalChecksum, validity(h.GlobalChecksumValid()))
+  fmt.Fprintf(&sb, "Nintendo logo:     %s\n", validity(h.LogoValid()))
+  return sb.String()
+}
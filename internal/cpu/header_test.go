@@ -0,0 +1,135 @@
+package cpu
+
+import (
+  "testing"
+)
+
+// a 32KB ROM with the logo, whatever edit does to it, and then
+// correct checksums
+func headerTestROM(edit func(rom []byte)) []byte {
+  rom := make([]byte, 32*1024)
+  copy(rom[0x104:], nintendoLogo)
+  copy(rom[0x134:], "TETRIS")
+  rom[0x200] = 0x42
+  edit(rom)
+
+  var header uint8
+  for address := 0x134; address <= 0x14C; address++ {
+    header = header - rom[address] - 1
+  }
+  rom[0x14D] = header
+  var global uint16
+  for address, value := range rom {
+    if address != 0x14E && address != 0x14F {
+      global += uint16(value)
+    }
+  }
+  rom[0x14E], rom[0x14F] = uint8(global >> 8), uint8(global)
+  return rom
+}
+
+func TestParseCartridgeHeader(t *testing.T) {
+  tests := []struct {
+    name string
+    edit func(rom []byte)
+    // applied after the checksums
+    corrupt func(rom []byte)
+    check func(t *testing.T, h CartridgeHeader)
+  }{
+    {"plain", func(rom []byte) {}, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.Title != "TETRIS" || h.ManufacturerCode != "" {
+        t.Errorf("title %q, manufacturer %q", h.Title, h.ManufacturerCode)
+      }
+      if h.ROMSize != 32*1024 || !h.ROMSizeValid() || h.RAMSize != 0 || !h.RAMSizeValid() {
+        t.Errorf("ROM %d %t, RAM %d %t", h.ROMSize, h.ROMSizeValid(), h.RAMSize, h.RAMSizeValid())
+      }
+      if !h.HeaderChecksumValid() || !h.GlobalChecksumValid() || !h.LogoValid() {
+        t.Errorf("header checksum %t, global %t, logo %t", h.HeaderChecksumValid(), h.GlobalChecksumValid(), h.LogoValid())
+      }
+    }},
+    {"16 byte title", func(rom []byte) {
+      copy(rom[0x134:], "ABCDEFGHIJKLMNOP")
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.Title != "ABCDEFGHIJKLMNOP" || h.ManufacturerCode != "" {
+        t.Errorf("title %q, manufacturer %q", h.Title, h.ManufacturerCode)
+      }
+    }},
+    {"manufacturer code", func(rom []byte) {
+      copy(rom[0x134:], "POKEMON\x00\x00\x00\x00AAXE")
+      rom[0x143] = 0x80
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.Title != "POKEMON" || h.ManufacturerCode != "AAXE" || h.CGBFlag != 0x80 {
+        t.Errorf("title %q, manufacturer %q, CGB flag %02X", h.Title, h.ManufacturerCode, h.CGBFlag)
+      }
+    }},
+    {"sizes", func(rom []byte) {
+      rom[0x147], rom[0x148], rom[0x149] = 0x13, 0x05, 0x03
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.ROMSize != 1024*1024 || h.RAMSize != 32*1024 || !h.HasRAM() || !h.HasBattery() {
+        t.Errorf("ROM %d, RAM %d, has RAM %t, battery %t", h.ROMSize, h.RAMSize, h.HasRAM(), h.HasBattery())
+      }
+    }},
+    {"unknown ROM size", func(rom []byte) {
+      rom[0x148] = 0x09
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.ROMSizeValid() || h.ROMSize != 0 || h.ROMSizeCode != 0x09 {
+        t.Errorf("ROM size %d, code %02X, valid %t", h.ROMSize, h.ROMSizeCode, h.ROMSizeValid())
+      }
+    }},
+    {"garbage ROM size", func(rom []byte) {
+      rom[0x148] = 0xFF
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.ROMSizeValid() || h.ROMSize != 0 {
+        t.Errorf("ROM size %d, valid %t", h.ROMSize, h.ROMSizeValid())
+      }
+    }},
+    {"unknown RAM size", func(rom []byte) {
+      rom[0x147], rom[0x149] = 0x03, 0x06
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.RAMSizeValid() || h.RAMSize != 0 || h.RAMSizeCode != 0x06 {
+        t.Errorf("RAM size %d, code %02X, valid %t", h.RAMSize, h.RAMSizeCode, h.RAMSizeValid())
+      }
+    }},
+    {"bad header checksum", func(rom []byte) {}, func(rom []byte) {
+      rom[0x14D]++
+    }, func(t *testing.T, h CartridgeHeader) {
+      if h.HeaderChecksumValid() {
+        t.Error("header checksum is valid")
+      }
+    }},
+    {"bad global checksum", func(rom []byte) {}, func(rom []byte) {
+      rom[0x4000]++
+    }, func(t *testing.T, h CartridgeHeader) {
+      if !h.HeaderChecksumValid() || h.GlobalChecksumValid() {
+        t.Errorf("header checksum %t, global %t", h.HeaderChecksumValid(), h.GlobalChecksumValid())
+      }
+    }},
+    {"bad logo", func(rom []byte) {
+      rom[0x104] = 0x00
+    }, nil, func(t *testing.T, h CartridgeHeader) {
+      if h.LogoValid() {
+        t.Error("logo is valid")
+      }
+    }},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      rom := headerTestROM(test.edit)
+      if test.corrupt != nil {
+        test.corrupt(rom)
+      }
+      h, err := ParseCartridgeHeader(rom)
+      if err != nil {
+        t.Fatal(err)
+      }
+      test.check(t, h)
+    })
+  }
+}
+
+func TestParseCartridgeHeaderTooSmall(t *testing.T) {
+  if _, err := ParseCartridgeHeader(make([]byte, HEADER_END - 1)); err == nil {
+    t.Error("parsed a header that isn't all there")
+  }
+}
@@ -0,0 +1,124 @@
+package cpu
+
+import (
+  "bytes"
+  "fmt"
+)
+
+// 154 lines of 456 dots, 4 dots per M-cycle
+const CYCLES_PER_FRAME = 154 * 456 / 4
+
+type StopReason int
+
+const (
+  STOP_CYCLES StopReason = iota
+  STOP_PC
+  STOP_SERIAL
+  STOP_FAIL_SERIAL
+)
+
+func (r StopReason) String() string {
+  switch r {
+  case STOP_CYCLES:
+    return "cycle limit"
+  case STOP_PC:
+    return "PC reached"
+  case STOP_SERIAL:
+    return "serial output matched"
+  case STOP_FAIL_SERIAL:
+    return "serial failure output matched"
+  default:
+    return "unknown"
+  }
+}
+
+// RunLimits says when RunUntil should stop. zero values are ignored,
+// except that with nothing set it would run forever
+type RunLimits struct {
+  // whichever of these comes first. a frame is the 17556 M-cycles
+  // it takes the PPU to draw one, whether or not the LCD is on
+  Frames uint64
+  Cycles uint64
+
+  // stop before running the instruction at this address
+  PC uint16
+  StopAtPC bool
+
+  // stop once the serial port output contains these
+  Serial string
+  FailSerial string
+}
+
+func (l RunLimits) cycleLimit() uint64 {
+  limit := l.Cycles
+  if l.Frames > 0 && (limit == 0 || l.Frames * CYCLES_PER_FRAME < limit) {
+    limit = l.Frames * CYCLES_PER_FRAME
+  }
+  return limit
+}
+
+// RunUntil runs as fast as possible until one of limits is hit. Any
+// panic from the emulator, e.g. an unimplemented opcode, comes back
+// as an error.
+func (cpu *Cpu) RunUntil(limits RunLimits) (reason StopReason, err error) {
+  if limits.cycleLimit() == 0 && !limits.StopAtPC && limits.Serial == "" && limits.FailSerial == "" {
+    return 0, fmt.Errorf("no limits set, would run forever")
+  }
+
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("emulator crashed at PC %04X after %d cycles: %v", cpu.PC.read(), cpu.globalCounter, r)
+    }
+  }()
+
+  fast := cpu.fast
+  cpu.fast = true
+  defer func() { cpu.fast = fast }()
+
+  start := cpu.globalCounter
+  cycleLimit := limits.cycleLimit()
+  serialChecked := len(cpu.serialOutput)
+
+  cpu.run(func(instructionBoundary bool) bool {
+    // only rescan the serial output when something new arrives
+    if len(cpu.serialOutput) != serialChecked {
+      serialChecked = len(cpu.serialOutput)
+      if limits.FailSerial != "" && bytes.Contains(cpu.serialOutput, []byte(limits.FailSerial)) {
+        reason = STOP_FAIL_SERIAL
+        return true
+      }
+      if limits.Serial != "" && bytes.Contains(cpu.serialOutput, []byte(limits.Serial)) {
+        reason = STOP_SERIAL
+        return true
+      }
+    }
+    if limits.StopAtPC && instructionBoundary && cpu.instructionAddress() == limits.PC {
+      reason = STOP_PC
+      return true
+    }
+    if cycleLimit > 0 && cpu.globalCounter - start >= cycleLimit {
+      reason = STOP_CYCLES
+      return true
+    }
+    return false
+  })
+  return reason, nil
+}
+
+// address of the instruction that was just fetched. for CB
+// instructions FetchAndDecode has already moved PC onto the suffix
+func (cpu *Cpu) instructionAddress() uint16 {
+  if cpu.CurrentOpcode.Prefixed {
+    return cpu.PC.read() - 1
+  }
+  return cpu.PC.read()
+}
+
+// SerialOutput is everything the game has sent over the serial port
+func (cpu *Cpu) SerialOutput() []byte {
+  return cpu.serialOutput
+}
+
+func (cpu *Cpu) Cycles() uint64 {
+  return cpu.globalCounter
+}
@@ -1,7 +1,5 @@
 package cpu
 
-import "fmt"
-
 // Opcode is the parsed octal representation of a byte
 // https://gb-archive.github.io/salvage/decoding_gbz80_opcodes/Decoding%20Gamboy%20Z80%20Opcodes.html
 type Opcode struct {
@@ -28,11 +26,24 @@ func ByteToOpcode(oneByte uint8, prefixed bool) Opcode {
   return op
 }
 
-// Instruction contains the actual execution logic for
-// one or more instructions
+// Instruction is one opcode's entry in opcodeTable
 type Instruction struct {
-  name string
+  // e.g. "LD A,n8", see disasm.Opcode
+  mnemonic string
   nBytes uint8
+  // M-cycles, see disasm.Opcode. only for looking at, the micro-ops
+  // are what actually take the time
+  cycles uint8
+  cyclesNotTaken uint8
+  // nil for the opcodes that don't exist
+  operations []func(*Cpu)
+}
+
+// instructionGroup is the execution logic shared by a group of opcodes
+// in makeInstructions, which works out which one it is from the fields
+// of CurrentOpcode
+type instructionGroup struct {
+  name string
   operations []func(*Cpu)
 }
 
@@ -41,51 +52,49 @@ func no_op(cpu *Cpu) {
   return
 }
 
-//TODO: this _should_ work but tetris still broken
-// so for now i invalid logic with || !cpu.IncrementPC
-// Maybe refactor so each instruction increments PC
-// and CPU doesnt store any state about IncrementPC
-// and FetchAndDecode just fetches without increments
+// interrupt dispatch, see DoInterrupts. the return address is PC as it
+// is, since the interrupted instruction was never fetched
 func int_call_push_hi(cpu *Cpu) {
   cpu.SP.dec()
-  var newPC uint16
-  // TODO: bug here?
-  newPC = cpu.PC.read()
-  //if cpu.IncrementPC || !cpu.IncrementPC {
-  //  newPC = cpu.PC.read() + uint16(cpu.OpcodeToInstruction(cpu.CurrentOpcode).nBytes)
-  //} else {
-  //  newPC = cpu.PC.read()
-  //}
-  cpu.Bus.WriteToBus(cpu.SP.read(), uint8(newPC >> 8))
+  cpu.mem.WriteToBus(cpu.SP.read(), uint8(cpu.PC.read() >> 8))
 }
 
-//TODO: this _should_ work but tetris still broken
-// so for now i invalid logic with || !cpu.IncrementPC
+// the vector is only picked now, after the high byte is pushed: if that
+// went onto IE (SP was 0000) and disabled the interrupt, the next one
+// down is taken instead, or if there's nothing left, none is and PC ends
+// up at 0000. IF is only acknowledged for the one that's taken
 func int_call_push_lo(cpu *Cpu) {
+  registers := cpu.interruptRegisters()
+  requested := registers.ReadFromBus(IF)
+  pending := registers.ReadFromBus(IE) & requested & 0x1F
+  cpu.interruptVector = 0x0000
+  for index := uint8(0); index < 5; index++ {
+    if GetBitBool(pending, index) {
+      registers.WriteToBus(IF, SetBitBool(requested, index, false))
+      cpu.interruptVector = 0x40 + 8 * uint16(index)
+      break
+    }
+  }
   cpu.SP.dec()
-  var newPC uint16
-  // TODO: bug here?
-  newPC = cpu.PC.read()
-  //if cpu.IncrementPC || !cpu.IncrementPC {
-  //  newPC = cpu.PC.read() + uint16(cpu.OpcodeToInstruction(cpu.CurrentOpcode).nBytes)
-  //} else {
-  //  newPC = cpu.PC.read()
-  //}
-  cpu.Bus.WriteToBus(cpu.SP.read(), uint8(newPC & 0xFF))
+  cpu.mem.WriteToBus(cpu.SP.read(), uint8(cpu.PC.read() & 0xFF))
+}
+
+func int_jump(cpu *Cpu) {
+  cpu.PC.write(cpu.interruptVector)
 }
 
 func call_push_hi(cpu *Cpu) {
   cpu.SP.dec()
   // return to _next_ instruction
   newPC := cpu.PC.read() + uint16(cpu.OpcodeToInstruction(cpu.CurrentOpcode).nBytes)
-  cpu.Bus.WriteToBus(cpu.SP.read(), uint8(newPC >> 8))
+  cpu.mem.WriteToBus(cpu.SP.read(), uint8(newPC >> 8))
 }
 
 func call_push_lo(cpu *Cpu) {
   cpu.SP.dec()
   // return to _next_ instruction
   newPC := cpu.PC.read() + uint16(cpu.OpcodeToInstruction(cpu.CurrentOpcode).nBytes)
-  cpu.Bus.WriteToBus(cpu.SP.read(), uint8(newPC & 0xFF))
+  cpu.mem.WriteToBus(cpu.SP.read(), uint8(newPC & 0xFF))
 }
 
 func (cpu *Cpu) DoAluInstruction(a uint8, b uint8) {
@@ -161,15 +170,16 @@ func (cpu *Cpu) DoAluInstruction(a uint8, b uint8) {
     return
   }
 
-// TODO: go through and re-check timing for each instr
-// TODO: and add no_ops to one's where previously FetchAndDecode()
-// TODO: was taking up a cycle
-func MakeInstructionMap() map[string]Instruction {
+// the micro-ops for every group of opcodes, which buildOpcodeTable
+// spreads over the opcodes. TestInstructionCycles checks each one takes
+// as long as disasm says. also returns every micro-op by name, see
+// microOpTable
+func makeInstructions() (map[string]instructionGroup, map[string]func(*Cpu)) {
   // the keys in this map are just my internal
   // names based on the X/Y/Z/P/Q's we need to
   // match on, since its a many -> one mapping
   // of opcodes to actual exection instructions.
-  instructionMap := make(map[string]Instruction)
+  instructionMap := make(map[string]instructionGroup)
 
   // X=0, Z=1, Q=0
   x0z1q0_1 := func (cpu *Cpu) {
@@ -185,61 +195,56 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z1Q0"] = Instruction{
+  instructionMap["X0Z1Q0"] = instructionGroup{
     "LD rp[p] nn",
-    3,
     []func(*Cpu){no_op, x0z1q0_1, x0z1q0_2},
   }
 
   // X=0, Z=2, P=3, Q=0
   x0z2q0p3_1 := func (cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.HL.read(), cpu.A.read())
+    cpu.mem.WriteToBus(cpu.HL.read(), cpu.A.read())
     cpu.HL.dec()
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P3Q0"] = Instruction {
+  instructionMap["X0Z2P3Q0"] = instructionGroup{
    "LDD (HL) A",
-   1,
    []func(*Cpu){x0z2q0p3_1, no_op},
   }
 
   // X=0, Z=2, P=2, Q=0
   x0z2q0p2_1 := func (cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.HL.read(), cpu.A.read())
+    cpu.mem.WriteToBus(cpu.HL.read(), cpu.A.read())
     cpu.HL.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P2Q0"] = Instruction {
+  instructionMap["X0Z2P2Q0"] = instructionGroup{
    "LDI (HL) A",
-   1,
    []func(*Cpu){x0z2q0p2_1, no_op},
   }
 
   // X=0, Z=2, P=3, Q=1
   x0z2q1p3_1 := func (cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(cpu.HL.read()))
+    cpu.A.write(cpu.mem.ReadFromBus(cpu.HL.read()))
     cpu.HL.dec()
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P3Q1"] = Instruction {
+  instructionMap["X0Z2P3Q1"] = instructionGroup{
    "LDD A (HL)",
-   1,
    []func(*Cpu){x0z2q1p3_1, no_op},
   }
 
   // X=0, Z=2, P=2, Q=1
   x0z2q1p2_1 := func (cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(cpu.HL.read()))
+    cpu.A.write(cpu.mem.ReadFromBus(cpu.HL.read()))
     cpu.HL.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P2Q1"] = Instruction {
+  instructionMap["X0Z2P2Q1"] = instructionGroup{
    "LDI A (HL)",
-   1,
    []func(*Cpu){x0z2q1p2_1, no_op},
   }
 
@@ -251,7 +256,7 @@ func MakeInstructionMap() map[string]Instruction {
       register := cpu.GetRTableRegister(cpu.CurrentOpcode.Z)
       b = register.read()
     } else {
-      b = cpu.Bus.ReadFromBus(cpu.HL.read())
+      b = cpu.mem.ReadFromBus(cpu.HL.read())
     }
 
     cpu.DoAluInstruction(a, b)
@@ -261,14 +266,11 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
- // TODO: if instructions in same group
- // have different nBytes, i have problem
  // TODO: if instructions should only last
  // 1 cycle, i have problem b/c i have separate
  // cycle for fetch and microops
-  instructionMap["X2"] = Instruction{
+  instructionMap["X2"] = instructionGroup{
     "alu[y] r[z]",
-    1,
     []func(*Cpu){x2_1},
   }
 
@@ -280,9 +282,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X3Y7Z3"] = Instruction{
+  instructionMap["X3Y7Z3"] = instructionGroup{
     "EI",
-    1,
     []func(*Cpu){x3y7z3},
   }
 
@@ -290,49 +291,47 @@ func MakeInstructionMap() map[string]Instruction {
     if cpu.CurrentOpcode.Y != 6 {
       cpu.GetRTableRegister(cpu.CurrentOpcode.Y).write(cpu.ReadN())
     } else if cpu.CurrentOpcode.Y == 6 {
-      cpu.Bus.WriteToBus(cpu.HL.read(), cpu.ReadN())
+      cpu.mem.WriteToBus(cpu.HL.read(), cpu.ReadN())
       cpu.ExecutionQueue.Push(no_op)
     }
     cpu.PC.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z6"] = Instruction{
+  instructionMap["X0Z6"] = instructionGroup{
     "LD r[y], N",
-    2,
     []func(*Cpu){no_op, x0z6_1},
   }
 
   x3z2y4_1 := func (cpu *Cpu) {
-    cpu.Bus.WriteToBus(0xFF00 + uint16(cpu.C.read()), cpu.A.read())
+    cpu.mem.WriteToBus(0xFF00 + uint16(cpu.C.read()), cpu.A.read())
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z2Y4"] = Instruction{
+  instructionMap["X3Z2Y4"] = instructionGroup{
     "LD [0xFF00 + C], A",
-    1,
     []func(*Cpu){x3z2y4_1, no_op},
   }
 
   x3z2y6_1 := func (cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(0xFF00 + uint16(cpu.C.read())))
+    cpu.A.write(cpu.mem.ReadFromBus(0xFF00 + uint16(cpu.C.read())))
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z2Y6"] = Instruction{
+  instructionMap["X3Z2Y6"] = instructionGroup{
     "LD A, [0xFF00 + C]",
-    1,
     []func(*Cpu){x3z2y6_1, no_op},
   }
 
   x3y6z3_1 := func (cpu *Cpu) {
+    // DI straight after EI wins, IME never gets set
     cpu.IME = false
+    cpu.IMECountdown = -1
     cpu.PC.inc()
   }
 
-  instructionMap["X3Y6Z3"] = Instruction{
+  instructionMap["X3Y6Z3"] = instructionGroup{
     "DI",
-    1,
     []func(*Cpu){x3y6z3_1},
   }
 
@@ -343,96 +342,89 @@ func MakeInstructionMap() map[string]Instruction {
       to.write(from.read())
     } else if cpu.CurrentOpcode.Y == 6 {
       from := cpu.GetRTableRegister(cpu.CurrentOpcode.Z)
-      cpu.Bus.WriteToBus(cpu.HL.read(), from.read())
+      cpu.mem.WriteToBus(cpu.HL.read(), from.read())
 
       // ideally this would happen _before_ x1_1 is executed
       cpu.ExecutionQueue.Push(no_op)
     } else if cpu.CurrentOpcode.Z == 6 {
       to := cpu.GetRTableRegister(cpu.CurrentOpcode.Y)
-      to.write(cpu.Bus.ReadFromBus(cpu.HL.read()))
+      to.write(cpu.mem.ReadFromBus(cpu.HL.read()))
 
       cpu.ExecutionQueue.Push(no_op)
     }
     cpu.PC.inc()
   }
 
-  instructionMap["X1"] = Instruction{
+  instructionMap["X1"] = instructionGroup{
     "LD r[y] r[z]",
-    1,
     []func(*Cpu){x1_1},
   }
 
   x3z0y4_2 := func (cpu *Cpu) {
     n := cpu.ReadN()
-    cpu.Bus.WriteToBus(0xFF00 + uint16(n), cpu.A.read())
+    cpu.mem.WriteToBus(0xFF00 + uint16(n), cpu.A.read())
     cpu.PC.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z0Y4"] = Instruction{
+  instructionMap["X3Z0Y4"] = instructionGroup{
     "LD [0xFF00+u8], A",
-    2,
     []func(*Cpu){no_op, x3z0y4_2, no_op},
   }
 
   x3z5q0_2 := func (cpu *Cpu) {
     cpu.SP.dec()
-    cpu.Bus.WriteToBus(cpu.SP.read(), cpu.rp2Table[cpu.CurrentOpcode.P].readHi())
+    cpu.mem.WriteToBus(cpu.SP.read(), cpu.rp2Table[cpu.CurrentOpcode.P].readHi())
   }
 
   x3z5q0_3 := func (cpu *Cpu) {
     cpu.SP.dec()
-    cpu.Bus.WriteToBus(cpu.SP.read(), cpu.rp2Table[cpu.CurrentOpcode.P].readLo())
+    cpu.mem.WriteToBus(cpu.SP.read(), cpu.rp2Table[cpu.CurrentOpcode.P].readLo())
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z5Q0"] = Instruction{
+  instructionMap["X3Z5Q0"] = instructionGroup{
     "PUSH rp2[p]",
-    1,
     []func(*Cpu){no_op, no_op,x3z5q0_2,x3z5q0_3},
   }
 
   x0z2p0q0_1 := func (cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.BC.read(), cpu.A.read())
+    cpu.mem.WriteToBus(cpu.BC.read(), cpu.A.read())
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P0Q0"] = Instruction{
+  instructionMap["X0Z2P0Q0"] = instructionGroup{
     "LD [BC], A",
-    1,
     []func(*Cpu){x0z2p0q0_1, no_op},
   }
 
   x0z2p1q0_1 := func (cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.DE.read(), cpu.A.read())
+    cpu.mem.WriteToBus(cpu.DE.read(), cpu.A.read())
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P1Q0"] = Instruction{
+  instructionMap["X0Z2P1Q0"] = instructionGroup{
     "LD [DE], A",
-    1,
     []func(*Cpu){x0z2p1q0_1, no_op},
   }
 
   x0z2p1q1_1 := func (cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(cpu.DE.read()))
+    cpu.A.write(cpu.mem.ReadFromBus(cpu.DE.read()))
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P1Q1"] = Instruction{
+  instructionMap["X0Z2P1Q1"] = instructionGroup{
     "LD A, [DE]",
-    1,
     []func(*Cpu){x0z2p1q1_1, no_op},
   }
 
   x0z2p0q1_1 := func (cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(cpu.BC.read()))
+    cpu.A.write(cpu.mem.ReadFromBus(cpu.BC.read()))
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z2P0Q1"] = Instruction{
+  instructionMap["X0Z2P0Q1"] = instructionGroup{
     "LD A, [BC]",
-    1,
     []func(*Cpu){x0z2p0q1_1, no_op},
   }
 
@@ -447,20 +439,19 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z3"] = Instruction{
+  instructionMap["X0Z3"] = instructionGroup{
     "INC/DEC rp[p]",
-    1,
     []func(*Cpu){no_op, x0z3_1},
   }
 
-  x0z0ygte4_1 := func (cpu *Cpu) {
-      x0z0ygte4_2 := func (cpu *Cpu) {
-        // NB: the relative jump is relative to the
-        // instruction _after_ this one.
-        newPC := cpu.PC.read() + uint16(cpu.ReadD()) + 2
-        cpu.PC.write(newPC)
-      }
+  x0z0ygte4_2 := func (cpu *Cpu) {
+    // NB: the relative jump is relative to the
+    // instruction _after_ this one.
+    newPC := cpu.PC.read() + uint16(cpu.ReadD()) + 2
+    cpu.PC.write(newPC)
+  }
 
+  x0z0ygte4_1 := func (cpu *Cpu) {
     cond := cpu.GetCCTableBool(cpu.CurrentOpcode.Y-4)
     if (cond) {
       // will this break shit? def. feels like
@@ -473,9 +464,8 @@ func MakeInstructionMap() map[string]Instruction {
     }
   }
 
-  instructionMap["X0Z0Ygte4"] = Instruction{
+  instructionMap["X0Z0Ygte4"] = instructionGroup{
     "JR cc[y-4], d",
-    2,
     []func(*Cpu){no_op, x0z0ygte4_1},
   }
 
@@ -486,9 +476,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.write(newPC)
   }
 
-  instructionMap["X0Z0Y3"] = Instruction{
+  instructionMap["X0Z0Y3"] = instructionGroup{
     "JR d",
-    2,
     []func(*Cpu){no_op, no_op, x0z0y3_1},
   }
 
@@ -500,9 +489,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z6"] = Instruction{
+  instructionMap["X3Z6"] = instructionGroup{
     "alu[y] n",
-    2,
     []func(*Cpu){no_op, x3z6_1},
   }
 
@@ -517,9 +505,8 @@ func MakeInstructionMap() map[string]Instruction {
     }
   }
 
-  instructionMap["X3Z5P0Q1"] = Instruction{
+  instructionMap["X3Z5P0Q1"] = instructionGroup{
     "CALL NN",
-    3,
     []func(*Cpu){no_op, no_op, no_op, no_op, call_push_hi, call_push_lo_and_jump},
   }
 
@@ -536,27 +523,24 @@ func MakeInstructionMap() map[string]Instruction {
     }
   }
 
-  instructionMap["X3Z4Ylte3"] = Instruction{
+  instructionMap["X3Z4Ylte3"] = instructionGroup{
     "CALL cc[y] NN",
-    3,
     []func(*Cpu){no_op, no_op, x3z4ylte3_branch},
   }
 
-  instructionMap["X3Z7"] = Instruction{
+  instructionMap["X3Z7"] = instructionGroup{
     "RST y*8",
-    1,
     []func(*Cpu){no_op, no_op, call_push_hi, call_push_lo_and_jump},
   }
 
   x3z0y6_2 := func(cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(0xFF00 + uint16(cpu.ReadN())))
+    cpu.A.write(cpu.mem.ReadFromBus(0xFF00 + uint16(cpu.ReadN())))
     cpu.PC.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z0Y6"] = Instruction{
+  instructionMap["X3Z0Y6"] = instructionGroup{
     "LD A, [0xFF00+n]",
-    2,
     []func(*Cpu){no_op, x3z0y6_2, no_op},
   }
 
@@ -567,9 +551,9 @@ func MakeInstructionMap() map[string]Instruction {
       reg.dec()
       val = reg.read()
     } else {
-      memAtHL := cpu.Bus.ReadFromBus(cpu.HL.read())
+      memAtHL := cpu.mem.ReadFromBus(cpu.HL.read())
       val = memAtHL - 1
-      cpu.Bus.WriteToBus(cpu.HL.read(), val)
+      cpu.mem.WriteToBus(cpu.HL.read(), val)
 
       cpu.ExecutionQueue.Push(no_op)
       cpu.ExecutionQueue.Push(no_op)
@@ -591,9 +575,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z5"] = Instruction{
+  instructionMap["X0Z5"] = instructionGroup{
     "DEC r[y]",
-    1,
     []func(*Cpu){x0z5_1},
   }
 
@@ -604,9 +587,9 @@ func MakeInstructionMap() map[string]Instruction {
       reg.inc()
       val = reg.read()
     } else {
-      memAtHL := cpu.Bus.ReadFromBus(cpu.HL.read())
+      memAtHL := cpu.mem.ReadFromBus(cpu.HL.read())
       val = memAtHL + 1
-      cpu.Bus.WriteToBus(cpu.HL.read(), val)
+      cpu.mem.WriteToBus(cpu.HL.read(), val)
       cpu.ExecutionQueue.Push(no_op)
       cpu.ExecutionQueue.Push(no_op)
     }
@@ -627,24 +610,22 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z4"] = Instruction{
+  instructionMap["X0Z4"] = instructionGroup{
     "INC r[y]",
-    1,
     []func(*Cpu){x0z4_1},
   }
 
   ret := func(cpu *Cpu) {
-    lower := cpu.Bus.ReadFromBus(cpu.SP.read())
+    lower := cpu.mem.ReadFromBus(cpu.SP.read())
     cpu.SP.inc()
-    upper := cpu.Bus.ReadFromBus(cpu.SP.read())
+    upper := cpu.mem.ReadFromBus(cpu.SP.read())
     cpu.SP.inc()
 
     cpu.PC.write(uint16(upper) << 8 | uint16(lower))
   }
 
-  instructionMap["X3Z1Q1P0"] = Instruction{
+  instructionMap["X3Z1Q1P0"] = instructionGroup{
     "RET",
-    1,
     []func(*Cpu){no_op, no_op, no_op, ret},
   }
 
@@ -656,9 +637,8 @@ func MakeInstructionMap() map[string]Instruction {
 
   // for this and RET, timing of writes don't
   // line up exactly
-  instructionMap["X3Z1Q1P1"] = Instruction{
+  instructionMap["X3Z1Q1P1"] = instructionGroup{
     "RETI",
-    1,
     []func(*Cpu){no_op, no_op, no_op, x3z1q1p1_1},
   }
 
@@ -676,9 +656,8 @@ func MakeInstructionMap() map[string]Instruction {
     }
   }
 
-  instructionMap["X3Z0Ylte3"] = Instruction{
+  instructionMap["X3Z0Ylte3"] = instructionGroup{
     "RET cc[y]",
-    1,
     []func(*Cpu){no_op, x3z0ylte3_1},
   }
 
@@ -686,9 +665,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z0Y0"] = Instruction{
+  instructionMap["X0Z0Y0"] = instructionGroup{
     "NOP",
-    1,
     []func(*Cpu){no_op_inc_pc},
   }
 
@@ -697,9 +675,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.write(nn)
   }
 
-  instructionMap["X3Z3Y0"] = Instruction{
+  instructionMap["X3Z3Y0"] = instructionGroup{
     "JP NN",
-    3,
     []func(*Cpu){no_op, no_op, no_op, x3z3y0_1},
   }
 
@@ -707,21 +684,20 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.write(cpu.HL.read())
   }
 
-  instructionMap["X3Z1Q1P2"] = Instruction{
+  instructionMap["X3Z1Q1P2"] = instructionGroup{
     "JP HL",
-    1,
     []func(*Cpu){x3z1q1p2_1},
   }
 
-  x3z2ylte3_1 := func (cpu *Cpu) {
-      // function to do the jump
-      x3z2ylte3_2 := func (cpu *Cpu) {
-        // TODO: does this work?? signed and unsigned
-        // confusion
-        newPC := cpu.ReadNN()
-        cpu.PC.write(newPC)
-      }
+  // function to do the jump
+  x3z2ylte3_2 := func (cpu *Cpu) {
+    // TODO: does this work?? signed and unsigned
+    // confusion
+    newPC := cpu.ReadNN()
+    cpu.PC.write(newPC)
+  }
 
+  x3z2ylte3_1 := func (cpu *Cpu) {
     cond := cpu.GetCCTableBool(cpu.CurrentOpcode.Y)
     if (cond) {
       // will this break shit? def. feels like
@@ -734,9 +710,8 @@ func MakeInstructionMap() map[string]Instruction {
     }
   }
 
-  instructionMap["X3Z2Ylte3"] = Instruction{
+  instructionMap["X3Z2Ylte3"] = instructionGroup{
     "JP cc[y], nn",
-    3,
     []func(*Cpu){no_op, no_op, x3z2ylte3_1},
   }
 
@@ -745,7 +720,7 @@ func MakeInstructionMap() map[string]Instruction {
     // set the flags, because they
     // are one and the same
     reg := cpu.rp2Table[cpu.CurrentOpcode.P]
-    val := cpu.Bus.ReadFromBus(cpu.SP.read())
+    val := cpu.mem.ReadFromBus(cpu.SP.read())
     reg.lo.write(val)
     // AF: zero-out bottom nibble
     if cpu.CurrentOpcode.P == 3 {
@@ -756,41 +731,38 @@ func MakeInstructionMap() map[string]Instruction {
 
   x3z1q0_2 := func(cpu *Cpu) {
     reg := cpu.rp2Table[cpu.CurrentOpcode.P]
-    val := cpu.Bus.ReadFromBus(cpu.SP.read())
+    val := cpu.mem.ReadFromBus(cpu.SP.read())
     reg.hi.write(val)
     cpu.SP.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z1Q0"] = Instruction{
+  instructionMap["X3Z1Q0"] = instructionGroup{
     "POP rp2[p]",
-    1,
     []func(*Cpu){no_op, x3z1q0_1, x3z1q0_2},
   }
 
   x3z2y7_1 := func(cpu *Cpu) {
-    cpu.A.write(cpu.Bus.ReadFromBus(cpu.ReadNN()))
+    cpu.A.write(cpu.mem.ReadFromBus(cpu.ReadNN()))
     cpu.PC.inc()
     cpu.PC.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z2Y7"] = Instruction{
+  instructionMap["X3Z2Y7"] = instructionGroup{
     "LD A, [NN]",
-    3,
     []func(*Cpu){no_op, no_op, x3z2y7_1, no_op},
   }
 
   x3z2y5_1 := func(cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.ReadNN(), cpu.A.read())
+    cpu.mem.WriteToBus(cpu.ReadNN(), cpu.A.read())
     cpu.PC.inc()
     cpu.PC.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z2Y5"] = Instruction{
+  instructionMap["X3Z2Y5"] = instructionGroup{
     "LD [NN], A",
-    3,
     []func(*Cpu){no_op, no_op, x3z2y5_1, no_op},
   }
 
@@ -829,9 +801,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z7Ylte3"] = Instruction{
+  instructionMap["X0Z7Ylte3"] = instructionGroup{
     "RLCA/RRCA/RLA/RRA",
-    1,
     []func(*Cpu){x0z7ylte3_1},
   }
 
@@ -842,9 +813,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z7Y5"] = Instruction{
+  instructionMap["X0Z7Y5"] = instructionGroup{
     "CPL",
-    1,
     []func(*Cpu){x0z7y5_1},
   }
 
@@ -855,9 +825,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z7Y6"] = Instruction{
+  instructionMap["X0Z7Y6"] = instructionGroup{
     "SCF",
-    1,
     []func(*Cpu){x0z7y6_1},
   }
 
@@ -872,9 +841,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z7Y7"] = Instruction{
+  instructionMap["X0Z7Y7"] = instructionGroup{
     "CCF",
-    1,
     []func(*Cpu){x0z7y7_1},
   }
 
@@ -900,37 +868,51 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z1Q1"] = Instruction{
+  instructionMap["X0Z1Q1"] = instructionGroup{
     "ADD HL, rp[p]",
-    1,
     []func(*Cpu){no_op, x0z1q1_1},
   }
 
   x0z0y1_1 := func(cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.ReadNN(), cpu.SP.readLo())
+    cpu.mem.WriteToBus(cpu.ReadNN(), cpu.SP.readLo())
   }
 
   x0z0y1_2 := func(cpu *Cpu) {
-    cpu.Bus.WriteToBus(cpu.ReadNN() + 1, cpu.SP.readHi())
+    cpu.mem.WriteToBus(cpu.ReadNN() + 1, cpu.SP.readHi())
     cpu.PC.inc()
     cpu.PC.inc()
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z0Y1"] = Instruction{
+  instructionMap["X0Z0Y1"] = instructionGroup{
     "LD (nn) SP",
-    3,
     []func(*Cpu){no_op, no_op, no_op, x0z0y1_1, x0z0y1_2},
   }
 
+  // STOP, as in https://gbdev.io/pandocs/Reducing_Power_Consumption.html#using-the-stop-instruction
+  // (the DMG half, there's no CGB speed switch):
+  //   - it's two bytes, the second skipped, unless an interrupt is pending
+  //   - if a button is already held it never stops: with an interrupt
+  //     pending nothing happens, otherwise it HALTs
+  //   - otherwise DIV is reset and the clock stops, with timers and the
+  //     LCD frozen, until a joypad line goes low, see fetchIfIdle
   x0z0y2_1 := func(cpu *Cpu) {
-    fmt.Printf("STOP PC %04X SP %04X GC %d\n", cpu.PC.read(), cpu.SP.read(), cpu.globalCounter)
-    panic("STOP")
+    buttonHeld := cpu.mem.ReadFromBus(P1) & 0x0F != 0x0F
+    pending := cpu.interruptPending()
+    cpu.PC.inc()
+    if !pending {
+      cpu.PC.inc()
+    }
+    if buttonHeld {
+      cpu.isHalted = !pending
+      return
+    }
+    cpu.mem.WriteToBus(DIV, 0)
+    cpu.isStopped = true
   }
 
-  instructionMap["X0Z0Y2"] = Instruction{
+  instructionMap["X0Z0Y2"] = instructionGroup{
     "STOP",
-    1,
     []func(*Cpu){x0z0y2_1},
   }
 
@@ -939,9 +921,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z1Q1P3"] = Instruction{
+  instructionMap["X3Z1Q1P3"] = instructionGroup{
     "LD SP, HL",
-    1,
     []func(*Cpu){no_op, x3z1q1p3_1},
   }
 
@@ -971,9 +952,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z0Y5"] = Instruction{
+  instructionMap["X3Z0Y5"] = instructionGroup{
     "ADD SP, d",
-    2,
     []func(*Cpu){no_op, no_op, no_op, x3z0y5_1},
   }
 
@@ -1001,9 +981,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X3Z0Y7"] = Instruction{
+  instructionMap["X3Z0Y7"] = instructionGroup{
     "LD HL, SP + d",
-    2,
     []func(*Cpu){no_op, no_op, x3z0y7_1},
   }
 
@@ -1050,9 +1029,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["X0Z7Y4"] = Instruction{
+  instructionMap["X0Z7Y4"] = instructionGroup{
     "DAA",
-    1,
     []func(*Cpu){x0z7y4_1},
   }
 
@@ -1062,7 +1040,7 @@ func MakeInstructionMap() map[string]Instruction {
     if cpu.CurrentOpcode.Z != 6 {
       result = cpu.GetRTableRegister(cpu.CurrentOpcode.Z).read()
     } else {
-      result = cpu.Bus.ReadFromBus(cpu.HL.read())
+      result = cpu.mem.ReadFromBus(cpu.HL.read())
     }
 
     y := cpu.CurrentOpcode.Y
@@ -1112,7 +1090,7 @@ func MakeInstructionMap() map[string]Instruction {
     if cpu.CurrentOpcode.Z != 6 {
       cpu.GetRTableRegister(cpu.CurrentOpcode.Z).write(result)
     } else {
-      cpu.Bus.WriteToBus(cpu.HL.read(), result)
+      cpu.mem.WriteToBus(cpu.HL.read(), result)
 
       cpu.ExecutionQueue.Push(no_op)
       cpu.ExecutionQueue.Push(no_op)
@@ -1121,9 +1099,8 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["CBX0"] = Instruction{
+  instructionMap["CBX0"] = instructionGroup{
     "rot[y] r[z]",
-    1,
     []func(*Cpu){no_op, cbx0_1},
   }
 
@@ -1133,7 +1110,7 @@ func MakeInstructionMap() map[string]Instruction {
     if oc.Z != 6 {
       value = cpu.GetRTableRegister(cpu.CurrentOpcode.Z).read()
     } else {
-      value = cpu.Bus.ReadFromBus(cpu.HL.read())
+      value = cpu.mem.ReadFromBus(cpu.HL.read())
     }
 
     //TODO: replace with Get/Set bit util functions; same with flags
@@ -1153,17 +1130,16 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["CBX1"] = Instruction{
+  instructionMap["CBX1"] = instructionGroup{
     "BIT y, r[z]",
-    1,
     []func(*Cpu){no_op, cbx1_1},
   }
 
   cbx2_2 := func(cpu *Cpu) {
     y := cpu.CurrentOpcode.Y
-    value := cpu.Bus.ReadFromBus(cpu.HL.read())
+    value := cpu.mem.ReadFromBus(cpu.HL.read())
     result := value & ^(0x1 << y)
-    cpu.Bus.WriteToBus(cpu.HL.read(), result)
+    cpu.mem.WriteToBus(cpu.HL.read(), result)
   }
 
   cbx2_1 := func(cpu *Cpu) {
@@ -1181,17 +1157,16 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["CBX2"] = Instruction{
+  instructionMap["CBX2"] = instructionGroup{
     "RES y, r[z]",
-    1,
     []func(*Cpu){no_op, cbx2_1},
   }
 
   cbx3_2 := func(cpu *Cpu) {
     y := cpu.CurrentOpcode.Y
-    value := cpu.Bus.ReadFromBus(cpu.HL.read())
+    value := cpu.mem.ReadFromBus(cpu.HL.read())
     result := (value | (0x1 << y))
-    cpu.Bus.WriteToBus(cpu.HL.read(), result)
+    cpu.mem.WriteToBus(cpu.HL.read(), result)
   }
 
   cbx3_1 := func(cpu *Cpu) {
@@ -1209,40 +1184,101 @@ func MakeInstructionMap() map[string]Instruction {
     cpu.PC.inc()
   }
 
-  instructionMap["CBX3"] = Instruction{
+  instructionMap["CBX3"] = instructionGroup{
     "SET y, r[z]",
-    1,
     []func(*Cpu){no_op, cbx3_1},
   }
 
-  // TODO: implement HALT bug
+  // HALT stops fetching until an interrupt is pending (IE & IF != 0),
+  // whatever IME is, see fetchIfIdle. if one already is it doesn't halt
+  // at all, and with IME=0 that's the HALT bug: the next opcode is read
+  // without PC moving past it, see FetchAndDecode
   halt := func(cpu *Cpu){
-    // make it halt
-    if !cpu.isHalted {
-      //fmt.Printf("starting halt PC:%04X IME:%t IE:%08b IF:%08b GC:%d\n", cpu.PC.read(), cpu.IME, cpu.Bus.ReadFromBus(IE), cpu.Bus.ReadFromBus(IF), cpu.globalCounter)
-    }
-    cpu.isHalted = true
-
-    pendingInt := (cpu.Bus.ReadFromBus(IE) & cpu.Bus.ReadFromBus(IF)) != 0
-
-    // unhalt if pending interrupt, regardless of IME
-    // DoInterrupts() will check IME to decide whether to service interrupt
-    if pendingInt || cpu.justDidInterrupt {
-      cpu.isHalted = false
-      cpu.PC.inc()
-      //fmt.Printf("unhalted PC:%04X GC:%d\n", cpu.PC.read(), cpu.globalCounter)
+    cpu.PC.inc()
+    if cpu.interruptPending() {
+      // with IME=1 DoInterrupts dispatches it at the next fetch
+      cpu.haltBug = !cpu.IME
       return
     }
-
-    // if no pending interrupt, keep halting
-    return
+    cpu.isHalted = true
   }
 
-  instructionMap["X1Z6Y6"] = Instruction{
+  instructionMap["X1Z6Y6"] = instructionGroup{
     "HALT",
-    1,
     []func(*Cpu){halt},
   }
 
-  return instructionMap
+  // anything that can end up in the ExecutionQueue has to be in here,
+  // or save states can't write it down. the names are part of the
+  // save state format, don't rename them
+  microOps := map[string]func(*Cpu){
+    "no_op": no_op,
+    "int_call_push_hi": int_call_push_hi,
+    "int_call_push_lo": int_call_push_lo,
+    "int_jump": int_jump,
+    "call_push_hi": call_push_hi,
+    "call_push_lo": call_push_lo,
+    "call_push_lo_and_jump": call_push_lo_and_jump,
+    "ret": ret,
+    "no_op_inc_pc": no_op_inc_pc,
+    "halt": halt,
+    "x0z1q0_1": x0z1q0_1,
+    "x0z1q0_2": x0z1q0_2,
+    "x0z2q0p3_1": x0z2q0p3_1,
+    "x0z2q0p2_1": x0z2q0p2_1,
+    "x0z2q1p3_1": x0z2q1p3_1,
+    "x0z2q1p2_1": x0z2q1p2_1,
+    "x2_1": x2_1,
+    "x3y7z3": x3y7z3,
+    "x0z6_1": x0z6_1,
+    "x3z2y4_1": x3z2y4_1,
+    "x3z2y6_1": x3z2y6_1,
+    "x3y6z3_1": x3y6z3_1,
+    "x1_1": x1_1,
+    "x3z0y4_2": x3z0y4_2,
+    "x3z5q0_2": x3z5q0_2,
+    "x3z5q0_3": x3z5q0_3,
+    "x0z2p0q0_1": x0z2p0q0_1,
+    "x0z2p1q0_1": x0z2p1q0_1,
+    "x0z2p1q1_1": x0z2p1q1_1,
+    "x0z2p0q1_1": x0z2p0q1_1,
+    "x0z3_1": x0z3_1,
+    "x0z0ygte4_1": x0z0ygte4_1,
+    "x0z0ygte4_2": x0z0ygte4_2,
+    "x0z0y3_1": x0z0y3_1,
+    "x3z6_1": x3z6_1,
+    "x3z4ylte3_branch": x3z4ylte3_branch,
+    "x3z0y6_2": x3z0y6_2,
+    "x0z5_1": x0z5_1,
+    "x0z4_1": x0z4_1,
+    "x3z1q1p1_1": x3z1q1p1_1,
+    "x3z0ylte3_1": x3z0ylte3_1,
+    "x3z3y0_1": x3z3y0_1,
+    "x3z1q1p2_1": x3z1q1p2_1,
+    "x3z2ylte3_1": x3z2ylte3_1,
+    "x3z2ylte3_2": x3z2ylte3_2,
+    "x3z1q0_1": x3z1q0_1,
+    "x3z1q0_2": x3z1q0_2,
+    "x3z2y7_1": x3z2y7_1,
+    "x3z2y5_1": x3z2y5_1,
+    "x0z7ylte3_1": x0z7ylte3_1,
+    "x0z7y5_1": x0z7y5_1,
+    "x0z7y6_1": x0z7y6_1,
+    "x0z7y7_1": x0z7y7_1,
+    "x0z1q1_1": x0z1q1_1,
+    "x0z0y1_1": x0z0y1_1,
+    "x0z0y1_2": x0z0y1_2,
+    "x0z0y2_1": x0z0y2_1,
+    "x3z1q1p3_1": x3z1q1p3_1,
+    "x3z0y5_1": x3z0y5_1,
+    "x3z0y7_1": x3z0y7_1,
+    "x0z7y4_1": x0z7y4_1,
+    "cbx0_1": cbx0_1,
+    "cbx1_1": cbx1_1,
+    "cbx2_1": cbx2_1,
+    "cbx2_2": cbx2_2,
+    "cbx3_1": cbx3_1,
+    "cbx3_2": cbx3_2,
+  }
+  return instructionMap, microOps
 }
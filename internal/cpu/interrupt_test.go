@@ -0,0 +1,149 @@
+package cpu
+
+import (
+  "testing"
+)
+
+func TestInterruptPushOntoIE(t *testing.T) {
+  // with SP at 0000 the high byte of PC is pushed onto IE. the vector
+  // is picked after that, from whatever IE is now
+  tests := []struct {
+    name string
+    // where the code runs, i.e. what gets written to IE
+    page uint16
+    requested uint8
+    wantB uint8
+    wantIF uint8
+  }{
+    // 03 keeps VBlank enabled
+    {"iepushkept", 0x0300, 0x01, 0x40, 0x00},
+    // 02 swaps VBlank for STAT
+    {"iepushstat", 0x0200, 0x03, 0x48, 0x01},
+    // and with nothing left, dispatch goes to 0000 and IF is untouched
+    {"iepushnone", 0x0200, 0x01, 0xAA, 0x01},
+  }
+  for _, test := range tests {
+    gb := newGameBoyWithCode(t, test.name, map[uint16][]byte{
+      0x0000: {0x06, 0xAA, 0x18, 0xFE},
+      0x0040: {0x06, 0x40, 0x18, 0xFE},
+      0x0048: {0x06, 0x48, 0x18, 0xFE},
+      0x0150: {0xC3, 0x00, uint8(test.page >> 8)},
+      test.page: {
+        0xF3,             // DI
+        0xAF,             // XOR A
+        0xE0, 0x40,       // LDH (LCDC),A, so the PPU stays out of it
+        0x31, 0x00, 0x00, // LD SP,$0000
+        0x3C,             // INC A
+        0xE0, 0xFF,       // LDH (IE),A
+        0x3E, test.requested, // LD A,requested
+        0xE0, 0x0F,       // LDH (IF),A
+        0xFB,             // EI
+        0x00,             // NOP, then the interrupt
+        0x18, 0xFE,       // JR $FE
+      },
+    })
+    if _, err := gb.RunUntil(RunLimits{Cycles: 200}); err != nil {
+      t.Fatal(err)
+    }
+    if b := gb.B.read(); b != test.wantB {
+      t.Errorf("%s: B is %02X, want %02X", test.name, b, test.wantB)
+    }
+    if ie := gb.Bus.ReadFromBus(IE); ie != uint8(test.page >> 8) {
+      t.Errorf("%s: IE is %02X", test.name, ie)
+    }
+    if requested := gb.Bus.ReadFromBus(IF) & 0x1F; requested != test.wantIF {
+      t.Errorf("%s: IF is %02X, want %02X", test.name, requested, test.wantIF)
+    }
+    if lo := gb.Bus.ReadFromBus(0xFFFE); lo != 0x10 {
+      t.Errorf("%s: pushed %02X as the low byte of PC", test.name, lo)
+    }
+  }
+}
+
+// VBlank is requested and enabled before EI. the handler at 0040
+// does LD B,A
+func eiTestGameBoy(t *testing.T, name string, code ...byte) *Cpu {
+  return newGameBoyWithCode(t, name, map[uint16][]byte{
+    0x0040: {0x47, 0x18, 0xFE},
+    0x0150: append([]byte{
+      0xF3,       // 0150 DI
+      0x3E, 0x01, // 0151 LD A,$01
+      0xE0, 0xFF, // 0153 LDH (IE),A
+      0xE0, 0x0F, // 0155 LDH (IF),A
+      0xAF,       // 0157 XOR A
+    }, code...),
+  })
+}
+
+func TestEIDelay(t *testing.T) {
+  gb := eiTestGameBoy(t, "eidelay",
+    0xFB,       // 0158 EI
+    0x3C,       // 0159 INC A, still runs
+    0x3C,       // 015A INC A
+    0x18, 0xFE, // 015B JR $FE
+  )
+  d := NewDebugger(gb)
+  d.Break(0x0159, -1, nil)
+  d.Continue()
+  start := gb.globalCounter
+  if stop := d.Step(1); gb.instructionAddress() != 0x0040 {
+    t.Fatalf("stepped to %04X (%s) instead of the handler", gb.instructionAddress(), stop)
+  }
+  // INC A, then the 5 cycles of dispatch
+  if n := gb.globalCounter - start; n != 1 + 5 {
+    t.Errorf("took %d cycles to get to the handler", n)
+  }
+  d.StepCycles(10)
+  if b := gb.B.read(); b != 1 {
+    t.Errorf("A was %d in the handler, want 1", b)
+  }
+}
+
+func TestDIStraightAfterEI(t *testing.T) {
+  gb := eiTestGameBoy(t, "eidi",
+    0xFB,       // 0158 EI
+    0xF3,       // 0159 DI
+    0x3C,       // 015A INC A
+    0x18, 0xFE, // 015B JR $FE
+  )
+  b := gb.B.read()
+  if _, err := gb.RunUntil(RunLimits{Frames: 1}); err != nil {
+    t.Fatal(err)
+  }
+  if gb.IME || gb.B.read() != b || gb.A.read() != 1 {
+    t.Errorf("interrupt dispatched after EI; DI: IME %t, A %02X, B %02X", gb.IME, gb.A.read(), gb.B.read())
+  }
+}
+
+func TestEIBeforeHaltBug(t *testing.T) {
+  // EI; HALT with an interrupt already pending: the handler returns to
+  // the HALT, which then waits for the next one
+  gb := newGameBoyWithCode(t, "eihalt", map[uint16][]byte{
+    0x0040: {0x04, 0xD9}, // INC B; RETI
+    0x0150: {
+      0xF3,       // 0150 DI
+      0xAF,       // 0151 XOR A
+      0xE0, 0x40, // 0152 LDH (LCDC),A, so there's no next VBlank
+      0x3C,       // 0154 INC A
+      0xE0, 0xFF, // 0155 LDH (IE),A
+      0xE0, 0x0F, // 0157 LDH (IF),A
+      0xFB,       // 0159 EI
+      0x76,       // 015A HALT
+      0x0E, 0x77, // 015B LD C,$77
+      0x18, 0xFE, // 015D JR $FE
+    },
+  })
+  b := gb.B.read()
+  if _, err := gb.RunUntil(RunLimits{Frames: 1}); err != nil {
+    t.Fatal(err)
+  }
+  if gb.B.read() != b + 1 {
+    t.Errorf("handler ran %d times", gb.B.read() - b)
+  }
+  if lo := gb.Bus.ReadFromBus(gb.SP.read() - 2); lo != 0x5A {
+    t.Errorf("returned to %02X%02X", gb.Bus.ReadFromBus(gb.SP.read() - 1), lo)
+  }
+  if !gb.isHalted || gb.C.read() == 0x77 {
+    t.Errorf("went past the HALT, halted %t", gb.isHalted)
+  }
+}
@@ -84,6 +84,30 @@ func (j *Joypad) doCycle() {
   }
 }
 
+// buttons in the order they're saved in save states
+var joypadKeys = []string{"up", "down", "left", "right", "a", "b", "start", "select"}
+
+func (j *Joypad) saveState(w *stateWriter) {
+  j.mu.RLock()
+  defer j.mu.RUnlock()
+  w.u8(j.value)
+  for _, key := range joypadKeys {
+    w.bool(j.keystate[key])
+  }
+}
+
+// key events that haven't been picked up by doCycle yet are dropped,
+// the frontend sends the next ones against the restored state
+func (j *Joypad) loadState(r *stateReader) {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+  j.value = r.u8()
+  for _, key := range joypadKeys {
+    j.keystate[key] = r.bool()
+    j.keyboard[key] = KeyPress{false, false}
+  }
+}
+
 func NewJoypad() *Joypad {
   keyboard := make(map[string]KeyPress)
   keyboard["up"] = KeyPress{false, false}
@@ -107,3 +131,14 @@ func NewJoypad() *Joypad {
 
   return &Joypad{value: 0xCF, keyboard: keyboard, keystate: keystate, mu: sync.RWMutex{}}
 }
+
+// SetKey passes on a frontend key event. name is one of up, down,
+// left, right, a, b, start or select
+func (cpu *Cpu) SetKey(name string, justPressed bool, justReleased bool) {
+  j := cpu.Bus.joypad
+  j.mu.Lock()
+  if _, ok := j.keyboard[name]; ok {
+    j.keyboard[name] = KeyPress{isJustReleased: justReleased, isJustPressed: justPressed}
+  }
+  j.mu.Unlock()
+}
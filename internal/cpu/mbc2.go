@@ -0,0 +1,108 @@
+package cpu
+
+// https://gbdev.io/pandocs/MBC2.html
+
+const MBC2_RAM_SIZE = 512
+
+type MBC2 struct {
+  rawCartridgeData []Register8
+
+  romBank uint8
+  isRAMEnabled bool
+
+  // 512 x 4 bits, built into the MBC
+  ram [MBC2_RAM_SIZE]Register8
+
+  battery bool
+}
+
+func NewMBC2(cartridgeData []Register8, battery bool) *MBC2 {
+  return &MBC2{
+    rawCartridgeData: cartridgeData,
+    romBank: 1,
+    battery: battery,
+  }
+}
+
+func (c *MBC2) romBankCount() uint32 {
+  return max(uint32(len(c.rawCartridgeData)) / 0x4000, 1)
+}
+
+func (c *MBC2) currentROMBank(address uint16) uint16 {
+  if address <= 0x3FFF {
+    return 0
+  }
+  return uint16(uint32(c.romBank) % c.romBankCount())
+}
+
+func (c *MBC2) read(address uint16) uint8 {
+  switch {
+  case address <= 0x3FFF:
+    return c.rawCartridgeData[address].read()
+  case address >= 0x4000 && address <= 0x7FFF:
+    bank := uint32(c.currentROMBank(address))
+    return c.rawCartridgeData[bank * 0x4000 + uint32(address - 0x4000)].read()
+  case address >= 0xA000 && address <= 0xBFFF:
+    if !c.isRAMEnabled {
+      return 0xFF
+    }
+    // only the bottom 9 address bits are wired up, so the 512
+    // nibbles echo through the whole region. upper nibble is open bus
+    return c.ram[address & 0x1FF].read() | 0xF0
+  default:
+    panic("MBC2 unknown read operation")
+  }
+}
+
+func (c *MBC2) write(address uint16, value uint8) {
+  switch {
+  case address <= 0x3FFF:
+    // bit 8 of the address picks the register
+    if GetBitBool(uint8(address >> 8), 0) {
+      c.romBank = value & 0x0F
+      if c.romBank == 0 {
+        c.romBank = 1
+      }
+    } else {
+      c.isRAMEnabled = (value & 0x0F) == 0x0A
+    }
+  case address >= 0x4000 && address <= 0x7FFF:
+    return
+  case address >= 0xA000 && address <= 0xBFFF:
+    if c.isRAMEnabled {
+      c.ram[address & 0x1FF].write(value & 0x0F)
+    }
+  default:
+    panic("unexpected MBC2 write operation")
+  }
+}
+
+func (c *MBC2) doCycle() {}
+
+func (c *MBC2) hasBattery() bool {
+  return c.battery
+}
+
+// one byte per nibble, the way other emulators store MBC2 saves
+func (c *MBC2) sram() []byte {
+  return registersToBytes(c.ram[:])
+}
+
+func (c *MBC2) loadSRAM(data []byte) {
+  bytesToRegisters(data, c.ram[:])
+  for i := range c.ram {
+    c.ram[i].write(c.ram[i].read() & 0x0F)
+  }
+}
+
+func (c *MBC2) saveState(w *stateWriter) {
+  w.u8(c.romBank)
+  w.bool(c.isRAMEnabled)
+  w.registers(c.ram[:])
+}
+
+func (c *MBC2) loadState(r *stateReader) {
+  c.romBank = r.u8()
+  c.isRAMEnabled = r.bool()
+  r.registers(c.ram[:])
+}
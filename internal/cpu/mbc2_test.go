@@ -0,0 +1,96 @@
+package cpu
+
+import (
+  "testing"
+)
+
+// 16 banks, each starting with its own number
+func newTestMBC2() *MBC2 {
+  data := make([]Register8, 16 * 0x4000)
+  for bank := 0; bank < 16; bank++ {
+    data[bank * 0x4000].write(uint8(bank))
+  }
+  return NewMBC2(data, true)
+}
+
+func TestMBC2Registers(t *testing.T) {
+  tests := []struct {
+    name string
+    writes [][2]uint16
+    bank uint8
+    ramEnabled bool
+  }{
+    {"starts on bank 1", nil, 1, false},
+    {"A8 set selects a bank", [][2]uint16{{0x2100, 0x03}}, 3, false},
+    {"A8 clear enables RAM", [][2]uint16{{0x0000, 0x0A}}, 1, true},
+    {"anything else disables it", [][2]uint16{{0x0000, 0x0A}, {0x00FF, 0x0B}}, 1, false},
+    {"only the low nibble enables", [][2]uint16{{0x1E00, 0xFA}}, 1, true},
+    // the rest of the address doesn't matter
+    {"0A with A8 set is a bank", [][2]uint16{{0x3F00, 0x0A}}, 10, false},
+    {"a bank with A8 clear enables nothing", [][2]uint16{{0x2000, 0x03}}, 1, false},
+    {"bank 0 is bank 1", [][2]uint16{{0x2100, 0x05}, {0x2100, 0x00}}, 1, false},
+    {"4 bit bank number", [][2]uint16{{0x0100, 0xF7}}, 7, false},
+    {"nothing at 4000-7FFF", [][2]uint16{{0x4100, 0x03}, {0x4000, 0x0A}}, 1, false},
+  }
+  for _, test := range tests {
+    c := newTestMBC2()
+    for _, w := range test.writes {
+      c.write(w[0], uint8(w[1]))
+    }
+    if got := c.read(0x4000); got != test.bank {
+      t.Errorf("%s: bank %d, want %d", test.name, got, test.bank)
+    }
+    if c.read(0x0000) != 0 {
+      t.Errorf("%s: bank 0 isn't at 0000", test.name)
+    }
+    if c.isRAMEnabled != test.ramEnabled {
+      t.Errorf("%s: RAM enabled %t", test.name, c.isRAMEnabled)
+    }
+  }
+}
+
+func TestMBC2RAM(t *testing.T) {
+  c := newTestMBC2()
+  c.write(0xA000, 0x05)
+  if got := c.read(0xA000); got != 0xFF {
+    t.Errorf("read %02X with RAM disabled", got)
+  }
+  c.write(0x0000, 0x0A)
+  if got := c.read(0xA000); got != 0xF0 {
+    t.Errorf("write with RAM disabled went through, read %02X", got)
+  }
+
+  // 4 bits a byte, with the top half reading as 1s
+  c.write(0xA001, 0xAB)
+  if got := c.read(0xA001); got != 0xFB {
+    t.Errorf("read %02X, want FB", got)
+  }
+
+  // only A0-A8 are wired up, so the 512 nibbles repeat through A000-BFFF
+  c.write(0xA1FF, 0x07)
+  for _, address := range []uint16{0xA1FF, 0xA3FF, 0xB5FF, 0xBFFF} {
+    if got := c.read(address); got != 0xF7 {
+      t.Errorf("read %02X at %04X, want F7", got, address)
+    }
+  }
+  c.write(0xBE01, 0x0C)
+  if got := c.read(0xA001); got != 0xFC {
+    t.Errorf("write to BE01 read back %02X at A001, want FC", got)
+  }
+
+  // .sav files store a nibble a byte
+  data := c.sram()
+  if len(data) != MBC2_RAM_SIZE || data[0x001] != 0x0C || data[0x1FF] != 0x07 {
+    t.Errorf("save is %d bytes, with %02X at 001 and %02X at 1FF", len(data), data[0x001], data[0x1FF])
+  }
+  loaded := newTestMBC2()
+  data[0x002] = 0xF3
+  loaded.loadSRAM(data)
+  loaded.write(0x0000, 0x0A)
+  if a, b := loaded.read(0xA001), loaded.read(0xA002); a != 0xFC || b != 0xF3 {
+    t.Errorf("loaded %02X and %02X, want FC and F3", a, b)
+  }
+  if got := loaded.ram[0x002].read(); got != 0x03 {
+    t.Errorf("kept the top nibble from the file, %02X", got)
+  }
+}
@@ -0,0 +1,365 @@
+package cpu
+
+import (
+  "encoding/binary"
+  "time"
+)
+
+// https://gbdev.io/pandocs/MBC3.html
+
+const (
+  RTC_S = 0x08
+  RTC_M = 0x09
+  RTC_H = 0x0A
+  RTC_DL = 0x0B
+  RTC_DH = 0x0C
+)
+
+// RealTimeClock is the MBC3's clock. It's advanced by emulated
+// M-cycles rather than the wall clock, so it stays in step with
+// the game when running fast or paused.
+type RealTimeClock struct {
+  seconds uint8
+  minutes uint8
+  hours uint8
+  days uint16
+  halted bool
+  dayCarry bool
+
+  subSecondCycles uint64
+
+  // latched copies, which are what the game reads
+  latched [5]uint8
+  latchWritten0 bool
+}
+
+func (rtc *RealTimeClock) tick() {
+  // counters wrap at their bit width without carrying if
+  // the game wrote an out-of-range value
+  rtc.seconds = (rtc.seconds + 1) & 0x3F
+  if rtc.seconds != 60 {
+    return
+  }
+  rtc.seconds = 0
+
+  rtc.minutes = (rtc.minutes + 1) & 0x3F
+  if rtc.minutes != 60 {
+    return
+  }
+  rtc.minutes = 0
+
+  rtc.hours = (rtc.hours + 1) & 0x1F
+  if rtc.hours != 24 {
+    return
+  }
+  rtc.hours = 0
+
+  rtc.days += 1
+  if rtc.days > 0x1FF {
+    rtc.days = 0
+    rtc.dayCarry = true
+  }
+}
+
+func (rtc *RealTimeClock) doCycle() {
+  if rtc.halted {
+    return
+  }
+  rtc.subSecondCycles += 1
+  if rtc.subSecondCycles >= ClockSpeed {
+    rtc.subSecondCycles = 0
+    rtc.tick()
+  }
+}
+
+func (rtc *RealTimeClock) dh() uint8 {
+  var result uint8 = uint8(rtc.days >> 8) & 0x01
+  result = SetBitBool(result, 6, rtc.halted)
+  result = SetBitBool(result, 7, rtc.dayCarry)
+  return result
+}
+
+// live register values in RTC_S..RTC_DH order
+func (rtc *RealTimeClock) registers() [5]uint8 {
+  return [5]uint8{rtc.seconds, rtc.minutes, rtc.hours, uint8(rtc.days & 0xFF), rtc.dh()}
+}
+
+// writing 0x00 then 0x01 copies the live counters into the latch
+func (rtc *RealTimeClock) writeLatch(value uint8) {
+  if rtc.latchWritten0 && value == 0x01 {
+    rtc.latched = rtc.registers()
+  }
+  rtc.latchWritten0 = value == 0x00
+}
+
+func (rtc *RealTimeClock) read(register uint8) uint8 {
+  return rtc.latched[register - RTC_S]
+}
+
+func (rtc *RealTimeClock) write(register uint8, value uint8) {
+  switch register {
+  case RTC_S:
+    rtc.seconds = value & 0x3F
+    // writing seconds resets the sub-second divider
+    rtc.subSecondCycles = 0
+  case RTC_M:
+    rtc.minutes = value & 0x3F
+  case RTC_H:
+    rtc.hours = value & 0x1F
+  case RTC_DL:
+    rtc.days = (rtc.days & 0x100) | uint16(value)
+  case RTC_DH:
+    rtc.days = (rtc.days & 0xFF) | (uint16(value & 0x01) << 8)
+    rtc.halted = GetBitBool(value, 6)
+    rtc.dayCarry = GetBitBool(value, 7)
+  }
+  // writes show up in the latched registers straight away
+  rtc.latched[register - RTC_S] = rtc.registers()[register - RTC_S]
+}
+
+// RTC state is appended to .sav files the way BGB and VBA-M do it:
+// live S/M/H/DL/DH then latched S/M/H/DL/DH as little endian uint32s,
+// then a little endian unix timestamp, 64-bit (or 32-bit in older files)
+const (
+  RTC_FOOTER_SIZE = 48
+  RTC_FOOTER_SIZE_32BIT = 44
+  RTC_FOOTER_TIMESTAMP = 40
+)
+
+func (rtc *RealTimeClock) footer(now time.Time) []byte {
+  data := make([]byte, RTC_FOOTER_SIZE)
+  for i, value := range rtc.registers() {
+    binary.LittleEndian.PutUint32(data[4*i:], uint32(value))
+  }
+  for i, value := range rtc.latched {
+    binary.LittleEndian.PutUint32(data[20+4*i:], uint32(value))
+  }
+  binary.LittleEndian.PutUint64(data[RTC_FOOTER_TIMESTAMP:], uint64(now.Unix()))
+  return data
+}
+
+func (rtc *RealTimeClock) loadFooter(data []byte, now time.Time) {
+  var registers [5]uint8
+  for i := range registers {
+    registers[i] = uint8(binary.LittleEndian.Uint32(data[4*i:]))
+  }
+  for i := range rtc.latched {
+    rtc.latched[i] = uint8(binary.LittleEndian.Uint32(data[20+4*i:]))
+  }
+  rtc.seconds = registers[0] & 0x3F
+  rtc.minutes = registers[1] & 0x3F
+  rtc.hours = registers[2] & 0x1F
+  rtc.days = uint16(registers[3]) | (uint16(registers[4] & 0x01) << 8)
+  rtc.halted = GetBitBool(registers[4], 6)
+  rtc.dayCarry = GetBitBool(registers[4], 7)
+
+  var saved int64
+  if len(data) >= RTC_FOOTER_SIZE {
+    saved = int64(binary.LittleEndian.Uint64(data[RTC_FOOTER_TIMESTAMP:]))
+  } else {
+    saved = int64(binary.LittleEndian.Uint32(data[RTC_FOOTER_TIMESTAMP:]))
+  }
+
+  // the real clock keeps running on the battery while the
+  // game is off, so catch up on the time since the save
+  elapsed := now.Unix() - saved
+  if rtc.halted || elapsed <= 0 {
+    return
+  }
+  total := uint64(elapsed) + uint64(rtc.seconds) + 60 * uint64(rtc.minutes) + 3600 * uint64(rtc.hours) + 86400 * uint64(rtc.days)
+  rtc.seconds = uint8(total % 60)
+  rtc.minutes = uint8((total / 60) % 60)
+  rtc.hours = uint8((total / 3600) % 24)
+  days := total / 86400
+  if days > 0x1FF {
+    rtc.dayCarry = true
+  }
+  rtc.days = uint16(days % 0x200)
+}
+
+type MBC3 struct {
+  rawCartridgeData []Register8
+  romSize uint32
+  ramSize uint32
+
+  romBank uint8
+  // 0x00-0x03 selects a RAM bank, 0x08-0x0C an RTC register
+  ramBankOrRTC uint8
+  isRAMEnabled bool
+
+  ram []Register8
+
+  hasRTC bool
+  rtc RealTimeClock
+
+  battery bool
+}
+
+func NewMBC3(cartridgeData []Register8, romSize uint32, ramSize uint32, hasRTC bool, battery bool) *MBC3 {
+  return &MBC3{
+    rawCartridgeData: cartridgeData,
+    romSize: romSize,
+    ramSize: ramSize,
+    romBank: 1,
+    ram: make([]Register8, ramSize),
+    hasRTC: hasRTC,
+    battery: battery,
+  }
+}
+
+// go by the actual data rather than the header, so a bad
+// header can't send us out of bounds
+func (c *MBC3) romBankCount() uint32 {
+  return max(uint32(len(c.rawCartridgeData)) / 0x4000, 1)
+}
+
+func (c *MBC3) ramAddress(address uint16) (uint32, bool) {
+  if c.ramSize == 0 || c.ramBankOrRTC > 0x03 {
+    return 0, false
+  }
+  nBanks := max(c.ramSize / 0x2000, 1)
+  bank := uint32(c.ramBankOrRTC) % nBanks
+  return (bank * 0x2000 + uint32(address - 0xA000)) % c.ramSize, true
+}
+
+func (c *MBC3) currentROMBank(address uint16) uint16 {
+  if address <= 0x3FFF {
+    return 0
+  }
+  return uint16(uint32(c.romBank) % c.romBankCount())
+}
+
+func (c *MBC3) read(address uint16) uint8 {
+  switch {
+  case address <= 0x3FFF:
+    return c.rawCartridgeData[address].read()
+  case address >= 0x4000 && address <= 0x7FFF:
+    bank := uint32(c.currentROMBank(address))
+    return c.rawCartridgeData[bank * 0x4000 + uint32(address - 0x4000)].read()
+  case address >= 0xA000 && address <= 0xBFFF:
+    if !c.isRAMEnabled {
+      return 0xFF
+    }
+    if c.hasRTC && c.ramBankOrRTC >= RTC_S && c.ramBankOrRTC <= RTC_DH {
+      return c.rtc.read(c.ramBankOrRTC)
+    }
+    if idx, ok := c.ramAddress(address); ok {
+      return c.ram[idx].read()
+    }
+    return 0xFF
+  default:
+    panic("MBC3 unknown read operation")
+  }
+}
+
+func (c *MBC3) write(address uint16, value uint8) {
+  switch {
+  case address <= 0x1FFF:
+    // enables both RAM and the RTC registers
+    c.isRAMEnabled = (value & 0x0F) == 0x0A
+  case address >= 0x2000 && address <= 0x3FFF:
+    c.romBank = value & 0x7F
+    if c.romBank == 0 {
+      c.romBank = 1
+    }
+  case address >= 0x4000 && address <= 0x5FFF:
+    c.ramBankOrRTC = value
+  case address >= 0x6000 && address <= 0x7FFF:
+    if c.hasRTC {
+      c.rtc.writeLatch(value)
+    }
+  case address >= 0xA000 && address <= 0xBFFF:
+    if !c.isRAMEnabled {
+      return
+    }
+    if c.hasRTC && c.ramBankOrRTC >= RTC_S && c.ramBankOrRTC <= RTC_DH {
+      c.rtc.write(c.ramBankOrRTC, value)
+      return
+    }
+    if idx, ok := c.ramAddress(address); ok {
+      c.ram[idx].write(value)
+    }
+  default:
+    panic("unexpected MBC3 write operation")
+  }
+}
+
+func (c *MBC3) doCycle() {
+  if c.hasRTC {
+    c.rtc.doCycle()
+  }
+}
+
+func (c *MBC3) hasBattery() bool {
+  return c.battery
+}
+
+func (c *MBC3) sram() []byte {
+  return registersToBytes(c.ram)
+}
+
+func (c *MBC3) saveFileFooter() []byte {
+  if !c.hasRTC {
+    return nil
+  }
+  return c.rtc.footer(time.Now())
+}
+
+// the clock registers, but not the timestamp, which is new every save
+func (c *MBC3) footerStateSize() int {
+  return RTC_FOOTER_TIMESTAMP
+}
+
+func (c *MBC3) loadSRAM(data []byte) {
+  bytesToRegisters(data, c.ram)
+  footer := data[min(len(data), len(c.ram)):]
+  if c.hasRTC && (len(footer) == RTC_FOOTER_SIZE || len(footer) == RTC_FOOTER_SIZE_32BIT) {
+    c.rtc.loadFooter(footer, time.Now())
+  }
+}
+
+// unlike the .sav footer, the clock doesn't catch up with the wall
+// clock on load, a save state puts it back exactly where it was
+func (rtc *RealTimeClock) saveState(w *stateWriter) {
+  w.u8(rtc.seconds)
+  w.u8(rtc.minutes)
+  w.u8(rtc.hours)
+  w.u16(rtc.days)
+  w.bool(rtc.halted)
+  w.bool(rtc.dayCarry)
+  w.u64(rtc.subSecondCycles)
+  for _, value := range rtc.latched {
+    w.u8(value)
+  }
+  w.bool(rtc.latchWritten0)
+}
+
+func (rtc *RealTimeClock) loadState(r *stateReader) {
+  rtc.seconds = r.u8()
+  rtc.minutes = r.u8()
+  rtc.hours = r.u8()
+  rtc.days = r.u16()
+  rtc.halted = r.bool()
+  rtc.dayCarry = r.bool()
+  rtc.subSecondCycles = r.u64()
+  for i := range rtc.latched {
+    rtc.latched[i] = r.u8()
+  }
+  rtc.latchWritten0 = r.bool()
+}
+
+func (c *MBC3) saveState(w *stateWriter) {
+  w.u8(c.romBank)
+  w.u8(c.ramBankOrRTC)
+  w.bool(c.isRAMEnabled)
+  w.registers(c.ram)
+  c.rtc.saveState(w)
+}
+
+func (c *MBC3) loadState(r *stateReader) {
+  c.romBank = r.u8()
+  c.ramBankOrRTC = r.u8()
+  c.isRAMEnabled = r.bool()
+  r.registers(c.ram)
+  c.rtc.loadState(r)
+}
@@ -0,0 +1,138 @@
+package cpu
+
+import (
+  "encoding/binary"
+  "testing"
+  "time"
+)
+
+func TestRTCTick(t *testing.T) {
+  tests := []struct {
+    name string
+    before RealTimeClock
+    want RealTimeClock
+  }{
+    {"second", RealTimeClock{seconds: 5}, RealTimeClock{seconds: 6}},
+    {"minute", RealTimeClock{seconds: 59, minutes: 1}, RealTimeClock{minutes: 2}},
+    {"hour", RealTimeClock{seconds: 59, minutes: 59, hours: 3}, RealTimeClock{hours: 4}},
+    {"day", RealTimeClock{seconds: 59, minutes: 59, hours: 23, days: 0xFF}, RealTimeClock{days: 0x100}},
+    {"day carry", RealTimeClock{seconds: 59, minutes: 59, hours: 23, days: 0x1FF}, RealTimeClock{days: 0, dayCarry: true}},
+    {"carry stays set", RealTimeClock{seconds: 1, dayCarry: true}, RealTimeClock{seconds: 2, dayCarry: true}},
+    // out of range values wrap at their bit width without carrying
+    {"seconds out of range", RealTimeClock{seconds: 63, minutes: 4}, RealTimeClock{seconds: 0, minutes: 4}},
+    {"hours out of range", RealTimeClock{seconds: 59, minutes: 59, hours: 31, days: 7}, RealTimeClock{hours: 0, days: 7}},
+  }
+  for _, test := range tests {
+    rtc := test.before
+    rtc.tick()
+    if rtc.registers() != test.want.registers() {
+      t.Errorf("%s: registers % X, want % X", test.name, rtc.registers(), test.want.registers())
+    }
+  }
+}
+
+func TestRTCHalt(t *testing.T) {
+  for _, halted := range []bool{false, true} {
+    rtc := RealTimeClock{}
+    // DH bit 6
+    rtc.write(RTC_DH, SetBitBool(0, 6, halted))
+    for i := uint64(0); i < ClockSpeed; i++ {
+      rtc.doCycle()
+    }
+    want := uint8(1)
+    if halted {
+      want = 0
+    }
+    if rtc.seconds != want {
+      t.Errorf("halted %t: %d seconds after a second", halted, rtc.seconds)
+    }
+  }
+}
+
+func TestRTCLatch(t *testing.T) {
+  tests := []struct {
+    name string
+    writes []uint8
+    latched bool
+  }{
+    {"00 01", []uint8{0x00, 0x01}, true},
+    {"00 00 01", []uint8{0x00, 0x00, 0x01}, true},
+    {"01", []uint8{0x01}, false},
+    {"00 02 01", []uint8{0x00, 0x02, 0x01}, false},
+    {"00 01 01", []uint8{0x00, 0x01, 0x01}, true},
+  }
+  for _, test := range tests {
+    rtc := RealTimeClock{}
+    rtc.write(RTC_M, 10)
+    rtc.tick()
+    for _, value := range test.writes {
+      rtc.writeLatch(value)
+    }
+    // the tick only shows up once latched, the write straight away
+    want := [5]uint8{0, 10, 0, 0, 0}
+    if test.latched {
+      want[0] = 1
+    }
+    if rtc.latched != want {
+      t.Errorf("%s: latched % X, want % X", test.name, rtc.latched, want)
+    }
+    if got := rtc.read(RTC_S); got != want[0] {
+      t.Errorf("%s: read seconds %d", test.name, got)
+    }
+  }
+}
+
+func TestRTCWriteResetsDivider(t *testing.T) {
+  rtc := RealTimeClock{}
+  for i := uint64(0); i < ClockSpeed - 1; i++ {
+    rtc.doCycle()
+  }
+  rtc.write(RTC_S, 0)
+  rtc.doCycle()
+  if rtc.seconds != 0 {
+    t.Error("ticked straight after writing the seconds")
+  }
+}
+
+func TestRTCFooter(t *testing.T) {
+  saved := time.Unix(1700000000, 0)
+  tests := []struct {
+    name string
+    clock RealTimeClock
+    elapsed time.Duration
+    // drop the top half of the timestamp, like older files
+    short bool
+    want [5]uint8
+  }{
+    {"no time passed", RealTimeClock{seconds: 1, minutes: 2, hours: 3, days: 0x104}, 0, false, [5]uint8{1, 2, 3, 0x04, 0x01}},
+    {"catches up", RealTimeClock{seconds: 50, minutes: 59, hours: 23, days: 1}, 15 * time.Second, false, [5]uint8{5, 0, 0, 2, 0}},
+    {"catches up a day", RealTimeClock{hours: 1}, 24 * time.Hour + time.Minute, false, [5]uint8{0, 1, 1, 1, 0}},
+    {"carries past 511 days", RealTimeClock{days: 0x1FF}, 24 * time.Hour, false, [5]uint8{0, 0, 0, 0, 0x80}},
+    {"halted doesn't catch up", RealTimeClock{seconds: 9, halted: true}, time.Hour, false, [5]uint8{9, 0, 0, 0, 0x40}},
+    {"saved in the future", RealTimeClock{seconds: 9}, -time.Hour, false, [5]uint8{9, 0, 0, 0, 0}},
+    {"32 bit timestamp", RealTimeClock{minutes: 1}, time.Minute, true, [5]uint8{0, 2, 0, 0, 0}},
+  }
+  for _, test := range tests {
+    clock := test.clock
+    clock.latched = [5]uint8{1, 2, 3, 4, 5}
+    footer := clock.footer(saved)
+    if len(footer) != RTC_FOOTER_SIZE {
+      t.Fatalf("footer is %d bytes", len(footer))
+    }
+    if got := binary.LittleEndian.Uint64(footer[40:]); got != uint64(saved.Unix()) {
+      t.Errorf("%s: timestamp %d", test.name, got)
+    }
+    if test.short {
+      footer = footer[:RTC_FOOTER_SIZE_32BIT]
+    }
+
+    loaded := RealTimeClock{}
+    loaded.loadFooter(footer, saved.Add(test.elapsed))
+    if got := loaded.registers(); got != test.want {
+      t.Errorf("%s: registers % X, want % X", test.name, got, test.want)
+    }
+    if loaded.latched != clock.latched {
+      t.Errorf("%s: latched % X, want % X", test.name, loaded.latched, clock.latched)
+    }
+  }
+}
@@ -0,0 +1,163 @@
+package cpu
+
+// https://gbdev.io/pandocs/MBC5.html
+
+type MBC5 struct {
+  rawCartridgeData []Register8
+  romSize uint32
+  ramSize uint32
+
+  // 9 bits, and unlike MBC1/MBC3 bank 0 can be mapped at 0x4000
+  romBank uint16
+  ramBank uint8
+  isRAMEnabled bool
+
+  ram []Register8
+
+  // on rumble carts bit 3 of the RAM bank register drives the motor
+  hasRumble bool
+  rumbling bool
+  onRumble func(bool)
+
+  battery bool
+}
+
+func NewMBC5(cartridgeData []Register8, romSize uint32, ramSize uint32, hasRumble bool, battery bool) *MBC5 {
+  return &MBC5{
+    rawCartridgeData: cartridgeData,
+    romSize: romSize,
+    ramSize: ramSize,
+    romBank: 1,
+    ram: make([]Register8, ramSize),
+    hasRumble: hasRumble,
+    battery: battery,
+  }
+}
+
+func (c *MBC5) romBankCount() uint32 {
+  return max(uint32(len(c.rawCartridgeData)) / 0x4000, 1)
+}
+
+func (c *MBC5) ramAddress(address uint16) (uint32, bool) {
+  if c.ramSize == 0 {
+    return 0, false
+  }
+  nBanks := max(c.ramSize / 0x2000, 1)
+  bank := uint32(c.ramBank) % nBanks
+  return (bank * 0x2000 + uint32(address - 0xA000)) % c.ramSize, true
+}
+
+func (c *MBC5) currentROMBank(address uint16) uint16 {
+  if address <= 0x3FFF {
+    return 0
+  }
+  return uint16(uint32(c.romBank) % c.romBankCount())
+}
+
+func (c *MBC5) read(address uint16) uint8 {
+  switch {
+  case address <= 0x3FFF:
+    return c.rawCartridgeData[address].read()
+  case address >= 0x4000 && address <= 0x7FFF:
+    bank := uint32(c.currentROMBank(address))
+    return c.rawCartridgeData[bank * 0x4000 + uint32(address - 0x4000)].read()
+  case address >= 0xA000 && address <= 0xBFFF:
+    if !c.isRAMEnabled {
+      return 0xFF
+    }
+    if idx, ok := c.ramAddress(address); ok {
+      return c.ram[idx].read()
+    }
+    return 0xFF
+  default:
+    panic("MBC5 unknown read operation")
+  }
+}
+
+func (c *MBC5) write(address uint16, value uint8) {
+  switch {
+  case address <= 0x1FFF:
+    // MBC5 checks all 8 bits, not just the low nibble
+    c.isRAMEnabled = value == 0x0A
+  case address >= 0x2000 && address <= 0x2FFF:
+    c.romBank = (c.romBank & 0x100) | uint16(value)
+  case address >= 0x3000 && address <= 0x3FFF:
+    c.romBank = (c.romBank & 0xFF) | (uint16(value & 0x01) << 8)
+  case address >= 0x4000 && address <= 0x5FFF:
+    if c.hasRumble {
+      c.ramBank = value & 0x07
+      c.setRumble(GetBitBool(value, 3))
+    } else {
+      c.ramBank = value & 0x0F
+    }
+  case address >= 0x6000 && address <= 0x7FFF:
+    // nothing mapped here on MBC5
+    return
+  case address >= 0xA000 && address <= 0xBFFF:
+    if !c.isRAMEnabled {
+      return
+    }
+    if idx, ok := c.ramAddress(address); ok {
+      c.ram[idx].write(value)
+    }
+  default:
+    panic("unexpected MBC5 write operation")
+  }
+}
+
+func (c *MBC5) setRumble(on bool) {
+  if on == c.rumbling {
+    return
+  }
+  c.rumbling = on
+  if c.onRumble != nil {
+    c.onRumble(on)
+  }
+}
+
+func (c *MBC5) doCycle() {}
+
+func (c *MBC5) hasBattery() bool {
+  return c.battery
+}
+
+func (c *MBC5) sram() []byte {
+  return registersToBytes(c.ram)
+}
+
+func (c *MBC5) loadSRAM(data []byte) {
+  bytesToRegisters(data, c.ram)
+}
+
+func (c *MBC5) saveState(w *stateWriter) {
+  w.u16(c.romBank)
+  w.u8(c.ramBank)
+  w.bool(c.isRAMEnabled)
+  w.bool(c.rumbling)
+  w.registers(c.ram)
+}
+
+func (c *MBC5) loadState(r *stateReader) {
+  c.romBank = r.u16()
+  c.ramBank = r.u8()
+  c.isRAMEnabled = r.bool()
+  // through setRumble so the frontend hears about it
+  rumbling := r.bool()
+  r.registers(c.ram)
+  if r.err == nil {
+    c.setRumble(rumbling)
+  }
+}
+
+// OnRumble registers f to be called whenever a rumble cartridge
+// turns its motor on or off. f runs on the emulation goroutine so
+// it should return quickly. Returns false if the cartridge can't
+// rumble.
+func (cpu *Cpu) OnRumble(f func(on bool)) bool {
+  mbc5, ok := cpu.Bus.cartridge.(*MBC5)
+  if !ok || !mbc5.hasRumble {
+    return false
+  }
+  mbc5.onRumble = f
+  return true
+}
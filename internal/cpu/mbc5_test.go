@@ -0,0 +1,153 @@
+package cpu
+
+import (
+  "testing"
+)
+
+// 8MB, 512 banks, each starting with its number low byte first, and
+// 128KB of RAM
+func newTestMBC5(hasRumble bool) *MBC5 {
+  data := make([]Register8, 512 * 0x4000)
+  for bank := 0; bank < 512; bank++ {
+    data[bank * 0x4000].write(uint8(bank))
+    data[bank * 0x4000 + 1].write(uint8(bank >> 8))
+  }
+  return NewMBC5(data, uint32(len(data)), 128*1024, hasRumble, true)
+}
+
+func mbc5Bank(c *MBC5) uint16 {
+  return uint16(c.read(0x4000)) | uint16(c.read(0x4001)) << 8
+}
+
+func TestMBC5ROMBank(t *testing.T) {
+  tests := []struct {
+    name string
+    writes [][2]uint16
+    bank uint16
+  }{
+    {"starts on bank 1", nil, 1},
+    {"low 8 bits", [][2]uint16{{0x2000, 0x42}}, 0x42},
+    {"anywhere in 2000-2FFF", [][2]uint16{{0x2FFF, 0xFF}}, 0xFF},
+    {"bit 8", [][2]uint16{{0x2000, 0x23}, {0x3000, 0x01}}, 0x123},
+    {"bit 8 first", [][2]uint16{{0x3FFF, 0x01}, {0x2000, 0x80}}, 0x180},
+    {"only bit 0 of the high register", [][2]uint16{{0x2000, 0x05}, {0x3000, 0xFE}}, 0x005},
+    {"clearing bit 8 keeps the low bits", [][2]uint16{{0x2000, 0x10}, {0x3000, 0x01}, {0x3000, 0x00}}, 0x010},
+    // unlike MBC1 and MBC3
+    {"bank 0", [][2]uint16{{0x2000, 0x00}}, 0},
+    {"bank 256", [][2]uint16{{0x2000, 0x00}, {0x3000, 0x01}}, 0x100},
+    {"nothing at 6000-7FFF", [][2]uint16{{0x6000, 0x01}, {0x7FFF, 0x05}}, 1},
+  }
+  for _, test := range tests {
+    c := newTestMBC5(false)
+    for _, w := range test.writes {
+      c.write(w[0], uint8(w[1]))
+    }
+    if got := mbc5Bank(c); got != test.bank {
+      t.Errorf("%s: bank %03X, want %03X", test.name, got, test.bank)
+    }
+    if c.read(0x0000) != 0 || c.read(0x0001) != 0 {
+      t.Errorf("%s: bank 0 isn't at 0000", test.name)
+    }
+  }
+}
+
+func TestMBC5RAM(t *testing.T) {
+  c := newTestMBC5(false)
+  c.write(0xA000, 0x55)
+  if got := c.read(0xA000); got != 0xFF {
+    t.Errorf("read %02X with RAM disabled", got)
+  }
+
+  // all 8 bits of the enable are checked
+  for _, value := range []uint8{0x1A, 0xFA, 0x0B} {
+    c.write(0x0000, value)
+    if c.isRAMEnabled {
+      t.Errorf("%02X enabled RAM", value)
+    }
+  }
+  c.write(0x1FFF, 0x0A)
+  if !c.isRAMEnabled {
+    t.Fatal("0A didn't enable RAM")
+  }
+
+  for bank := uint8(0); bank < 16; bank++ {
+    c.write(0x4000, bank)
+    c.write(0xA000, bank | 0x80)
+    c.write(0xBFFF, bank | 0x40)
+  }
+  for bank := uint8(0); bank < 16; bank++ {
+    c.write(0x5FFF, bank)
+    if a, b := c.read(0xA000), c.read(0xBFFF); a != bank | 0x80 || b != bank | 0x40 {
+      t.Errorf("bank %d: read %02X and %02X", bank, a, b)
+    }
+  }
+  if data := c.sram(); len(data) != 128*1024 || data[15 * 0x2000] != 0x8F {
+    t.Errorf("save is %d bytes", len(data))
+  }
+
+  // the top nibble of the register is ignored
+  c.write(0x4000, 0x13)
+  if got := c.read(0xA000); got != 0x83 {
+    t.Errorf("bank 13 read %02X, want bank 3's 83", got)
+  }
+
+  c.write(0x0000, 0x00)
+  c.write(0xA000, 0x00)
+  if got := c.read(0xA000); got != 0xFF {
+    t.Errorf("read %02X after disabling RAM", got)
+  }
+  c.write(0x0000, 0x0A)
+  if got := c.read(0xA000); got != 0x83 {
+    t.Errorf("write with RAM disabled went through, read %02X", got)
+  }
+}
+
+func TestMBC5Rumble(t *testing.T) {
+  tests := []struct {
+    name string
+    writes []uint8
+    bank uint8
+    calls []bool
+  }{
+    {"bank", []uint8{0x05}, 5, nil},
+    {"motor on", []uint8{0x08}, 0, []bool{true}},
+    {"motor on with a bank", []uint8{0x0B}, 3, []bool{true}},
+    {"only 3 bits of bank", []uint8{0x07, 0x0F}, 7, []bool{true}},
+    {"on and off", []uint8{0x08, 0x09, 0x01}, 1, []bool{true, false}},
+    {"only changes are reported", []uint8{0x08, 0x08, 0x0C}, 4, []bool{true}},
+    {"top nibble ignored", []uint8{0xF2}, 2, nil},
+  }
+  for _, test := range tests {
+    c := newTestMBC5(true)
+    var calls []bool
+    c.onRumble = func(on bool) {
+      calls = append(calls, on)
+    }
+    for _, value := range test.writes {
+      c.write(0x4000, value)
+    }
+    if c.ramBank != test.bank {
+      t.Errorf("%s: RAM bank %d, want %d", test.name, c.ramBank, test.bank)
+    }
+    if len(calls) != len(test.calls) {
+      t.Errorf("%s: OnRumble called with %v, want %v", test.name, calls, test.calls)
+      continue
+    }
+    for i := range calls {
+      if calls[i] != test.calls[i] {
+        t.Errorf("%s: OnRumble called with %v, want %v", test.name, calls, test.calls)
+        break
+      }
+    }
+  }
+
+  // a cart without rumble uses bit 3 for the bank
+  c := newTestMBC5(false)
+  c.onRumble = func(bool) {
+    t.Error("a cart without rumble rumbled")
+  }
+  c.write(0x4000, 0x0B)
+  if c.ramBank != 0x0B {
+    t.Errorf("RAM bank %d, want 11", c.ramBank)
+  }
+}
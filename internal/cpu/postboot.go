@@ -0,0 +1,162 @@
+package cpu
+
+import (
+  "fmt"
+  "strings"
+)
+
+// https://gbdev.io/pandocs/Power_Up_Sequence.html#cpu-registers
+// https://gbdev.io/pandocs/Power_Up_Sequence.html#hardware-registers
+
+type ioValue struct {
+  address uint16
+  value uint8
+}
+
+// what the boot ROM leaves behind when it jumps to 0x100
+type postBootState struct {
+  A, F, B, C, D, E, H, L uint8
+  // internal 16 bit counter, DIV is the top byte
+  divCounter uint16
+  nr52 uint8
+}
+
+var postBootStates = map[Model]postBootState{
+  DMG0: {A: 0x01, F: 0x00, B: 0xFF, C: 0x13, D: 0x00, E: 0xC1, H: 0x84, L: 0x03, divCounter: 0x1830, nr52: 0xF1},
+  DMG: {A: 0x01, F: 0xB0, B: 0x00, C: 0x13, D: 0x00, E: 0xD8, H: 0x01, L: 0x4D, divCounter: 0xABCC, nr52: 0xF1},
+  MGB: {A: 0xFF, F: 0xB0, B: 0x00, C: 0x13, D: 0x00, E: 0xD8, H: 0x01, L: 0x4D, divCounter: 0xABCC, nr52: 0xF1},
+  SGB: {A: 0x01, F: 0x00, B: 0x00, C: 0x14, D: 0x00, E: 0x00, H: 0xC0, L: 0x60, divCounter: 0xD85C, nr52: 0xF0},
+  SGB2: {A: 0xFF, F: 0x00, B: 0x00, C: 0x14, D: 0x00, E: 0x00, H: 0xC0, L: 0x60, divCounter: 0xD85C, nr52: 0xF0},
+  CGB: {A: 0x11, F: 0x80, B: 0x00, C: 0x00, D: 0xFF, E: 0x56, H: 0x00, L: 0x0D, divCounter: 0x267C, nr52: 0xF1},
+}
+
+// same on every model. order matters: the APU has to be
+// powered on (NR52 goes first) before the rest of it is written
+var postBootIO = []ioValue{
+  {P1, 0xCF},
+  {TIMA, 0x00},
+  {TMA, 0x00},
+  {TAC, 0xF8},
+  {IF, 0xE1},
+  {NR10, 0x80},
+  {NR11, 0xBF},
+  {NR12, 0xF3},
+  {NR13, 0xFF},
+  {NR14, 0xBF},
+  {NR21, 0x3F},
+  {NR22, 0x00},
+  {NR23, 0xFF},
+  {NR24, 0xBF},
+  {NR30, 0x7F},
+  {NR31, 0xFF},
+  {NR32, 0x9F},
+  {NR33, 0xFF},
+  {NR34, 0xBF},
+  {NR41, 0xFF},
+  {NR42, 0x00},
+  {NR43, 0x00},
+  {NR44, 0xBF},
+  {NR50, 0x77},
+  {NR51, 0xF3},
+  {LCDC, 0x91},
+  {STAT, 0x80},
+  {SCY, 0x00},
+  {SCX, 0x00},
+  {LYC, 0x00},
+  {BGP, 0xFC},
+  {OBP0, 0xFF},
+  {OBP1, 0xFF},
+  {WY, 0x00},
+  {WX, 0x00},
+  {BANK, 0x01},
+  {IE, 0x00},
+}
+
+// the ® next to the logo, 1 bit per pixel
+var registeredTile = [8]uint8{0x3C, 0x42, 0xB9, 0xA5, 0xB9, 0xA5, 0x42, 0x3C}
+
+func ParseModel(name string) (Model, error) {
+  for model := range postBootStates {
+    if strings.EqualFold(model.String(), name) {
+      return model, nil
+    }
+  }
+  return DMG, fmt.Errorf("unknown model %q, expected one of DMG0, DMG, MGB, SGB, SGB2, CGB", name)
+}
+
+// skipBootROM puts the hardware in the state the boot ROM for
+// model would have left it in, so games can start at 0x100
+func (cpu *Cpu) skipBootROM(model Model) {
+  state := postBootStates[model]
+  bus := cpu.Bus
+
+  cpu.A.write(state.A)
+  cpu.F.write(state.F)
+  // the DMG boot ROM sets H and C from the header checksum
+  if (model == DMG || model == MGB) && bus.header.HeaderChecksum == 0 {
+    cpu.F.write(0x80)
+  }
+  cpu.B.write(state.B)
+  cpu.C.write(state.C)
+  cpu.D.write(state.D)
+  cpu.E.write(state.E)
+  cpu.H.write(state.H)
+  cpu.L.write(state.L)
+  cpu.SP.write(0xFFFE)
+  cpu.PC.write(0x0100)
+
+  bus.WriteToBus(NR52, state.nr52)
+  for _, io := range postBootIO {
+    bus.WriteToBus(io.address, io.value)
+  }
+  bus.timers.divCounter = state.divCounter
+
+  // channel 1 is still on from the boot chime, but it's
+  // faded out by the time the boot ROM hands over
+  bus.apu.ch1.envelope.volume = 0
+  if state.nr52 & 0x01 == 0 {
+    bus.apu.ch1.enabled = false
+  }
+
+  if model != CGB {
+    bus.ppu.loadBootLogo(bus.cartridge)
+  }
+  // the LCD has been on since the logo scrolled in. we hand over at
+  // the tail end of line 153, where LY already reads 0
+  bus.ppu.currentMode = M1
+  bus.ppu.LY.write(0)
+  bus.ppu.LYCeqLY = true
+  bus.ppu.nDots = 4504
+}
+
+// the DMG boot ROM decompresses the logo from the cartridge header
+// into VRAM, doubling each pixel, and leaves it there
+func (ppu *Ppu) loadBootLogo(cartridge Cartridge) {
+  address := uint16(0x8010)
+  for i := uint16(0x104); i < 0x134; i++ {
+    logoByte := cartridge.read(i)
+    for _, nibble := range []uint8{logoByte >> 4, logoByte & 0x0F} {
+      var doubled uint8
+      for bit := uint8(0); bit < 4; bit++ {
+        if GetBitBool(nibble, bit) {
+          doubled |= 0x03 << (2 * bit)
+        }
+      }
+      // two rows per nibble, only the low bitplane is set
+      ppu.vram[address - 0x8000].write(doubled)
+      ppu.vram[address + 2 - 0x8000].write(doubled)
+      address += 4
+    }
+  }
+
+  for i, row := range registeredTile {
+    ppu.vram[0x8190 + 2*i - 0x8000].write(row)
+  }
+
+  // tile map: 2 rows of 12 tiles, then the ®
+  for i := uint16(0); i < 12; i++ {
+    ppu.vram[0x9904 + i - 0x8000].write(uint8(i + 1))
+    ppu.vram[0x9924 + i - 0x8000].write(uint8(i + 13))
+  }
+  ppu.vram[0x9910 - 0x8000].write(0x19)
+}
@@ -0,0 +1,134 @@
+package cpu
+
+import (
+  "testing"
+)
+
+func TestSkipBootROM(t *testing.T) {
+  type registers struct {
+    A, F, B, C, D, E, H, L uint8
+  }
+  tests := []struct {
+    model Model
+    headerChecksum uint8
+    registers registers
+    div uint8
+    nr52 uint8
+  }{
+    {DMG0, 0x00, registers{0x01, 0x00, 0xFF, 0x13, 0x00, 0xC1, 0x84, 0x03}, 0x18, 0xF1},
+    // H and C come from the header checksum
+    {DMG, 0x00, registers{0x01, 0x80, 0x00, 0x13, 0x00, 0xD8, 0x01, 0x4D}, 0xAB, 0xF1},
+    {DMG, 0x3C, registers{0x01, 0xB0, 0x00, 0x13, 0x00, 0xD8, 0x01, 0x4D}, 0xAB, 0xF1},
+    {MGB, 0x00, registers{0xFF, 0x80, 0x00, 0x13, 0x00, 0xD8, 0x01, 0x4D}, 0xAB, 0xF1},
+    {MGB, 0x3C, registers{0xFF, 0xB0, 0x00, 0x13, 0x00, 0xD8, 0x01, 0x4D}, 0xAB, 0xF1},
+    {SGB, 0x3C, registers{0x01, 0x00, 0x00, 0x14, 0x00, 0x00, 0xC0, 0x60}, 0xD8, 0xF0},
+    {SGB2, 0x3C, registers{0xFF, 0x00, 0x00, 0x14, 0x00, 0x00, 0xC0, 0x60}, 0xD8, 0xF0},
+    {CGB, 0x3C, registers{0x11, 0x80, 0x00, 0x00, 0xFF, 0x56, 0x00, 0x0D}, 0x26, 0xF1},
+  }
+
+  for _, test := range tests {
+    path := writeROM(t, "postboot", map[uint16][]byte{
+      0x0104: nintendoLogo,
+      0x014D: {test.headerChecksum},
+    })
+    gb, err := NewGameBoy(&path, "", test.model, true)
+    if err != nil {
+      t.Fatal(err)
+    }
+    name := test.model.String()
+    if test.headerChecksum != 0 {
+      name += " with a header checksum"
+    }
+
+    got := registers{gb.A.read(), gb.F.read(), gb.B.read(), gb.C.read(), gb.D.read(), gb.E.read(), gb.H.read(), gb.L.read()}
+    if got != test.registers {
+      t.Errorf("%s: registers %+v, want %+v", name, got, test.registers)
+    }
+    if pc, sp := gb.PC.read(), gb.SP.read(); pc != 0x0100 || sp != 0xFFFE {
+      t.Errorf("%s: PC %04X and SP %04X", name, pc, sp)
+    }
+
+    // as the game reads them, unused bits and all
+    io := []ioValue{
+      {P1, 0xCF},
+      {DIV, test.div},
+      {TIMA, 0x00},
+      {TMA, 0x00},
+      {TAC, 0xF8},
+      {IF, 0xE1},
+      {NR10, 0x80},
+      {NR11, 0xBF},
+      {NR12, 0xF3},
+      {NR14, 0xBF},
+      {NR21, 0x3F},
+      {NR22, 0x00},
+      {NR24, 0xBF},
+      {NR30, 0x7F},
+      {NR31, 0xFF},
+      {NR32, 0x9F},
+      {NR34, 0xBF},
+      {NR41, 0xFF},
+      {NR42, 0x00},
+      {NR43, 0x00},
+      {NR44, 0xBF},
+      {NR50, 0x77},
+      {NR51, 0xF3},
+      {NR52, test.nr52},
+      {LCDC, 0x91},
+      // mode 1 with LY=LYC
+      {STAT, 0x85},
+      {SCY, 0x00},
+      {SCX, 0x00},
+      {LY, 0x00},
+      {LYC, 0x00},
+      {BGP, 0xFC},
+      {OBP0, 0xFF},
+      {OBP1, 0xFF},
+      {WY, 0x00},
+      {WX, 0x00},
+      {IE, 0x00},
+    }
+    for _, want := range io {
+      if got := gb.Bus.ReadFromBus(want.address); got != want.value {
+        t.Errorf("%s: %04X is %02X, want %02X", name, want.address, got, want.value)
+      }
+    }
+    if gb.Bus.isBootROMMapped {
+      t.Errorf("%s: boot ROM still mapped", name)
+    }
+    if nDots := gb.Bus.ppu.nDots; nDots != 4504 {
+      t.Errorf("%s: %d dots into the frame, want 4504", name, nDots)
+    }
+
+    // the logo's first byte, CE, doubled up: C -> F0 and E -> FC, two
+    // rows each. the CGB boot ROM leaves VRAM empty
+    vram := func(address uint16) uint8 {
+      return gb.Bus.ppu.vram[address - 0x8000].read()
+    }
+    logo := []ioValue{
+      {0x8010, 0xF0},
+      {0x8012, 0xF0},
+      {0x8014, 0xFC},
+      {0x8016, 0xFC},
+      // odd bytes are the high bitplane
+      {0x8011, 0x00},
+      // the ®
+      {0x8190, 0x3C},
+      {0x819E, 0x3C},
+      // tile map
+      {0x9904, 0x01},
+      {0x990F, 0x0C},
+      {0x9910, 0x19},
+      {0x9924, 0x0D},
+      {0x992F, 0x18},
+    }
+    for _, want := range logo {
+      if test.model == CGB {
+        want.value = 0x00
+      }
+      if got := vram(want.address); got != want.value {
+        t.Errorf("%s: VRAM %04X is %02X, want %02X", name, want.address, got, want.value)
+      }
+    }
+  }
+}
@@ -1,7 +1,7 @@
 package cpu
 
 import (
-	//"fmt"
+	"fmt"
 )
 
 type Mode int
@@ -36,26 +36,14 @@ type Pixel struct {
   priority uint8
 }
 
-type palette map[uint8]uint8
+// the shade each of the 4 colors maps to
+type palette [4]uint8
 
 func (p palette) read() uint8 {
-  var value uint8 = 0x0
-  if c0, ok := p[0]; ok {
-    value = value | c0
-  }
-  if c1, ok := p[1]; ok {
-    value = value | (c1 << 2)
-  }
-  if c2, ok := p[2]; ok {
-    value = value | (c2 << 4)
-  }
-  if c3, ok := p[3]; ok {
-    value = value | (c3 << 6)
-  }
-  return value
+  return p[0] | p[1] << 2 | p[2] << 4 | p[3] << 6
 }
 
-func (p palette) write(value uint8) {
+func (p *palette) write(value uint8) {
   p[0] = value & 0x03
   p[1] = (value & 0x0C) >> 2
   p[2] = (value & 0x30) >> 4
@@ -76,10 +64,6 @@ func NewPpu(busPointer *Bus) *Ppu {
   ppu.bus = busPointer
   ppu.screen = [160*144]uint8{}
 
-  ppu.bgp = make(palette)
-  ppu.obp0 = make(palette)
-  ppu.obp1 = make(palette)
-
   ppu.applyFetcherState = [N_FETCHER_STATES]func()bool{
     ppu.GetTile,
     ppu.GetTileDataLow,
@@ -125,8 +109,8 @@ type Ppu struct {
 
   applyFetcherState [4]func() bool
 
-  bgFifo Fifo[*Pixel]
-  spriteFifo Fifo[*Pixel]
+  bgFifo Fifo[Pixel]
+  spriteFifo Fifo[Pixel]
 
   // OAM scan
   SpriteBuffer []Sprite
@@ -298,7 +282,7 @@ func (ppu *Ppu) Push() bool {
       high := (ppu.CurrentTileDataHigh >> offset) & 0x01
       palette := GetBit(ppu.SpriteToRender.flags, 4)
       priority := GetBit(ppu.SpriteToRender.flags, 7)
-      ppu.spriteFifo.Push(&Pixel{color: high << 1 | low, palette: palette, priority: priority})
+      ppu.spriteFifo.Push(Pixel{color: high << 1 | low, palette: palette, priority: priority})
     }
 
     // after this we're done fetching this sprite
@@ -316,7 +300,7 @@ func (ppu *Ppu) Push() bool {
     low := (ppu.CurrentTileDataLow >> (7-i)) & 0x01
     high := (ppu.CurrentTileDataHigh >> (7-i)) & 0x01
 
-    ppu.bgFifo.Push(&Pixel{color: high << 1 | low})
+    ppu.bgFifo.Push(Pixel{color: high << 1 | low})
     //fmt.Printf("%d ", high << 1 | low)
   }
 
@@ -327,14 +311,9 @@ func (ppu *Ppu) Push() bool {
 }
 
 func (ppu *Ppu) clearFifo(sprite bool) {
-  for ppu.bgFifo.Length() > 0 {
-    ppu.bgFifo.Pop()
-  }
-
+  ppu.bgFifo.Clear()
   if sprite {
-    for ppu.spriteFifo.Length() > 0 {
-      ppu.spriteFifo.Pop()
-    }
+    ppu.spriteFifo.Clear()
   }
 }
 
@@ -548,7 +527,7 @@ func (ppu *Ppu) doCycle() {
     if ppu.nDots == 376 {
       ppu.LY.inc()
       ppu.nDots = 0
-      ppu.SpriteBuffer = make([]Sprite, 0)
+      ppu.SpriteBuffer = ppu.SpriteBuffer[:0]
 
       if ppu.LY.read() == 144 {
         ppu.currentMode = M1
@@ -591,7 +570,7 @@ func (ppu *Ppu) clearState() {
     ppu.renderingWindow = false
     ppu.fetchingSprite = false
     ppu.clearFifo(true)
-    ppu.SpriteBuffer = make([]Sprite, 0)
+    ppu.SpriteBuffer = ppu.SpriteBuffer[:0]
 }
 
 func (ppu *Ppu) read(address uint16) uint8 {
@@ -612,7 +591,8 @@ func (ppu *Ppu) read(address uint16) uint8 {
     result = SetBitBool(result, 0, ppu.bgWinDisplay)
     return result
   case address == STAT:
-    var result uint8 = 0
+    // bit 7 is unused and reads as 1
+    var result uint8 = 0x80
     result = SetBitBool(result, 6, ppu.lycInt)
     result = SetBitBool(result, 5, ppu.mode2Int)
     result = SetBitBool(result, 4, ppu.mode1Int)
@@ -700,3 +680,134 @@ func (ppu *Ppu) write(address uint16, value uint8) {
   // TODO
   }
 }
+
+// Screen is the last rendered frame, 160x144 row by row, as
+// shades 0 (lightest) to 3 (darkest)
+func (cpu *Cpu) Screen() [160*144]uint8 {
+  return cpu.Bus.ppu.screen
+}
+
+func (s *Sprite) saveState(w *stateWriter) {
+  w.u8(s.yPos)
+  w.u8(s.xPos)
+  w.u8(s.tileIndex)
+  w.u8(s.flags)
+}
+
+func (s *Sprite) loadState(r *stateReader) {
+  s.yPos = r.u8()
+  s.xPos = r.u8()
+  s.tileIndex = r.u8()
+  s.flags = r.u8()
+}
+
+func savePixelFifo(w *stateWriter, fifo *Fifo[Pixel]) {
+  w.u8(uint8(fifo.Length()))
+  for i := 0; i < fifo.Length(); i++ {
+    p := fifo.At(i)
+    w.u8(p.color)
+    w.u8(p.palette)
+    w.u8(p.priority)
+  }
+}
+
+func loadPixelFifo(r *stateReader, fifo *Fifo[Pixel]) {
+  fifo.Clear()
+  n := r.u8()
+  if r.err == nil && n > FIFO_SIZE {
+    r.fail(fmt.Errorf("%w: %d pixels queued", ErrSaveStateFormat, n))
+  }
+  for i := uint8(0); i < n && r.err == nil; i++ {
+    fifo.Push(Pixel{color: r.u8(), palette: r.u8(), priority: r.u8()})
+  }
+}
+
+func (ppu *Ppu) saveState(w *stateWriter) {
+  w.registers(ppu.vram[:])
+  w.registers(ppu.oam[:])
+  w.data = append(w.data, ppu.screen[:]...)
+
+  w.u16(ppu.renderX)
+  w.u8(ppu.scrollDiscardedX)
+  w.bool(ppu.renderingWindow)
+  w.bool(ppu.renderedWindowThisLY)
+  w.u16(ppu.nDots)
+
+  w.u8(uint8(ppu.currentFetcherState))
+  w.u8(ppu.fetcherX)
+  w.u8(ppu.windowLineCounter)
+  w.u8(ppu.CurrentTileIndex)
+  w.u8(ppu.CurrentTileDataLow)
+  w.u8(ppu.CurrentTileDataHigh)
+  w.bool(ppu.fetchingSprite)
+  ppu.SpriteToRender.saveState(w)
+  savePixelFifo(w, &ppu.bgFifo)
+  savePixelFifo(w, &ppu.spriteFifo)
+
+  w.u8(uint8(len(ppu.SpriteBuffer)))
+  for i := range ppu.SpriteBuffer {
+    ppu.SpriteBuffer[i].saveState(w)
+  }
+  w.u8(ppu.OAMOffset)
+
+  w.u8(ppu.read(LCDC))
+  for _, reg := range []*Register8{&ppu.LY, &ppu.LYC, &ppu.SCX, &ppu.SCY, &ppu.WY, &ppu.WX} {
+    w.u8(reg.read())
+  }
+  for _, b := range []bool{ppu.lycInt, ppu.mode2Int, ppu.mode1Int, ppu.mode0Int, ppu.LYCeqLY, ppu.statInterruptLine} {
+    w.bool(b)
+  }
+  w.u8(uint8(ppu.currentMode))
+  w.u8(ppu.bgp.read())
+  w.u8(ppu.obp0.read())
+  w.u8(ppu.obp1.read())
+}
+
+func (ppu *Ppu) loadState(r *stateReader) {
+  r.registers(ppu.vram[:])
+  r.registers(ppu.oam[:])
+  copy(ppu.screen[:], r.take(len(ppu.screen)))
+
+  ppu.renderX = r.u16()
+  ppu.scrollDiscardedX = r.u8()
+  ppu.renderingWindow = r.bool()
+  ppu.renderedWindowThisLY = r.bool()
+  ppu.nDots = r.u16()
+
+  ppu.currentFetcherState = FetcherState(r.u8() % N_FETCHER_STATES)
+  ppu.fetcherX = r.u8()
+  ppu.windowLineCounter = r.u8()
+  ppu.CurrentTileIndex = r.u8()
+  ppu.CurrentTileDataLow = r.u8()
+  ppu.CurrentTileDataHigh = r.u8()
+  ppu.fetchingSprite = r.bool()
+  ppu.SpriteToRender.loadState(r)
+  loadPixelFifo(r, &ppu.bgFifo)
+  loadPixelFifo(r, &ppu.spriteFifo)
+
+  ppu.SpriteBuffer = make([]Sprite, r.u8())
+  for i := range ppu.SpriteBuffer {
+    ppu.SpriteBuffer[i].loadState(r)
+  }
+  ppu.OAMOffset = r.u8()
+
+  lcdc := r.u8()
+  ppu.lcdEnable = GetBitBool(lcdc, 7)
+  ppu.windowTileMap = GetBitBool(lcdc, 6)
+  ppu.windowEnable = GetBitBool(lcdc, 5)
+  ppu.bgWinDataAddress = GetBitBool(lcdc, 4)
+  ppu.bgTileMap = GetBitBool(lcdc, 3)
+  ppu.objSize = GetBitBool(lcdc, 2)
+  ppu.spriteEnable = GetBitBool(lcdc, 1)
+  ppu.bgWinDisplay = GetBitBool(lcdc, 0)
+  for _, reg := range []*Register8{&ppu.LY, &ppu.LYC, &ppu.SCX, &ppu.SCY, &ppu.WY, &ppu.WX} {
+    reg.write(r.u8())
+  }
+  for _, b := range []*bool{&ppu.lycInt, &ppu.mode2Int, &ppu.mode1Int, &ppu.mode0Int, &ppu.LYCeqLY, &ppu.statInterruptLine} {
+    *b = r.bool()
+  }
+  ppu.currentMode = Mode(r.u8() % N_MODES)
+  ppu.bgp.write(r.u8())
+  ppu.obp0.write(r.u8())
+  ppu.obp1.write(r.u8())
+}
@@ -0,0 +1,79 @@
+package cpu
+
+import (
+  "sort"
+)
+
+// the debugger keeps a profile of everything it runs: how many times
+// each opcode was fetched and how many M-cycles it took in total,
+// names and all from opcodeTable. an instruction's cycles are the ones
+// from its fetch until its micro-ops run out, so interrupt dispatch
+// and time spent halted don't count towards whatever ran before them
+
+// OpcodeProfile is one opcode's line in the profile
+type OpcodeProfile struct {
+  // e.g. "LD A,n8"
+  Mnemonic string
+  Opcode uint8
+  Prefixed bool
+  Count uint64
+  Cycles uint64
+  // from opcodeTable. the same unless it's conditional, when
+  // CyclesNotTaken is how long it is when the branch isn't taken
+  CyclesTaken uint8
+  CyclesNotTaken uint8
+}
+
+type opcodeCounter struct {
+  count uint64
+  cycles uint64
+}
+
+// the index into opcodeTable
+func opcodeIndex(op Opcode) int {
+  if op.Prefixed {
+    return 0x100 + int(op.Full)
+  }
+  return int(op.Full)
+}
+
+// called every cycle from resume
+func (d *Debugger) profileCycle(instructionBoundary bool) {
+  if d.cpu.betweenInstructions {
+    return
+  }
+  index := opcodeIndex(d.cpu.CurrentOpcode)
+  if instructionBoundary {
+    d.profile[index].count++
+  }
+  d.profile[index].cycles++
+}
+
+// Profile is every opcode that's run since the debugger was attached
+// or ResetProfile, the most cycles first
+func (d *Debugger) Profile() []OpcodeProfile {
+  var profile []OpcodeProfile
+  for i, counter := range d.profile {
+    if counter.count == 0 {
+      continue
+    }
+    inst := &opcodeTable[i]
+    profile = append(profile, OpcodeProfile{
+      Mnemonic: inst.mnemonic,
+      Opcode: uint8(i),
+      Prefixed: i >= 0x100,
+      Count: counter.count,
+      Cycles: counter.cycles,
+      CyclesTaken: inst.cycles,
+      CyclesNotTaken: inst.cyclesNotTaken,
+    })
+  }
+  sort.SliceStable(profile, func(i, j int) bool {
+    return profile[i].Cycles > profile[j].Cycles
+  })
+  return profile
+}
+
+func (d *Debugger) ResetProfile() {
+  d.profile = [0x200]opcodeCounter{}
+}
@@ -0,0 +1,110 @@
+package cpu
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+// halts, waits for the timer interrupt, and halts again
+//   0150 LD SP, DFFE
+//   0153 LD A, 04
+//   0155 LDH (FF), A   ; IE = timer
+//   0157 LD A, 05
+//   0159 LDH (07), A   ; TAC = on, every 4 M-cycles
+//   015B EI
+//   015C HALT
+//   015D JR 015C
+//   0050 RETI
+func TestDebuggerProfile(t *testing.T) {
+  path := writeROM(t, "profile", map[uint16][]byte{
+    0x050: {0xD9},
+    0x150: {0x31, 0xFE, 0xDF, 0x3E, 0x04, 0xE0, 0xFF, 0x3E, 0x05, 0xE0, 0x07, 0xFB, 0x76, 0x18, 0xFD},
+  })
+  gb, err := NewGameBoy(&path, "", DMG, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  d := NewDebugger(gb)
+
+  d.Break(0x015C, -1, nil)
+  expectStop(t, gb, d.Continue(), DEBUG_BREAKPOINT, 0x015C)
+  // NOP, JP, LD SP, LD A twice, LDH twice, EI and HALT's first cycle
+  if profile := d.Profile(); len(profile) != 7 || profile[0].Opcode != 0xE0 || profile[0].Count != 2 || profile[0].Cycles != 6 {
+    t.Errorf("profile up to the first HALT is %+v", profile)
+  }
+
+  // HALT's one cycle was fetched before the reset, so it doesn't count
+  d.ResetProfile()
+  start := gb.globalCounter
+  for i := 0; i < 5; i++ {
+    expectStop(t, gb, d.Continue(), DEBUG_BREAKPOINT, 0x015C)
+  }
+
+  // the time halted and the 5 cycles of interrupt dispatch aren't
+  // anyone's
+  want := map[uint8]uint64{0x76: 5, 0xD9: 20, 0x18: 15}
+  profile := d.Profile()
+  if len(profile) != len(want) {
+    t.Fatalf("profile is %+v", profile)
+  }
+  var total uint64
+  for _, p := range profile {
+    if p.Prefixed || p.Count != 5 || p.Cycles != want[p.Opcode] {
+      t.Errorf("%02X: ran %d times in %d cycles, want 5 in %d", p.Opcode, p.Count, p.Cycles, want[p.Opcode])
+    }
+    if inst := &opcodeTable[p.Opcode]; p.Mnemonic != inst.mnemonic || p.Cycles != p.Count * uint64(inst.cycles) {
+      t.Errorf("%02X: %+v doesn't match %s", p.Opcode, p, inst.mnemonic)
+    }
+    total += p.Cycles
+  }
+  if profile[0].Opcode != 0xD9 {
+    t.Errorf("%s took the most cycles, not RETI", profile[0].Mnemonic)
+  }
+  if elapsed := gb.globalCounter - start; total >= elapsed {
+    t.Errorf("%d cycles profiled out of %d", total, elapsed)
+  }
+
+  var out bytes.Buffer
+  d.command("profile 2", &out)
+  lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+  if len(lines) != 3 || !strings.Contains(lines[1], "RETI") || !strings.Contains(lines[2], "JR") {
+    t.Errorf("profile printed:\n%s", out.String())
+  }
+  out.Reset()
+  d.command("profile reset", &out)
+  d.command("profile", &out)
+  if !strings.Contains(out.String(), "nothing has run yet") {
+    t.Errorf("profile after a reset printed:\n%s", out.String())
+  }
+}
+
+// conditional ones take however long they actually took
+//   0150 LD A, 03
+//   0152 DEC A
+//   0153 JR NZ, 0152
+//   0155 JR 0155
+func TestDebuggerProfileConditional(t *testing.T) {
+  path := writeROM(t, "profilecc", map[uint16][]byte{
+    0x150: {0x3E, 0x03, 0x3D, 0x20, 0xFD, 0x18, 0xFE},
+  })
+  gb, err := NewGameBoy(&path, "", DMG, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  d := NewDebugger(gb)
+  d.Break(0x0155, -1, nil)
+  expectStop(t, gb, d.Continue(), DEBUG_BREAKPOINT, 0x0155)
+
+  for _, p := range d.Profile() {
+    if p.Opcode != 0x20 {
+      continue
+    }
+    // taken twice, then not
+    if want := 2 * uint64(p.CyclesTaken) + uint64(p.CyclesNotTaken); p.Count != 3 || p.Cycles != want {
+      t.Errorf("JR NZ ran %d times in %d cycles, want 3 in %d", p.Count, p.Cycles, want)
+    }
+    return
+  }
+  t.Error("JR NZ isn't in the profile")
+}
@@ -0,0 +1,236 @@
+package cpu
+
+import (
+  "bufio"
+  "encoding/binary"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// WavWriter writes 16-bit PCM WAV files. Sizes in the header are
+// filled in by Close.
+type WavWriter struct {
+  file *os.File
+  w *bufio.Writer
+  channels uint16
+  sampleRate uint32
+  dataBytes uint32
+}
+
+func NewWavWriter(path string, sampleRate int, channels int) (*WavWriter, error) {
+  f, err := os.Create(path)
+  if err != nil {
+    return nil, err
+  }
+  wav := &WavWriter{
+    file: f,
+    w: bufio.NewWriter(f),
+    channels: uint16(channels),
+    sampleRate: uint32(sampleRate),
+  }
+  if err := wav.writeHeader(); err != nil {
+    f.Close()
+    return nil, err
+  }
+  return wav, nil
+}
+
+// http://soundfile.sapp.org/doc/WaveFormat/
+func (wav *WavWriter) writeHeader() error {
+  blockAlign := wav.channels * 2
+  header := []any{
+    []byte("RIFF"),
+    uint32(36 + wav.dataBytes),
+    []byte("WAVE"),
+    []byte("fmt "),
+    uint32(16), // fmt chunk size
+    uint16(1),  // PCM
+    wav.channels,
+    wav.sampleRate,
+    wav.sampleRate * uint32(blockAlign), // byte rate
+    blockAlign,
+    uint16(16), // bits per sample
+    []byte("data"),
+    wav.dataBytes,
+  }
+  for _, field := range header {
+    if err := binary.Write(wav.w, binary.LittleEndian, field); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (wav *WavWriter) writeFrame(samples ...int16) error {
+  var buf [2]byte
+  for _, s := range samples {
+    binary.LittleEndian.PutUint16(buf[:], uint16(s))
+    if _, err := wav.w.Write(buf[:]); err != nil {
+      return err
+    }
+  }
+  wav.dataBytes += uint32(2 * len(samples))
+  return nil
+}
+
+func (wav *WavWriter) Close() error {
+  if err := wav.w.Flush(); err != nil {
+    wav.file.Close()
+    return err
+  }
+  // rewrite the header now that we know how much data there is
+  if _, err := wav.file.Seek(0, 0); err != nil {
+    wav.file.Close()
+    return err
+  }
+  wav.w.Reset(wav.file)
+  if err := wav.writeHeader(); err != nil {
+    wav.file.Close()
+    return err
+  }
+  if err := wav.w.Flush(); err != nil {
+    wav.file.Close()
+    return err
+  }
+  return wav.file.Close()
+}
+
+// AudioRecorder captures the APU's output as a stereo mix and,
+// optionally, one stereo stem per channel
+type AudioRecorder struct {
+  mixed *WavWriter
+  stems [4]*WavWriter
+
+  capacitorLeft float64
+  capacitorRight float64
+  stemCapacitors [4][2]float64
+
+  err error
+}
+
+// stem files are named like song_ch1.wav, song_ch2.wav, ...
+func stemPath(path string, channel int) string {
+  ext := filepath.Ext(path)
+  return fmt.Sprintf("%s_ch%d%s", strings.TrimSuffix(path, ext), channel, ext)
+}
+
+func NewAudioRecorder(path string, sampleRate int, stems bool) (*AudioRecorder, error) {
+  r := &AudioRecorder{}
+  mixed, err := NewWavWriter(path, sampleRate, 2)
+  if err != nil {
+    return nil, err
+  }
+  r.mixed = mixed
+
+  if stems {
+    for i := range r.stems {
+      stem, err := NewWavWriter(stemPath(path, i + 1), sampleRate, 2)
+      if err != nil {
+        r.Close()
+        return nil, err
+      }
+      r.stems[i] = stem
+    }
+  }
+  return r, nil
+}
+
+func (r *AudioRecorder) record(a *Apu, outputs [4]float64) {
+  // keep the first error, and stop writing after it
+  if r.err != nil {
+    return
+  }
+
+  left, right := a.mix(outputs)
+  left = a.highPass(left, &r.capacitorLeft)
+  right = a.highPass(right, &r.capacitorRight)
+  r.err = r.mixed.writeFrame(toPCM(left), toPCM(right))
+
+  for i, stem := range r.stems {
+    if stem == nil || r.err != nil {
+      continue
+    }
+    var solo [4]float64
+    solo[i] = outputs[i]
+    left, right := a.mix(solo)
+    left = a.highPass(left, &r.stemCapacitors[i][0])
+    right = a.highPass(right, &r.stemCapacitors[i][1])
+    r.err = stem.writeFrame(toPCM(left), toPCM(right))
+  }
+}
+
+func (r *AudioRecorder) Close() error {
+  err := r.err
+  if r.mixed != nil {
+    if closeErr := r.mixed.Close(); err == nil {
+      err = closeErr
+    }
+  }
+  for _, stem := range r.stems {
+    if stem == nil {
+      continue
+    }
+    if closeErr := stem.Close(); err == nil {
+      err = closeErr
+    }
+  }
+  return err
+}
+
+// StartRecording writes everything the APU plays to a WAV file at
+// path, plus per-channel stems if stems is set. It doesn't need an
+// audio device, so it works headless too.
+func (cpu *Cpu) StartRecording(path string, stems bool) error {
+  apu := cpu.Bus.apu
+  apu.recorderMu.Lock()
+  defer apu.recorderMu.Unlock()
+
+  if apu.recorder != nil {
+    return fmt.Errorf("already recording")
+  }
+  recorder, err := NewAudioRecorder(path, int(apu.sampleRate), stems)
+  if err != nil {
+    return err
+  }
+  apu.recorder = recorder
+  return nil
+}
+
+func (cpu *Cpu) StopRecording() error {
+  apu := cpu.Bus.apu
+  apu.recorderMu.Lock()
+  defer apu.recorderMu.Unlock()
+
+  if apu.recorder == nil {
+    return nil
+  }
+  err := apu.recorder.Close()
+  apu.recorder = nil
+  return err
+}
+
+func (cpu *Cpu) IsRecording() bool {
+  apu := cpu.Bus.apu
+  apu.recorderMu.Lock()
+  defer apu.recorderMu.Unlock()
+  return apu.recorder != nil
+}
+
+// ToggleRecording starts a timestamped recording next to the ROM,
+// or stops the current one
+func (cpu *Cpu) ToggleRecording(stems bool) (string, error) {
+  if cpu.IsRecording() {
+    return "", cpu.StopRecording()
+  }
+  path := timestampedPath(cpu.Bus.romFilePath, ".wav")
+  return path, cpu.StartRecording(path, stems)
+}
+
+// e.g. data/Tetris.gb -> data/Tetris-20231201-150405.wav
+func timestampedPath(romFilePath string, ext string) string {
+  base := strings.TrimSuffix(romFilePath, filepath.Ext(romFilePath))
+  return fmt.Sprintf("%s-%s%s", base, time.Now().Format("20060102-150405"), ext)
+}
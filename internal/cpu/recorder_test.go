@@ -0,0 +1,86 @@
+package cpu
+
+import (
+  "encoding/binary"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// records a square wave on channel 2 the way the headless -record
+// does, and checks what ends up in the WAV files
+func TestRecording(t *testing.T) {
+  gb := newGameBoyWithCode(t, "record", map[uint16][]byte{
+    0x0150: {
+      0x3E, 0x80, // 0150 LD A,$80
+      0xE0, 0x26, // 0152 LDH (NR52),A, APU on
+      0x3E, 0x77, // 0154 LD A,$77
+      0xE0, 0x24, // 0156 LDH (NR50),A, full volume
+      0x3E, 0xFF, // 0158 LD A,$FF
+      0xE0, 0x25, // 015A LDH (NR51),A, everything both sides
+      0xAF,       // 015C XOR A
+      0xE0, 0x12, // 015D LDH (NR12),A, channel 1's DAC off, the boot sound is still going
+      0x3E, 0xF0, // 015F LD A,$F0
+      0xE0, 0x17, // 0161 LDH (NR22),A
+      0x3E, 0x87, // 0163 LD A,$87
+      0xE0, 0x19, // 0165 LDH (NR24),A, trigger
+      0x18, 0xFE, // 0167 JR $FE
+    },
+  })
+  path := filepath.Join(t.TempDir(), "out.wav")
+  if err := gb.StartRecording(path, true); err != nil {
+    t.Fatal(err)
+  }
+  start := gb.globalCounter
+  sampleCounter := gb.Bus.apu.sampleCounter
+  if _, err := gb.RunUntil(RunLimits{Frames: 10}); err != nil {
+    t.Fatal(err)
+  }
+  if err := gb.StopRecording(); err != nil {
+    t.Fatal(err)
+  }
+  // doSample runs once a cycle, starting from wherever its counter was
+  samples := (sampleCounter + (gb.globalCounter - start) * AudioSampleRate) / ClockSpeed
+
+  for _, file := range []string{path, stemPath(path, 1), stemPath(path, 2), stemPath(path, 3), stemPath(path, 4)} {
+    data, err := os.ReadFile(file)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(data) < 44 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" || string(data[36:40]) != "data" {
+      t.Fatalf("%s: not a WAV file", file)
+    }
+    le := binary.LittleEndian
+    if size := le.Uint32(data[4:]); int(size) != len(data) - 8 {
+      t.Errorf("%s: RIFF size %d, file is %d bytes", file, size, len(data))
+    }
+    if channels := le.Uint16(data[22:]); channels != 2 {
+      t.Errorf("%s: %d channels", file, channels)
+    }
+    if rate := le.Uint32(data[24:]); rate != AudioSampleRate {
+      t.Errorf("%s: sample rate %d", file, rate)
+    }
+    dataBytes := le.Uint32(data[40:])
+    if int(dataBytes) != len(data) - 44 {
+      t.Errorf("%s: data size %d, %d bytes after the header", file, dataBytes, len(data) - 44)
+    }
+    // if the last cycle got as far as the sample, it's in there too
+    if n := uint64(dataBytes / 4); n != samples && n != samples + 1 {
+      t.Errorf("%s: %d samples, want %d", file, n, samples)
+    }
+
+    // channel 2 is the only one playing by the second half, once
+    // channel 1 has been turned off and the high-pass filter has settled
+    silent := true
+    last := len(data) - 2
+    for i := 44 + (len(data) - 44) / 4 * 2; i < last; i += 2 {
+      if le.Uint16(data[i:]) != le.Uint16(data[last:]) {
+        silent = false
+        break
+      }
+    }
+    if want := file == path || file == stemPath(path, 2); silent == want {
+      t.Errorf("%s: silent %t", file, silent)
+    }
+  }
+}
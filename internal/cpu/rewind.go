@@ -0,0 +1,258 @@
+package cpu
+
+import (
+  "bytes"
+  "compress/flate"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "sync"
+)
+
+// Rewind keeps a rolling history of save states. the newest one is kept
+// whole and everything older as a compressed XOR against the state after
+// it, which is mostly zeros since little changes in a frame or two:
+//   latest = S9, deltas = [S1^S2, S2^S3, ... S8^S9]
+// so stepping back is one delta, and going over the memory budget drops
+// the oldest. snapshots are taken on the Execute goroutine but compressed
+// on another one, so emulation only pays for SaveState itself
+
+type RewindConfig struct {
+  // take a snapshot every this many frames
+  Interval uint64
+  // roughly how much memory the history can use, in bytes
+  MaxBytes int
+}
+
+var DefaultRewindConfig = RewindConfig{Interval: 2, MaxBytes: 64 * 1024 * 1024}
+
+type rewindBuffer struct {
+  mu sync.Mutex
+  latest []byte
+  // oldest first
+  deltas [][]byte
+  deltaBytes int
+  maxBytes int
+
+  // snapshots on their way to the compressor. compressed is signalled
+  // whenever pending goes down
+  snapshots chan []byte
+  pending int
+  compressed *sync.Cond
+  // closed when compressLoop returns
+  done chan struct{}
+}
+
+func newRewindBuffer(maxBytes int) *rewindBuffer {
+  r := &rewindBuffer{maxBytes: maxBytes, snapshots: make(chan []byte, 8), done: make(chan struct{})}
+  r.compressed = sync.NewCond(&r.mu)
+  go r.compressLoop()
+  return r
+}
+
+// stops the compressor once it's caught up. nothing can be pushed
+// after this, but what's there can still be popped
+func (r *rewindBuffer) close() {
+  close(r.snapshots)
+  <-r.done
+}
+
+// never blocks. if the compressor has fallen behind the snapshot is
+// dropped, which just leaves a bigger jump in the history
+func (r *rewindBuffer) push(state []byte) {
+  r.mu.Lock()
+  r.pending++
+  r.mu.Unlock()
+  select {
+  case r.snapshots <- state:
+  default:
+    r.mu.Lock()
+    r.pending--
+    r.compressed.Broadcast()
+    r.mu.Unlock()
+  }
+}
+
+// with r.mu held
+func (r *rewindBuffer) waitForCompressor() {
+  for r.pending > 0 {
+    r.compressed.Wait()
+  }
+}
+
+func (r *rewindBuffer) compressLoop() {
+  defer close(r.done)
+  for state := range r.snapshots {
+    // pop waits for pending snapshots, so nothing else touches
+    // latest until this one's done
+    r.mu.Lock()
+    previous := r.latest
+    r.mu.Unlock()
+    var delta []byte
+    if previous != nil {
+      delta = compressDelta(previous, state)
+    }
+
+    r.mu.Lock()
+    if previous != nil {
+      r.deltas = append(r.deltas, delta)
+      r.deltaBytes += len(delta)
+      for r.deltaBytes + len(state) > r.maxBytes && len(r.deltas) > 0 {
+        r.deltaBytes -= len(r.deltas[0])
+        r.deltas[0] = nil
+        r.deltas = r.deltas[1:]
+      }
+    }
+    r.latest = state
+    r.pending--
+    r.compressed.Broadcast()
+    r.mu.Unlock()
+  }
+}
+
+// pop returns the newest snapshot and makes the one before it the
+// newest. once there's only one left it keeps returning that
+func (r *rewindBuffer) pop() ([]byte, bool) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.waitForCompressor()
+  if r.latest == nil {
+    return nil, false
+  }
+  state := r.latest
+  if n := len(r.deltas); n > 0 {
+    older, err := applyDelta(state, r.deltas[n-1])
+    if err != nil {
+      panic(fmt.Sprintf("corrupt rewind history: %v", err))
+    }
+    r.deltaBytes -= len(r.deltas[n-1])
+    r.deltas[n-1] = nil
+    r.deltas = r.deltas[:n-1]
+    r.latest = older
+  }
+  return state, true
+}
+
+// how many snapshots are in the history
+func (r *rewindBuffer) length() int {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.waitForCompressor()
+  if r.latest == nil {
+    return 0
+  }
+  return len(r.deltas) + 1
+}
+
+// states aren't all the same length (e.g. the sprite buffer and the
+// micro-op queue), so the shorter one is zero padded and the length
+// of the older one goes first
+func compressDelta(older []byte, newer []byte) []byte {
+  delta := make([]byte, max(len(older), len(newer)))
+  copy(delta, older)
+  for i := range newer {
+    delta[i] ^= newer[i]
+  }
+
+  var buf bytes.Buffer
+  buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(older))))
+  w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+  w.Write(delta)
+  w.Close()
+  return buf.Bytes()
+}
+
+func applyDelta(newer []byte, compressed []byte) ([]byte, error) {
+  if len(compressed) < 4 {
+    return nil, io.ErrUnexpectedEOF
+  }
+  n := int(binary.LittleEndian.Uint32(compressed))
+  delta, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed[4:])))
+  if err != nil {
+    return nil, err
+  }
+  if n > len(delta) {
+    return nil, io.ErrUnexpectedEOF
+  }
+  older := delta[:n]
+  for i := 0; i < n && i < len(newer); i++ {
+    older[i] ^= newer[i]
+  }
+  return older, nil
+}
+
+// EnableRewind starts keeping a history to rewind through, throwing
+// away any history from before. Safe to call from any goroutine but
+// the one running Execute
+func (cpu *Cpu) EnableRewind(config RewindConfig) error {
+  if config.Interval == 0 {
+    return fmt.Errorf("rewind interval must be at least 1 frame")
+  }
+  if config.MaxBytes <= 0 {
+    return fmt.Errorf("rewind needs a memory budget")
+  }
+  cpu.swapRewind(newRewindBuffer(config.MaxBytes), config.Interval * CYCLES_PER_FRAME)
+  return nil
+}
+
+// DisableRewind stops keeping a history and frees it. Safe to call
+// from any goroutine but the one running Execute
+func (cpu *Cpu) DisableRewind() {
+  cpu.swapRewind(nil, 0)
+}
+
+func (cpu *Cpu) swapRewind(r *rewindBuffer, interval uint64) {
+  var old *rewindBuffer
+  cpu.betweenCycles(func() {
+    old = cpu.rewind
+    cpu.rewind = r
+    cpu.rewindInterval = interval
+  })
+  // run won't push to it any more, so its compressor can stop
+  if old != nil {
+    old.close()
+  }
+}
+
+// called every M-cycle from run
+func (cpu *Cpu) captureRewind() {
+  if cpu.globalCounter % cpu.rewindInterval == 0 {
+    cpu.rewind.push(cpu.SaveState())
+  }
+}
+
+// StartRewind pauses emulation so RewindStep can walk back through
+// the history. Returns false if rewind isn't enabled
+func (cpu *Cpu) StartRewind() bool {
+  if cpu.rewind == nil {
+    return false
+  }
+  cpu.paused.Store(true)
+  return true
+}
+
+// StopRewind carries on from wherever RewindStep got to. The history
+// from there on is overwritten as the game runs
+func (cpu *Cpu) StopRewind() {
+  cpu.paused.Store(false)
+}
+
+// RewindStep goes back one snapshot, or stays on the oldest one.
+// Safe to call from any goroutine but the one running Execute
+func (cpu *Cpu) RewindStep() bool {
+  if cpu.rewind == nil {
+    return false
+  }
+  state, ok := cpu.rewind.pop()
+  if !ok {
+    return false
+  }
+  var err error
+  cpu.betweenCycles(func() {
+    err = cpu.LoadState(state)
+  })
+  if err != nil {
+    panic(fmt.Sprintf("couldn't load a rewind snapshot: %v", err))
+  }
+  return true
+}
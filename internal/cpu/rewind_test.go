@@ -0,0 +1,133 @@
+package cpu
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestRewindBuffer(t *testing.T) {
+  r := newRewindBuffer(1 << 20)
+  var states [][]byte
+  for i := 0; i < 20; i++ {
+    // different lengths, like states with more or fewer micro-ops queued
+    state := bytes.Repeat([]byte{byte(i), 0xAA, 0x00}, 1000 + i % 3)
+    states = append(states, state)
+    r.push(state)
+    // the compressor drops snapshots it can't keep up with
+    r.length()
+  }
+  if n := r.length(); n != len(states) {
+    t.Fatalf("%d snapshots, want %d", n, len(states))
+  }
+
+  for i := len(states) - 1; i >= 0; i-- {
+    state, ok := r.pop()
+    if !ok || !bytes.Equal(state, states[i]) {
+      t.Fatalf("pop %d gave the wrong state", len(states) - i)
+    }
+  }
+  // the oldest one sticks around
+  if state, ok := r.pop(); !ok || !bytes.Equal(state, states[0]) {
+    t.Fatal("popping past the start lost the oldest state")
+  }
+}
+
+func TestRewindBufferBudget(t *testing.T) {
+  // room for the latest state and not much else
+  r := newRewindBuffer(5000)
+  for i := 0; i < 100; i++ {
+    r.push(bytes.Repeat([]byte{byte(i * 37)}, 4000))
+    r.length()
+  }
+  if n := r.length(); n < 1 || n == 100 {
+    t.Errorf("%d snapshots kept in 5000 bytes", n)
+  }
+  if r.deltaBytes + len(r.latest) > 5000 {
+    t.Errorf("history is %d bytes", r.deltaBytes + len(r.latest))
+  }
+}
+
+func TestRewindStep(t *testing.T) {
+  gb := newTestGameBoy(t)
+  if err := gb.EnableRewind(RewindConfig{Interval: 1, MaxBytes: 16 << 20}); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 10; i++ {
+    runCycles(gb, CYCLES_PER_FRAME)
+    gb.rewind.length()
+  }
+
+  if !gb.StartRewind() {
+    t.Fatal("rewind not enabled")
+  }
+  for frame := uint64(10); frame >= 1; frame-- {
+    if !gb.RewindStep() {
+      t.Fatal("nothing to rewind to")
+    }
+    if gb.globalCounter != frame * CYCLES_PER_FRAME {
+      t.Fatalf("rewound to cycle %d, want frame %d", gb.globalCounter, frame)
+    }
+  }
+  gb.RewindStep()
+  if gb.globalCounter != CYCLES_PER_FRAME {
+    t.Errorf("rewound past the oldest snapshot to cycle %d", gb.globalCounter)
+  }
+  gb.StopRewind()
+
+  // and carry on from there
+  runCycles(gb, CYCLES_PER_FRAME)
+  if gb.globalCounter != 2 * CYCLES_PER_FRAME {
+    t.Errorf("at cycle %d after running on", gb.globalCounter)
+  }
+}
+
+func TestRewindBufferClose(t *testing.T) {
+  r := newRewindBuffer(1 << 20)
+  r.push(bytes.Repeat([]byte{0x01}, 1000))
+  r.push(bytes.Repeat([]byte{0x02}, 1000))
+  r.close()
+  select {
+  case <-r.done:
+  default:
+    t.Fatal("compressor still running after close")
+  }
+  // whatever was queued still made it in
+  if n := r.length(); n != 2 {
+    t.Errorf("%d snapshots after closing, want 2", n)
+  }
+}
+
+func TestEnableRewindStopsOldCompressor(t *testing.T) {
+  gb := newTestGameBoy(t)
+  config := RewindConfig{Interval: 1, MaxBytes: 16 << 20}
+  if err := gb.EnableRewind(config); err != nil {
+    t.Fatal(err)
+  }
+  first := gb.rewind
+  runCycles(gb, CYCLES_PER_FRAME)
+
+  if err := gb.EnableRewind(config); err != nil {
+    t.Fatal(err)
+  }
+  second := gb.rewind
+  select {
+  case <-first.done:
+  default:
+    t.Error("replaced history's compressor still running")
+  }
+  if second.length() != 0 {
+    t.Error("new history isn't empty")
+  }
+
+  gb.DisableRewind()
+  select {
+  case <-second.done:
+  default:
+    t.Error("compressor still running after disabling rewind")
+  }
+  if gb.StartRewind() || gb.RewindStep() {
+    t.Error("rewound with rewind disabled")
+  }
+  // and running on doesn't take snapshots
+  runCycles(gb, CYCLES_PER_FRAME)
+}
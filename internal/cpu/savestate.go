@@ -0,0 +1,389 @@
+package cpu
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+)
+
+// Save states are the whole machine in one blob: a small header so we
+// can refuse states from other ROMs or other versions of the format,
+// then every component in a fixed order. each component writes its own
+// fields in its saveState/loadState, next to the struct they describe,
+// so adding a field means touching those and bumping SAVE_STATE_VERSION.
+//
+// the one thing that isn't plain data is the ExecutionQueue, which holds
+// the micro-ops left of the current instruction. those are written by
+// name, see microOpTable below.
+
+var saveStateMagic = []byte("GBSTATE\x00")
+
+const SAVE_STATE_VERSION = 5
+
+var ErrSaveStateFormat = errors.New("not a save state, or a corrupt one")
+
+// stateWriter appends little endian values to a byte slice
+type stateWriter struct {
+  data []byte
+}
+
+func (w *stateWriter) u8(value uint8) {
+  w.data = append(w.data, value)
+}
+
+func (w *stateWriter) bool(value bool) {
+  if value {
+    w.u8(1)
+  } else {
+    w.u8(0)
+  }
+}
+
+func (w *stateWriter) u16(value uint16) {
+  w.data = binary.LittleEndian.AppendUint16(w.data, value)
+}
+
+func (w *stateWriter) u32(value uint32) {
+  w.data = binary.LittleEndian.AppendUint32(w.data, value)
+}
+
+func (w *stateWriter) u64(value uint64) {
+  w.data = binary.LittleEndian.AppendUint64(w.data, value)
+}
+
+func (w *stateWriter) i32(value int32) {
+  w.u32(uint32(value))
+}
+
+// length prefixed
+func (w *stateWriter) bytes(value []byte) {
+  w.u32(uint32(len(value)))
+  w.data = append(w.data, value...)
+}
+
+func (w *stateWriter) string(value string) {
+  w.bytes([]byte(value))
+}
+
+func (w *stateWriter) registers(registers []Register8) {
+  w.u32(uint32(len(registers)))
+  for i := range registers {
+    w.u8(registers[i].read())
+  }
+}
+
+// stateReader is the other end of stateWriter. it stops at the first
+// problem and remembers it, so loadState methods can read everything
+// and check err once at the end
+type stateReader struct {
+  data []byte
+  err error
+}
+
+func (r *stateReader) fail(err error) {
+  if r.err == nil {
+    r.err = err
+  }
+}
+
+func (r *stateReader) take(n int) []byte {
+  if r.err != nil {
+    return make([]byte, n)
+  }
+  if n > len(r.data) {
+    r.fail(ErrSaveStateFormat)
+    return make([]byte, n)
+  }
+  b := r.data[:n]
+  r.data = r.data[n:]
+  return b
+}
+
+func (r *stateReader) u8() uint8 {
+  return r.take(1)[0]
+}
+
+func (r *stateReader) bool() bool {
+  return r.u8() != 0
+}
+
+func (r *stateReader) u16() uint16 {
+  return binary.LittleEndian.Uint16(r.take(2))
+}
+
+func (r *stateReader) u32() uint32 {
+  return binary.LittleEndian.Uint32(r.take(4))
+}
+
+func (r *stateReader) u64() uint64 {
+  return binary.LittleEndian.Uint64(r.take(8))
+}
+
+func (r *stateReader) i32() int32 {
+  return int32(r.u32())
+}
+
+func (r *stateReader) bytes() []byte {
+  n := r.u32()
+  if r.err == nil && int(n) > len(r.data) {
+    r.fail(ErrSaveStateFormat)
+  }
+  if r.err != nil {
+    return nil
+  }
+  return append([]byte(nil), r.take(int(n))...)
+}
+
+func (r *stateReader) string() string {
+  return string(r.bytes())
+}
+
+// the length has to match, e.g. cartridge RAM is sized by the header
+func (r *stateReader) registers(registers []Register8) {
+  n := r.u32()
+  if r.err == nil && int(n) != len(registers) {
+    r.fail(fmt.Errorf("%w: expected %d bytes of memory, got %d", ErrSaveStateFormat, len(registers), n))
+  }
+  if r.err != nil {
+    return
+  }
+  for i, b := range r.take(len(registers)) {
+    registers[i].write(b)
+  }
+}
+
+// microOpTable maps the micro-ops that can be waiting in the
+// ExecutionQueue to stable names and back. funcs can't be compared in
+// go, but their code pointers can, and none of the micro-ops capture
+// anything that changes, so a code pointer is enough to know which
+// one it is
+type microOpTable struct {
+  byName map[string]func(*Cpu)
+  names map[uintptr]string
+}
+
+func newMicroOpTable(byName map[string]func(*Cpu)) microOpTable {
+  table := microOpTable{byName: byName, names: make(map[uintptr]string)}
+  for name, op := range byName {
+    pointer := reflect.ValueOf(op).Pointer()
+    if other, ok := table.names[pointer]; ok {
+      panic(fmt.Sprintf("micro-ops %s and %s are the same function", name, other))
+    }
+    table.names[pointer] = name
+  }
+  return table
+}
+
+func (t *microOpTable) name(op func(*Cpu)) string {
+  name, ok := t.names[reflect.ValueOf(op).Pointer()]
+  if !ok {
+    panic("micro-op missing from the table in makeInstructions, can't save it")
+  }
+  return name
+}
+
+func (t *microOpTable) lookup(name string) (func(*Cpu), bool) {
+  op, ok := t.byName[name]
+  return op, ok
+}
+
+func (cpu *Cpu) saveState(w *stateWriter) {
+  for _, reg := range []*Register8{&cpu.A, &cpu.F, &cpu.B, &cpu.C, &cpu.D, &cpu.E, &cpu.H, &cpu.L} {
+    w.u8(reg.read())
+  }
+  w.u16(cpu.PC.read())
+  w.u16(cpu.SP.read())
+
+  w.u8(cpu.CurrentOpcode.Full)
+  w.bool(cpu.CurrentOpcode.Prefixed)
+  w.u32(uint32(cpu.ExecutionQueue.Length()))
+  for i := 0; i < cpu.ExecutionQueue.Length(); i++ {
+    w.string(microOps.name(cpu.ExecutionQueue.At(i)))
+  }
+
+  w.u8(uint8(cpu.IMECountdown))
+  w.bool(cpu.IME)
+  w.bool(cpu.isHalted)
+  w.bool(cpu.isStopped)
+  w.bool(cpu.haltBug)
+  w.u16(cpu.interruptVector)
+  w.bool(cpu.midCycle)
+  w.u64(cpu.globalCounter)
+}
+
+func (cpu *Cpu) loadState(r *stateReader) {
+  for _, reg := range []*Register8{&cpu.A, &cpu.F, &cpu.B, &cpu.C, &cpu.D, &cpu.E, &cpu.H, &cpu.L} {
+    reg.write(r.u8())
+  }
+  cpu.PC.write(r.u16())
+  cpu.SP.write(r.u16())
+
+  full := r.u8()
+  cpu.CurrentOpcode = ByteToOpcode(full, r.bool())
+  n := r.u32()
+  if r.err == nil && n > FIFO_SIZE {
+    r.fail(fmt.Errorf("%w: %d micro-ops queued", ErrSaveStateFormat, n))
+  }
+  cpu.ExecutionQueue.Clear()
+  for i := uint32(0); i < n && r.err == nil; i++ {
+    name := r.string()
+    op, ok := microOps.lookup(name)
+    if !ok {
+      r.fail(fmt.Errorf("%w: unknown micro-op %q", ErrSaveStateFormat, name))
+      break
+    }
+    cpu.ExecutionQueue.Push(op)
+  }
+
+  cpu.IMECountdown = int8(r.u8())
+  cpu.IME = r.bool()
+  cpu.isHalted = r.bool()
+  cpu.isStopped = r.bool()
+  cpu.haltBug = r.bool()
+  cpu.interruptVector = r.u16()
+  cpu.midCycle = r.bool()
+  cpu.globalCounter = r.u64()
+}
+
+// SaveState snapshots the whole machine. It isn't safe to call while
+// Execute is running on another goroutine, use SaveStateSlot for that
+func (cpu *Cpu) SaveState() []byte {
+  w := &stateWriter{}
+  w.data = append(w.data, saveStateMagic...)
+  w.u16(SAVE_STATE_VERSION)
+  // which game this is for
+  header := cpu.Bus.header
+  w.string(header.Title)
+  w.u16(header.GlobalChecksum)
+  w.u8(uint8(cpu.model))
+
+  cpu.saveState(w)
+  cpu.Bus.saveState(w)
+  cpu.Bus.timers.saveState(w)
+  cpu.Bus.ppu.saveState(w)
+  cpu.Bus.apu.saveState(w)
+  cpu.Bus.joypad.saveState(w)
+  cpu.Bus.cartridge.saveState(w)
+  return w.data
+}
+
+// LoadState restores a snapshot from SaveState. On error the machine
+// is left as it was. Like SaveState it isn't safe to call while
+// Execute is running, see LoadStateSlot
+func (cpu *Cpu) LoadState(data []byte) error {
+  if len(data) < len(saveStateMagic) || string(data[:len(saveStateMagic)]) != string(saveStateMagic) {
+    return ErrSaveStateFormat
+  }
+  r := &stateReader{data: data[len(saveStateMagic):]}
+  if version := r.u16(); r.err == nil && version != SAVE_STATE_VERSION {
+    return fmt.Errorf("save state is version %d, this build reads version %d", version, SAVE_STATE_VERSION)
+  }
+  title := r.string()
+  checksum := r.u16()
+  model := Model(r.u8())
+  if r.err != nil {
+    return r.err
+  }
+  header := cpu.Bus.header
+  if title != header.Title || checksum != header.GlobalChecksum {
+    return fmt.Errorf("save state is for %q (checksum %04X), not %q (checksum %04X)", title, checksum, header.Title, header.GlobalChecksum)
+  }
+
+  // restore from this if the state turns out to be bad half way through
+  backup := cpu.SaveState()
+
+  cpu.loadState(r)
+  cpu.Bus.loadState(r)
+  cpu.Bus.timers.loadState(r)
+  cpu.Bus.ppu.loadState(r)
+  cpu.Bus.apu.loadState(r)
+  cpu.Bus.joypad.loadState(r)
+  cpu.Bus.cartridge.loadState(r)
+  if r.err == nil && len(r.data) != 0 {
+    r.fail(fmt.Errorf("%w: %d bytes left over", ErrSaveStateFormat, len(r.data)))
+  }
+  if r.err != nil {
+    if err := cpu.LoadState(backup); err != nil {
+      panic(fmt.Sprintf("couldn't restore the machine after a bad save state: %v", err))
+    }
+    return r.err
+  }
+  cpu.model = model
+  return nil
+}
+
+// e.g. data/Zelda.gb, 1 -> data/Zelda.ss1
+func SaveStatePath(romFilePath string, slot int) string {
+  return fmt.Sprintf("%s.ss%d", strings.TrimSuffix(romFilePath, filepath.Ext(romFilePath)), slot)
+}
+
+// SaveStateSlot writes a save state to the numbered slot next to the
+// ROM and returns its path. Safe to call from any goroutine but the
+// one running Execute: it waits for the emulator to finish the
+// current M-cycle
+func (cpu *Cpu) SaveStateSlot(slot int) (string, error) {
+  var data []byte
+  cpu.betweenCycles(func() {
+    data = cpu.SaveState()
+  })
+
+  path := SaveStatePath(cpu.Bus.romFilePath, slot)
+  // write + rename like the .sav file, so a crash can't leave half a state
+  if err := os.WriteFile(path + ".tmp", data, 0644); err != nil {
+    return "", err
+  }
+  return path, os.Rename(path + ".tmp", path)
+}
+
+// LoadStateSlot restores the numbered slot saved by SaveStateSlot.
+// Same goroutine rules as SaveStateSlot
+func (cpu *Cpu) LoadStateSlot(slot int) (string, error) {
+  path := SaveStatePath(cpu.Bus.romFilePath, slot)
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return "", err
+  }
+  cpu.betweenCycles(func() {
+    err = cpu.LoadState(data)
+  })
+  if err != nil {
+    return "", fmt.Errorf("%s: %w", path, err)
+  }
+  return path, nil
+}
+
+// betweenCycles runs f on the goroutine running Execute, between two
+// M-cycles, and waits for it. if nothing is running it just runs f,
+// holding the lock so Execute can't start half way through
+func (cpu *Cpu) betweenCycles(f func()) {
+  cpu.tasksMu.Lock()
+  if !cpu.running {
+    defer cpu.tasksMu.Unlock()
+    f()
+    return
+  }
+  done := make(chan struct{})
+  cpu.tasks = append(cpu.tasks, func() {
+    f()
+    close(done)
+  })
+  cpu.hasTasks.Store(true)
+  cpu.tasksMu.Unlock()
+  <-done
+}
+
+// called from run, which sets cpu.running
+func (cpu *Cpu) runTasks() {
+  cpu.tasksMu.Lock()
+  tasks := cpu.tasks
+  cpu.tasks = nil
+  cpu.hasTasks.Store(false)
+  cpu.tasksMu.Unlock()
+  for _, task := range tasks {
+    task()
+  }
+}
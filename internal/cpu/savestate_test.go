@@ -0,0 +1,150 @@
+package cpu
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// a ROM-only cartridge that keeps incrementing its way through WRAM
+//   0150 LD HL, C000
+//   0153 INC (HL)
+//   0154 INC HL
+//   0155 LD A, H
+//   0156 CP D0
+//   0158 JR NZ, 0153
+//   015A JR 0150
+func writeTestROM(t *testing.T) string {
+  return writeROM(t, "savestate", map[uint16][]byte{
+    0x150: {0x21, 0x00, 0xC0, 0x34, 0x23, 0x7C, 0xFE, 0xD0, 0x20, 0xF9, 0x18, 0xF4},
+  })
+}
+
+// a 32KB ROM-only cartridge that jumps from 0100 to 0150, with code
+// placed at the given addresses. the title is name in capitals
+func writeROM(t testing.TB, name string, code map[uint16][]byte) string {
+  rom := make([]byte, 32*1024)
+  copy(rom[0x100:], []byte{0x00, 0xC3, 0x50, 0x01})
+  copy(rom[0x134:], strings.ToUpper(name))
+  for address, bytes := range code {
+    copy(rom[address:], bytes)
+  }
+
+  path := filepath.Join(t.TempDir(), name + ".gb")
+  if err := os.WriteFile(path, rom, 0644); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+func newGameBoyWithCode(t testing.TB, name string, code map[uint16][]byte) *Cpu {
+  path := writeROM(t, name, code)
+  gb, err := NewGameBoy(&path, "", DMG, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return gb
+}
+
+func newTestGameBoy(t *testing.T) *Cpu {
+  path := writeTestROM(t)
+  gb, err := NewGameBoy(&path, "", DMG, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return gb
+}
+
+func runCycles(gb *Cpu, n uint64) {
+  target := gb.globalCounter + n
+  gb.run(func(bool) bool {
+    return gb.globalCounter >= target
+  })
+}
+
+func TestSaveStateRoundTrip(t *testing.T) {
+  gb := newTestGameBoy(t)
+
+  // stop part way through an instruction, so there are micro-ops queued
+  runCycles(gb, 3 * CYCLES_PER_FRAME)
+  for gb.ExecutionQueue.Length() == 0 {
+    runCycles(gb, 1)
+  }
+  state := gb.SaveState()
+
+  runCycles(gb, 2 * CYCLES_PER_FRAME)
+  want := gb.SaveState()
+
+  if err := gb.LoadState(state); err != nil {
+    t.Fatal(err)
+  }
+  if got := gb.SaveState(); !bytes.Equal(got, state) {
+    t.Fatal("saving straight after loading gave a different state")
+  }
+  runCycles(gb, 2 * CYCLES_PER_FRAME)
+  if got := gb.SaveState(); !bytes.Equal(got, want) {
+    t.Error("running on from a loaded state went somewhere else")
+  }
+}
+
+func TestLoadStateRejectsBadStates(t *testing.T) {
+  gb := newTestGameBoy(t)
+  runCycles(gb, CYCLES_PER_FRAME)
+  state := gb.SaveState()
+  runCycles(gb, CYCLES_PER_FRAME)
+  before := gb.SaveState()
+
+  tests := map[string][]byte{
+    "empty": nil,
+    "not a state": []byte("hello"),
+    "truncated": state[:len(state) - 100],
+    "trailing bytes": append(append([]byte(nil), state...), 0x00),
+  }
+  other := append([]byte(nil), state...)
+  // first letter of the title
+  other[len(saveStateMagic) + 2 + 4] = 'X'
+  tests["other ROM"] = other
+
+  for name, data := range tests {
+    if err := gb.LoadState(data); err == nil {
+      t.Errorf("%s: loaded", name)
+    }
+    if !bytes.Equal(gb.SaveState(), before) {
+      t.Errorf("%s: machine changed by a failed load", name)
+    }
+  }
+}
+
+func TestSaveStateSlotWhileRunning(t *testing.T) {
+  gb := newTestGameBoy(t)
+
+  done := make(chan error)
+  go func() {
+    _, err := gb.RunUntil(RunLimits{Frames: 30})
+    done <- err
+  }()
+  for running := false; !running; {
+    gb.tasksMu.Lock()
+    running = gb.running
+    gb.tasksMu.Unlock()
+  }
+
+  path, err := gb.SaveStateSlot(3)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if filepath.Base(path) != "savestate.ss3" {
+    t.Errorf("saved to %s", path)
+  }
+  if _, err := gb.LoadStateSlot(3); err != nil {
+    t.Fatal(err)
+  }
+  if err := <-done; err != nil {
+    t.Fatal(err)
+  }
+  if _, err := gb.LoadStateSlot(4); err == nil {
+    t.Error("loaded an empty slot")
+  }
+}
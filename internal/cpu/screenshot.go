@@ -0,0 +1,85 @@
+package cpu
+
+import (
+  "fmt"
+  "image"
+  "image/color"
+  "image/png"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+const (
+  SCREEN_WIDTH = 160
+  SCREEN_HEIGHT = 144
+)
+
+// DisplayPalette is what shades 0-3 look like on screen, lightest first.
+// the window and screenshots both use it
+var DisplayPalette = color.Palette{
+  color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+  color.RGBA{0xAA, 0xAA, 0xAA, 0xFF},
+  color.RGBA{0x55, 0x55, 0x55, 0xFF},
+  color.RGBA{0x00, 0x00, 0x00, 0xFF},
+}
+
+// ScreenImage is the last rendered frame as a 160x144 image
+func (cpu *Cpu) ScreenImage() *image.Paletted {
+  return cpu.scaledScreenImage(1)
+}
+
+// each pixel becomes a scale x scale block
+func (cpu *Cpu) scaledScreenImage(scale int) *image.Paletted {
+  screen := cpu.Screen()
+  img := image.NewPaletted(image.Rect(0, 0, SCREEN_WIDTH * scale, SCREEN_HEIGHT * scale), DisplayPalette)
+  for y := 0; y < SCREEN_HEIGHT * scale; y++ {
+    row := img.Pix[y * img.Stride:]
+    for x := 0; x < SCREEN_WIDTH * scale; x++ {
+      row[x] = screen[(y / scale) * SCREEN_WIDTH + x / scale] & 0x03
+    }
+  }
+  return img
+}
+
+// WriteScreenshot encodes the last rendered frame as a PNG, scaled
+// up by an integer factor
+func (cpu *Cpu) WriteScreenshot(w io.Writer, scale int) error {
+  if scale < 1 {
+    return fmt.Errorf("screenshot scale must be at least 1, got %d", scale)
+  }
+  return png.Encode(w, cpu.scaledScreenImage(scale))
+}
+
+// SaveScreenshot writes the last rendered frame to a timestamped PNG
+// next to the ROM and returns its path
+func (cpu *Cpu) SaveScreenshot(scale int) (string, error) {
+  path := uniquePath(timestampedPath(cpu.Bus.romFilePath, ".png"))
+  f, err := os.Create(path)
+  if err != nil {
+    return "", err
+  }
+  if err := cpu.WriteScreenshot(f, scale); err != nil {
+    f.Close()
+    os.Remove(path)
+    return "", err
+  }
+  return path, f.Close()
+}
+
+// timestamps only go down to the second, so number any
+// more screenshots taken in the same second
+func uniquePath(path string) string {
+  if _, err := os.Stat(path); os.IsNotExist(err) {
+    return path
+  }
+  ext := filepath.Ext(path)
+  base := strings.TrimSuffix(path, ext)
+  for i := 2; ; i++ {
+    candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+    if _, err := os.Stat(candidate); os.IsNotExist(err) {
+      return candidate
+    }
+  }
+}
@@ -0,0 +1,83 @@
+package cpu
+
+import (
+  "bytes"
+  "image/png"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestWriteScreenshot(t *testing.T) {
+  gb := newTestGameBoy(t)
+  screen := &gb.Bus.ppu.screen
+  // one pixel of each shade along the top, and the bottom right corner
+  for x := 0; x < 4; x++ {
+    screen[x] = uint8(x)
+  }
+  screen[SCREEN_WIDTH * SCREEN_HEIGHT - 1] = 3
+
+  for _, scale := range []int{1, 3} {
+    var buf bytes.Buffer
+    if err := gb.WriteScreenshot(&buf, scale); err != nil {
+      t.Fatal(err)
+    }
+    img, err := png.Decode(&buf)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if size := img.Bounds().Size(); size.X != SCREEN_WIDTH * scale || size.Y != SCREEN_HEIGHT * scale {
+      t.Errorf("scale %d: image is %dx%d", scale, size.X, size.Y)
+      continue
+    }
+
+    // every pixel in a block is the same shade as the one it came from
+    for x := 0; x < 4 * scale; x++ {
+      for y := 0; y < scale; y++ {
+        if got, want := img.At(x, y), DisplayPalette[x / scale]; got != want {
+          t.Errorf("scale %d: %d,%d is %v, want %v", scale, x, y, got, want)
+        }
+      }
+    }
+    if got, want := img.At(4 * scale, 0), DisplayPalette[0]; got != want {
+      t.Errorf("scale %d: %d,0 is %v, want %v", scale, 4 * scale, got, want)
+    }
+    right, bottom := SCREEN_WIDTH * scale - 1, SCREEN_HEIGHT * scale - 1
+    if got, want := img.At(right - scale + 1, bottom - scale + 1), DisplayPalette[3]; got != want {
+      t.Errorf("scale %d: bottom right block is %v, want %v", scale, got, want)
+    }
+    if got, want := img.At(right - scale, bottom), DisplayPalette[0]; got != want {
+      t.Errorf("scale %d: left of the bottom right block is %v, want %v", scale, got, want)
+    }
+  }
+
+  for _, scale := range []int{0, -1} {
+    var buf bytes.Buffer
+    if err := gb.WriteScreenshot(&buf, scale); err == nil {
+      t.Errorf("wrote a screenshot at scale %d", scale)
+    }
+    if buf.Len() != 0 {
+      t.Errorf("scale %d: wrote %d bytes", scale, buf.Len())
+    }
+  }
+}
+
+func TestUniquePath(t *testing.T) {
+  dir := t.TempDir()
+  path := filepath.Join(dir, "shot.png")
+  if got := uniquePath(path); got != path {
+    t.Errorf("got %s for a new file", got)
+  }
+
+  // each screenshot taken in the same second gets the next number
+  taken := path
+  for _, want := range []string{"shot-2.png", "shot-3.png"} {
+    if err := os.WriteFile(taken, nil, 0644); err != nil {
+      t.Fatal(err)
+    }
+    taken = uniquePath(path)
+    if taken != filepath.Join(dir, want) {
+      t.Errorf("got %s, want %s", taken, want)
+    }
+  }
+}
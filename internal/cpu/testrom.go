@@ -0,0 +1,177 @@
+package cpu
+
+import (
+  "bytes"
+  "fmt"
+  "strings"
+)
+
+// Test ROMs report their results in a few different ways:
+//  - blargg's print "Passed" or "Failed" over the serial port
+//  - newer blargg ROMs also write a signature + result to cartridge RAM:
+//    0xDE 0xB0 0x61 at 0xA001-0xA003, a status at 0xA000 (0x80 while
+//    running, 0x00 on success, otherwise a failure code) and a
+//    null-terminated message from 0xA004
+//  - mooneye's run LD B,B as a breakpoint, with the Fibonacci numbers
+//    3/5/8/13/21/34 in B/C/D/E/H/L on success and 0x42 in all of them
+//    on failure
+// https://github.com/retrio/gb-test-roms
+// https://github.com/Gekkio/mooneye-test-suite#passfail-reporting
+
+type TestROMStatus int
+
+const (
+  TEST_PASS TestROMStatus = iota
+  TEST_FAIL
+  TEST_TIMEOUT
+  TEST_ERROR
+)
+
+func (s TestROMStatus) String() string {
+  switch s {
+  case TEST_PASS:
+    return "PASS"
+  case TEST_FAIL:
+    return "FAIL"
+  case TEST_TIMEOUT:
+    return "TIMEOUT"
+  case TEST_ERROR:
+    return "ERROR"
+  default:
+    return "unknown"
+  }
+}
+
+type TestROMResult struct {
+  Status TestROMStatus
+  // which protocol reported the result: serial, memory or mooneye
+  Protocol string
+  // whatever the ROM printed or wrote, or the error
+  Message string
+  Cycles uint64
+}
+
+var blarggSignature = []uint8{0xDE, 0xB0, 0x61}
+var mooneyePass = [6]uint8{3, 5, 8, 13, 21, 34}
+var mooneyeFail = [6]uint8{0x42, 0x42, 0x42, 0x42, 0x42, 0x42}
+
+// LD B,B
+const MOONEYE_BREAKPOINT = 0x40
+
+// RunTestROM runs until the ROM reports a result by any of the above,
+// or until maxFrames frames have gone by
+func (cpu *Cpu) RunTestROM(maxFrames uint64) (result TestROMResult) {
+  defer func() {
+    if r := recover(); r != nil {
+      result = TestROMResult{
+        Status: TEST_ERROR,
+        Message: fmt.Sprintf("emulator crashed at PC %04X: %v", cpu.PC.read(), r),
+      }
+    }
+    result.Cycles = cpu.globalCounter
+  }()
+
+  fast := cpu.fast
+  cpu.fast = true
+  defer func() { cpu.fast = fast }()
+
+  result.Status = TEST_TIMEOUT
+  start := cpu.globalCounter
+  serialChecked := len(cpu.serialOutput)
+
+  cpu.run(func(instructionBoundary bool) bool {
+    if len(cpu.serialOutput) != serialChecked {
+      serialChecked = len(cpu.serialOutput)
+      if r, ok := cpu.checkBlarggSerial(); ok {
+        result = r
+        return true
+      }
+    }
+
+    if instructionBoundary && cpu.CurrentOpcode.Full == MOONEYE_BREAKPOINT && !cpu.CurrentOpcode.Prefixed {
+      if r, ok := cpu.checkMooneye(); ok {
+        result = r
+        return true
+      }
+    }
+
+    elapsed := cpu.globalCounter - start
+    // cartridge RAM doesn't change often, once a frame is plenty
+    if elapsed % CYCLES_PER_FRAME == 0 {
+      if r, ok := cpu.checkBlarggMemory(); ok {
+        result = r
+        return true
+      }
+    }
+    return elapsed >= maxFrames * CYCLES_PER_FRAME
+  })
+
+  if result.Status == TEST_TIMEOUT {
+    result.Message = string(cpu.serialOutput)
+  }
+  return result
+}
+
+func (cpu *Cpu) checkBlarggSerial() (TestROMResult, bool) {
+  output := string(cpu.serialOutput)
+  if strings.Contains(output, "Passed") {
+    return TestROMResult{Status: TEST_PASS, Protocol: "serial", Message: output}, true
+  }
+  if strings.Contains(output, "Failed") {
+    return TestROMResult{Status: TEST_FAIL, Protocol: "serial", Message: output}, true
+  }
+  return TestROMResult{}, false
+}
+
+func (cpu *Cpu) checkBlarggMemory() (TestROMResult, bool) {
+  cartridge := cpu.Bus.cartridge
+  if !cpu.Bus.header.HasRAM() {
+    return TestROMResult{}, false
+  }
+  for i, b := range blarggSignature {
+    if cartridge.read(0xA001 + uint16(i)) != b {
+      return TestROMResult{}, false
+    }
+  }
+  status := cartridge.read(0xA000)
+  if status == 0x80 {
+    return TestROMResult{}, false
+  }
+
+  var message []byte
+  for address := uint16(0xA004); address <= 0xBFFF; address++ {
+    c := cartridge.read(address)
+    if c == 0 {
+      break
+    }
+    message = append(message, c)
+  }
+
+  result := TestROMResult{Status: TEST_PASS, Protocol: "memory", Message: string(message)}
+  if status != 0x00 {
+    result.Status = TEST_FAIL
+    result.Message = fmt.Sprintf("result code %02X: %s", status, message)
+  }
+  return result, true
+}
+
+func (cpu *Cpu) checkMooneye() (TestROMResult, bool) {
+  registers := [6]uint8{cpu.B.read(), cpu.C.read(), cpu.D.read(), cpu.E.read(), cpu.H.read(), cpu.L.read()}
+  switch registers {
+  case mooneyePass:
+    return TestROMResult{Status: TEST_PASS, Protocol: "mooneye"}, true
+  case mooneyeFail:
+    return TestROMResult{Status: TEST_FAIL, Protocol: "mooneye"}, true
+  }
+  // some ROMs use LD B,B for other things, keep going
+  return TestROMResult{}, false
+}
+
+// trims what the ROM printed down to something that fits on a line
+func (r TestROMResult) Summary() string {
+  message := strings.Join(strings.Fields(string(bytes.ToValidUTF8([]byte(r.Message), nil))), " ")
+  if len(message) > 60 {
+    message = "..." + message[len(message)-57:]
+  }
+  return message
+}
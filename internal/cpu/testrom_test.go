@@ -0,0 +1,71 @@
+package cpu
+
+import (
+  "flag"
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "text/tabwriter"
+)
+
+// e.g. go test ./internal/cpu -run TestROMs -roms ../gameboy_resources/gb-test-roms
+// or set GAMEBOY_TEST_ROMS. skipped if neither is set
+var romDir = flag.String("roms", os.Getenv("GAMEBOY_TEST_ROMS"), "directory of blargg/mooneye test ROMs, searched recursively")
+var romFrames = flag.Uint64("rom-frames", 3600, "frames to give each test ROM before timing out")
+
+func TestROMs(t *testing.T) {
+  if *romDir == "" {
+    t.Skip("no test ROM directory, set -roms or GAMEBOY_TEST_ROMS")
+  }
+
+  var roms []string
+  err := filepath.WalkDir(*romDir, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    if !d.IsDir() && (strings.HasSuffix(path, ".gb") || strings.HasSuffix(path, ".gbc")) {
+      roms = append(roms, path)
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(roms) == 0 {
+    t.Fatalf("no ROMs in %s", *romDir)
+  }
+
+  results := make([]TestROMResult, len(roms))
+  for i, rom := range roms {
+    name, _ := filepath.Rel(*romDir, rom)
+    t.Run(name, func(t *testing.T) {
+      path := rom
+      gb, err := NewGameBoy(&path, "", DMG, true)
+      if err != nil {
+        results[i] = TestROMResult{Status: TEST_ERROR, Message: err.Error()}
+      } else {
+        results[i] = gb.RunTestROM(*romFrames)
+      }
+      if results[i].Status != TEST_PASS {
+        t.Errorf("%s: %s", results[i].Status, results[i].Summary())
+      }
+    })
+  }
+
+  var sb strings.Builder
+  w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(w, "ROM\tRESULT\tPROTOCOL\tCYCLES\tOUTPUT")
+  passed := 0
+  for i, rom := range roms {
+    name, _ := filepath.Rel(*romDir, rom)
+    fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", name, results[i].Status, results[i].Protocol, results[i].Cycles, results[i].Summary())
+    if results[i].Status == TEST_PASS {
+      passed++
+    }
+  }
+  w.Flush()
+  t.Logf("%d/%d test ROMs passed\n%s", passed, len(roms), sb.String())
+}
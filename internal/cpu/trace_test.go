@@ -0,0 +1,47 @@
+package cpu
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestTrace(t *testing.T) {
+  gb := newTestGameBoy(t)
+  path := filepath.Join(t.TempDir(), "trace.log")
+  if err := gb.StartTrace(path); err != nil {
+    t.Fatal(err)
+  }
+  if ly := gb.mem.ReadFromBus(LY); ly != 0x90 {
+    t.Errorf("LY reads %02X while tracing", ly)
+  }
+  runCycles(gb, 100)
+  if err := gb.StopTrace(); err != nil {
+    t.Fatal(err)
+  }
+
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+  // F is 80 not B0 because the test ROM's header checksum is 0
+  for i, want := range []string{
+    "A:01 F:80 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0100 PCMEM:00,C3,50,01",
+    "A:01 F:80 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0101 PCMEM:C3,50,01,00",
+    "A:01 F:80 B:00 C:13 D:00 E:D8 H:01 L:4D SP:FFFE PC:0150 PCMEM:21,00,C0,34",
+    "A:01 F:80 B:00 C:13 D:00 E:D8 H:C0 L:00 SP:FFFE PC:0153 PCMEM:34,23,7C,FE",
+  } {
+    if i >= len(lines) || lines[i] != want {
+      t.Fatalf("line %d:\n got %q\nwant %q", i, lines[i], want)
+    }
+  }
+  // run a bit, and as many lines as instructions
+  if len(lines) < 20 {
+    t.Errorf("%d lines in 100 cycles", len(lines))
+  }
+  if ly := gb.mem.ReadFromBus(LY); ly == 0x90 {
+    t.Errorf("LY still stubbed after the trace stopped")
+  }
+}
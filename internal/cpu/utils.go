@@ -32,20 +32,48 @@ func GetBitBool(value uint8, bitNum uint8) bool {
     }
 }
 
+// FIFO_SIZE is how much a Fifo holds, a power of 2 so the indices can
+// wrap with a mask. nothing queues more than 8 pixels, or one
+// instruction's micro-ops, at most 6 for CALL. interrupt dispatch
+// waits for an empty queue, see TestExecutionQueueHeadroom
+const FIFO_SIZE = 16
+
+// Fifo is a fixed size ring buffer, so pushing and popping never
+// allocate
 type Fifo[T any] struct {
-  values []T
+  values [FIFO_SIZE]T
+  head int
+  length int
 }
 
 func (fifo *Fifo[T]) Push(val T) {
-  fifo.values = append(fifo.values, val)
+  if fifo.length == FIFO_SIZE {
+    panic("Fifo is full")
+  }
+  fifo.values[(fifo.head + fifo.length) & (FIFO_SIZE - 1)] = val
+  fifo.length++
 }
 
 func (fifo *Fifo[T]) Pop() T {
-  x, a := fifo.values[0], fifo.values[1:]
-  fifo.values = a
+  if fifo.length == 0 {
+    panic("Pop from an empty Fifo")
+  }
+  x := fifo.values[fifo.head]
+  fifo.head = (fifo.head + 1) & (FIFO_SIZE - 1)
+  fifo.length--
   return x
 }
 
+// At is the i'th value from the front, without popping it
+func (fifo *Fifo[T]) At(i int) T {
+  return fifo.values[(fifo.head + i) & (FIFO_SIZE - 1)]
+}
+
+func (fifo *Fifo[T]) Clear() {
+  fifo.head = 0
+  fifo.length = 0
+}
+
 func (fifo *Fifo[T]) Length() int {
-  return len(fifo.values)
+  return fifo.length
 }
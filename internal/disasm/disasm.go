@@ -0,0 +1,124 @@
+package disasm
+
+import (
+  "fmt"
+  "strings"
+)
+
+// Disassembler for the SM83. opcodes are split into fields the same way
+// the cpu package decodes them (https://gb-archive.github.io/salvage/decoding_gbz80_opcodes/Decoding%20Gamboy%20Z80%20opcodes.htm):
+//   x = bits 7-6, y = bits 5-3, z = bits 2-0, p = y >> 1, q = y & 1
+// and the mnemonics are the usual ones, with (HL) style memory operands.
+// see Opcodes for the table it's all decoded from
+
+var (
+  r = []string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+  rp = []string{"BC", "DE", "HL", "SP"}
+  rp2 = []string{"BC", "DE", "HL", "AF"}
+  cc = []string{"NZ", "Z", "NC", "C"}
+  alu = []string{"ADD A,", "ADC A,", "SUB ", "SBC A,", "AND ", "XOR ", "OR ", "CP "}
+  rot = []string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SWAP", "SRL"}
+  x0z7 = []string{"RLCA", "RRCA", "RLA", "RRA", "DAA", "CPL", "SCF", "CCF"}
+)
+
+type Instruction struct {
+  Address uint16
+  Bytes []byte
+  // e.g. "LD A,(HL+)", or "DB $D3" for an opcode the SM83 doesn't have
+  Mnemonic string
+  Illegal bool
+
+  // where a jump, call or absolute memory operand points, so it
+  // can be swapped for a symbol
+  Target uint16
+  HasTarget bool
+  // the operand Target came from, as it appears in Mnemonic
+  targetText string
+}
+
+func (i Instruction) Length() int {
+  return len(i.Bytes)
+}
+
+func (i Instruction) String() string {
+  return i.Mnemonic
+}
+
+// WithSymbols is the mnemonic with the target replaced by its symbol,
+// if symbols has one. bank is the ROM bank the instruction is in
+func (i Instruction) WithSymbols(symbols *Symbols, bank int) string {
+  if !i.HasTarget || symbols == nil {
+    return i.Mnemonic
+  }
+  name, ok := symbols.Name(bank, i.Target)
+  if !ok {
+    return i.Mnemonic
+  }
+  return strings.Replace(i.Mnemonic, i.targetText, name, 1)
+}
+
+// Decode disassembles the instruction at address, reading its bytes
+// through read
+func Decode(read func(uint16) uint8, address uint16) Instruction {
+  inst := Instruction{Address: address}
+  next := func() uint8 {
+    b := read(address + uint16(len(inst.Bytes)))
+    inst.Bytes = append(inst.Bytes, b)
+    return b
+  }
+  // a16 operands etc., which symbols can stand in for
+  target := func(value uint16, text string) string {
+    inst.Target, inst.HasTarget, inst.targetText = value, true, text
+    return text
+  }
+
+  op := next()
+  if op == 0xCB {
+    inst.Mnemonic = CBOpcodes[next()].Mnemonic
+    return inst
+  }
+  info := Opcodes[op]
+  inst.Illegal = info.Illegal
+
+  placeholder, text := "", ""
+  switch info.Operand {
+  case OPERAND_N8:
+    placeholder, text = "n8", fmt.Sprintf("$%02X", next())
+  case OPERAND_N16:
+    lo := next()
+    hi := next()
+    placeholder, text = "n16", fmt.Sprintf("$%04X", uint16(hi) << 8 | uint16(lo))
+  case OPERAND_A8:
+    offset := next()
+    placeholder, text = "a8", target(0xFF00 + uint16(offset), fmt.Sprintf("$%02X", offset))
+  case OPERAND_A16:
+    lo := next()
+    hi := next()
+    value := uint16(hi) << 8 | uint16(lo)
+    placeholder, text = "a16", target(value, fmt.Sprintf("$%04X", value))
+  case OPERAND_E8:
+    offset := next()
+    placeholder, text = "e8", target(address + 2 + uint16(int8(offset)), fmt.Sprintf("$%02X", offset))
+  case OPERAND_SP_E8:
+    // signed, which reads better with the sign written out
+    offset := int8(next())
+    placeholder, text = "+e8", fmt.Sprintf("+$%02X", offset)
+    if offset < 0 {
+      text = fmt.Sprintf("-$%02X", -int(offset))
+    }
+    if !strings.Contains(info.Mnemonic, placeholder) {
+      placeholder = "e8"
+    }
+  }
+  inst.Mnemonic = info.Mnemonic
+  if placeholder != "" {
+    inst.Mnemonic = strings.Replace(info.Mnemonic, placeholder, text, 1)
+  }
+
+  // RST's vector is in the opcode
+  if op & 0xC7 == 0xC7 {
+    vector := uint16(op & 0x38)
+    target(vector, fmt.Sprintf("$%02X", vector))
+  }
+  return inst
+}
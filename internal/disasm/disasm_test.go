@@ -0,0 +1,122 @@
+package disasm
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func decodeBytes(address uint16, code ...byte) Instruction {
+  return Decode(func(a uint16) uint8 {
+    if i := int(a - address); i < len(code) {
+      return code[i]
+    }
+    return 0
+  }, address)
+}
+
+func TestDecode(t *testing.T) {
+  tests := []struct {
+    code []byte
+    want string
+  }{
+    {[]byte{0x00}, "NOP"},
+    {[]byte{0x08, 0x34, 0x12}, "LD ($1234),SP"},
+    {[]byte{0x10, 0x00}, "STOP $00"},
+    {[]byte{0x20, 0xFE}, "JR NZ,$FE"},
+    {[]byte{0x18, 0x05}, "JR $05"},
+    {[]byte{0x21, 0x00, 0xC0}, "LD HL,$C000"},
+    {[]byte{0x39}, "ADD HL,SP"},
+    {[]byte{0x2A}, "LD A,(HL+)"},
+    {[]byte{0x32}, "LD (HL-),A"},
+    {[]byte{0x0B}, "DEC BC"},
+    {[]byte{0x34}, "INC (HL)"},
+    {[]byte{0x3E, 0x3F}, "LD A,$3F"},
+    {[]byte{0x27}, "DAA"},
+    {[]byte{0x76}, "HALT"},
+    {[]byte{0x78}, "LD A,B"},
+    {[]byte{0x9E}, "SBC A,(HL)"},
+    {[]byte{0xAF}, "XOR A"},
+    {[]byte{0xC8}, "RET Z"},
+    {[]byte{0xE0, 0x44}, "LDH ($44),A"},
+    {[]byte{0xE8, 0xFE}, "ADD SP,-$02"},
+    {[]byte{0xF8, 0x02}, "LD HL,SP+$02"},
+    {[]byte{0xF1}, "POP AF"},
+    {[]byte{0xD9}, "RETI"},
+    {[]byte{0xE9}, "JP HL"},
+    {[]byte{0xDA, 0x50, 0x01}, "JP C,$0150"},
+    {[]byte{0xE2}, "LD (C),A"},
+    {[]byte{0xFA, 0x00, 0xD0}, "LD A,($D000)"},
+    {[]byte{0xF3}, "DI"},
+    {[]byte{0xC4, 0x00, 0x40}, "CALL NZ,$4000"},
+    {[]byte{0xCD, 0x00, 0x40}, "CALL $4000"},
+    {[]byte{0xC5}, "PUSH BC"},
+    {[]byte{0xFE, 0x90}, "CP $90"},
+    {[]byte{0xFF}, "RST $38"},
+    {[]byte{0xCB, 0x7C}, "BIT 7,H"},
+    {[]byte{0xCB, 0x37}, "SWAP A"},
+    {[]byte{0xCB, 0x86}, "RES 0,(HL)"},
+    {[]byte{0xCB, 0xFF}, "SET 7,A"},
+    {[]byte{0xD3}, "DB $D3"},
+  }
+  for _, test := range tests {
+    inst := decodeBytes(0x0150, test.code...)
+    if inst.Mnemonic != test.want || inst.Length() != len(test.code) {
+      t.Errorf("% X: got %q (%d bytes), want %q (%d bytes)", test.code, inst.Mnemonic, inst.Length(), test.want, len(test.code))
+    }
+  }
+}
+
+func TestDecodeEveryOpcode(t *testing.T) {
+  illegal := map[byte]bool{0xD3: true, 0xDB: true, 0xDD: true, 0xE3: true, 0xE4: true, 0xEB: true, 0xEC: true, 0xED: true, 0xF4: true, 0xFC: true, 0xFD: true}
+  for op := 0; op < 0x100; op++ {
+    inst := decodeBytes(0, byte(op))
+    if inst.Mnemonic == "" || inst.Illegal != illegal[byte(op)] {
+      t.Errorf("%02X: %q, illegal %t", op, inst.Mnemonic, inst.Illegal)
+    }
+    if info := Opcodes[op]; op != 0xCB && (info.Length != inst.Length() || !info.Illegal && info.Cycles == 0) {
+      t.Errorf("%02X: %d bytes, %d cycles in the table", op, info.Length, info.Cycles)
+    }
+    if cb := decodeBytes(0, 0xCB, byte(op)); cb.Mnemonic == "" || cb.Length() != 2 {
+      t.Errorf("CB %02X: %q", op, cb.Mnemonic)
+    }
+  }
+}
+
+func TestSymbols(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "game.sym")
+  sym := "; made by rgblink\n00:0150 Main\n01:4000 BankOne\n02:4000 BankTwo\n00:C000 wCounter ; in WRAM\n"
+  if err := os.WriteFile(path, []byte(sym), 0644); err != nil {
+    t.Fatal(err)
+  }
+  symbols, err := LoadSymbols(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // JR back to the top of Main
+  jr := decodeBytes(0x0155, 0x18, 0xF9)
+  if got := jr.WithSymbols(symbols, 0); got != "JR Main" {
+    t.Errorf("got %q", got)
+  }
+  call := decodeBytes(0x0150, 0xCD, 0x00, 0x40)
+  if got := call.WithSymbols(symbols, 2); got != "CALL BankTwo" {
+    t.Errorf("bank 2: got %q", got)
+  }
+  if got := call.WithSymbols(symbols, 3); got != "CALL $4000" {
+    t.Errorf("bank 3: got %q", got)
+  }
+  load := decodeBytes(0x0150, 0xEA, 0x00, 0xC0)
+  if got := load.WithSymbols(symbols, 5); got != "LD (wCounter),A" {
+    t.Errorf("got %q", got)
+  }
+
+  if bank, address, ok := symbols.Address("BankOne"); !ok || bank != 1 || address != 0x4000 {
+    t.Errorf("BankOne at %02X:%04X", bank, address)
+  }
+
+  os.WriteFile(path, []byte("0150 Main\n"), 0644)
+  if _, err := LoadSymbols(path); err == nil {
+    t.Error("loaded a line with no bank")
+  }
+}
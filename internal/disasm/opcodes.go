@@ -0,0 +1,235 @@
+package disasm
+
+import (
+  "fmt"
+)
+
+// Opcode is everything about an opcode that doesn't depend on where it
+// is: the mnemonic with a lowercase placeholder for its operand, e.g.
+// "LD A,n8" or "JR NZ,e8", its length and how long it takes. the cpu
+// package builds its instruction table from these too
+type Opcode struct {
+  Mnemonic string
+  Operand Operand
+  // in bytes, CB and all for the CB opcodes
+  Length int
+  // M-cycles, fetch included. conditional jumps, calls and returns
+  // take CyclesNotTaken when the condition fails
+  Cycles int
+  CyclesNotTaken int
+  // D3 DB DD E3 E4 EB EC ED F4 FC FD lock up the CPU
+  Illegal bool
+}
+
+// Operand is the kind of operand an opcode has, and the placeholder
+// for it in the mnemonic
+type Operand int
+
+const (
+  OPERAND_NONE Operand = iota
+  // n8
+  OPERAND_N8
+  // n16
+  OPERAND_N16
+  // a8, LDH's offset into FF00-FFFF
+  OPERAND_A8
+  // a16
+  OPERAND_A16
+  // e8, JR's offset from the end of the instruction
+  OPERAND_E8
+  // e8, signed and added to SP
+  OPERAND_SP_E8
+)
+
+func (o Operand) length() int {
+  switch o {
+  case OPERAND_NONE:
+    return 0
+  case OPERAND_N16, OPERAND_A16:
+    return 2
+  default:
+    return 1
+  }
+}
+
+// Opcodes and CBOpcodes are indexed by the opcode byte, the CB ones by
+// the byte after CB
+var Opcodes, CBOpcodes [256]Opcode
+
+func init() {
+  for op := 0; op < 0x100; op++ {
+    Opcodes[op] = describe(uint8(op))
+    CBOpcodes[op] = describeCB(uint8(op))
+  }
+}
+
+func describeCB(op uint8) Opcode {
+  x, y, z := op >> 6, (op >> 3) & 7, op & 7
+  var m string
+  switch x {
+  case 0:
+    m = fmt.Sprintf("%s %s", rot[y], r[z])
+  case 1:
+    m = fmt.Sprintf("BIT %d,%s", y, r[z])
+  case 2:
+    m = fmt.Sprintf("RES %d,%s", y, r[z])
+  case 3:
+    m = fmt.Sprintf("SET %d,%s", y, r[z])
+  }
+  cycles := 2
+  if z == 6 {
+    // BIT only reads (HL), the rest write it back too
+    cycles = 4
+    if x == 1 {
+      cycles = 3
+    }
+  }
+  return Opcode{Mnemonic: m, Length: 2, Cycles: cycles, CyclesNotTaken: cycles}
+}
+
+func describe(op uint8) Opcode {
+  x, y, z := op >> 6, (op >> 3) & 7, op & 7
+  p, q := y >> 1, y & 1
+  var m string
+  operand := OPERAND_NONE
+  cycles, notTaken := 1, 0
+  // (HL) costs a cycle to read and another to write
+  hl := func(reg uint8, extra int) {
+    if reg == 6 {
+      cycles += extra
+    }
+  }
+
+  switch x {
+  case 0:
+    switch z {
+    case 0:
+      switch {
+      case y == 0:
+        m = "NOP"
+      case y == 1:
+        m, operand, cycles = "LD (a16),SP", OPERAND_A16, 5
+      case y == 2:
+        // STOP is followed by a byte the CPU skips
+        m, operand = "STOP n8", OPERAND_N8
+      case y == 3:
+        m, operand, cycles = "JR e8", OPERAND_E8, 3
+      default:
+        m, operand, cycles, notTaken = fmt.Sprintf("JR %s,e8", cc[y-4]), OPERAND_E8, 3, 2
+      }
+    case 1:
+      if q == 0 {
+        m, operand, cycles = fmt.Sprintf("LD %s,n16", rp[p]), OPERAND_N16, 3
+      } else {
+        m, cycles = "ADD HL," + rp[p], 2
+      }
+    case 2:
+      memory := []string{"(BC)", "(DE)", "(HL+)", "(HL-)"}[p]
+      if q == 0 {
+        m = fmt.Sprintf("LD %s,A", memory)
+      } else {
+        m = "LD A," + memory
+      }
+      cycles = 2
+    case 3:
+      if q == 0 {
+        m = "INC " + rp[p]
+      } else {
+        m = "DEC " + rp[p]
+      }
+      cycles = 2
+    case 4:
+      m = "INC " + r[y]
+      hl(y, 2)
+    case 5:
+      m = "DEC " + r[y]
+      hl(y, 2)
+    case 6:
+      m, operand, cycles = fmt.Sprintf("LD %s,n8", r[y]), OPERAND_N8, 2
+      hl(y, 1)
+    case 7:
+      m = x0z7[y]
+    }
+  case 1:
+    if y == 6 && z == 6 {
+      m = "HALT"
+    } else {
+      m = fmt.Sprintf("LD %s,%s", r[y], r[z])
+      hl(y, 1)
+      hl(z, 1)
+    }
+  case 2:
+    m = alu[y] + r[z]
+    hl(z, 1)
+  case 3:
+    switch z {
+    case 0:
+      switch {
+      case y < 4:
+        m, cycles, notTaken = "RET " + cc[y], 5, 2
+      case y == 4:
+        m, operand, cycles = "LDH (a8),A", OPERAND_A8, 3
+      case y == 5:
+        m, operand, cycles = "ADD SP,e8", OPERAND_SP_E8, 4
+      case y == 6:
+        m, operand, cycles = "LDH A,(a8)", OPERAND_A8, 3
+      case y == 7:
+        m, operand, cycles = "LD HL,SP+e8", OPERAND_SP_E8, 3
+      }
+    case 1:
+      if q == 0 {
+        m, cycles = "POP " + rp2[p], 3
+      } else {
+        m = []string{"RET", "RETI", "JP HL", "LD SP,HL"}[p]
+        cycles = []int{4, 4, 1, 2}[p]
+      }
+    case 2:
+      switch {
+      case y < 4:
+        m, operand, cycles, notTaken = fmt.Sprintf("JP %s,a16", cc[y]), OPERAND_A16, 4, 3
+      case y == 4:
+        m, cycles = "LD (C),A", 2
+      case y == 5:
+        m, operand, cycles = "LD (a16),A", OPERAND_A16, 4
+      case y == 6:
+        m, cycles = "LD A,(C)", 2
+      case y == 7:
+        m, operand, cycles = "LD A,(a16)", OPERAND_A16, 4
+      }
+    case 3:
+      switch y {
+      case 0:
+        m, operand, cycles = "JP a16", OPERAND_A16, 4
+      case 1:
+        // only ever decoded along with the next byte, see CBOpcodes
+        m = "PREFIX CB"
+      case 6:
+        m = "DI"
+      case 7:
+        m = "EI"
+      }
+    case 4:
+      if y < 4 {
+        m, operand, cycles, notTaken = fmt.Sprintf("CALL %s,a16", cc[y]), OPERAND_A16, 6, 3
+      }
+    case 5:
+      if q == 0 {
+        m, cycles = "PUSH " + rp2[p], 4
+      } else if p == 0 {
+        m, operand, cycles = "CALL a16", OPERAND_A16, 6
+      }
+    case 6:
+      m, operand, cycles = alu[y] + "n8", OPERAND_N8, 2
+    case 7:
+      m, cycles = fmt.Sprintf("RST $%02X", y * 8), 4
+    }
+  }
+
+  if m == "" {
+    return Opcode{Mnemonic: fmt.Sprintf("DB $%02X", op), Length: 1, Illegal: true}
+  }
+  if notTaken == 0 {
+    notTaken = cycles
+  }
+  return Opcode{Mnemonic: m, Operand: operand, Length: 1 + operand.length(), Cycles: cycles, CyclesNotTaken: notTaken}
+}
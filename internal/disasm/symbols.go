@@ -0,0 +1,93 @@
+package disasm
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// Symbols are labels from a .sym file, the format RGBDS, BGB and no$gmb
+// all use: one "BB:AAAA Name" per line, ; for comments
+type Symbols struct {
+  names map[symbolKey]string
+  addresses map[string]symbolKey
+}
+
+type symbolKey struct {
+  bank int
+  address uint16
+}
+
+// e.g. data/Zelda.gb -> data/Zelda.sym
+func SymbolsPath(romFilePath string) string {
+  return strings.TrimSuffix(romFilePath, filepath.Ext(romFilePath)) + ".sym"
+}
+
+func LoadSymbols(path string) (*Symbols, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  symbols := &Symbols{names: make(map[symbolKey]string), addresses: make(map[string]symbolKey)}
+  scanner := bufio.NewScanner(file)
+  for line := 1; scanner.Scan(); line++ {
+    text, _, _ := strings.Cut(scanner.Text(), ";")
+    fields := strings.Fields(text)
+    if len(fields) == 0 {
+      continue
+    }
+    bankText, addressText, ok := strings.Cut(fields[0], ":")
+    if !ok || len(fields) != 2 {
+      return nil, fmt.Errorf("%s:%d: expected BB:AAAA Name", path, line)
+    }
+    bank, err := strconv.ParseUint(bankText, 16, 16)
+    if err != nil {
+      return nil, fmt.Errorf("%s:%d: bad bank %q", path, line, bankText)
+    }
+    address, err := strconv.ParseUint(addressText, 16, 16)
+    if err != nil {
+      return nil, fmt.Errorf("%s:%d: bad address %q", path, line, addressText)
+    }
+    symbols.add(int(bank), uint16(address), fields[1])
+  }
+  return symbols, scanner.Err()
+}
+
+func (s *Symbols) add(bank int, address uint16, name string) {
+  key := symbolKey{bankFor(bank, address), address}
+  // first label at an address wins, like the linker's output order
+  if _, ok := s.names[key]; !ok {
+    s.names[key] = name
+  }
+  s.addresses[name] = key
+}
+
+// only 4000-7FFF is told apart by bank. bank 0 is always at 0000-3FFF,
+// and on the DMG the rest only has the one bank that matters here
+func bankFor(bank int, address uint16) int {
+  if address >= 0x4000 && address <= 0x7FFF {
+    return bank
+  }
+  return 0
+}
+
+// Name is the label at address when bank is mapped at 4000-7FFF
+func (s *Symbols) Name(bank int, address uint16) (string, bool) {
+  name, ok := s.names[symbolKey{bankFor(bank, address), address}]
+  return name, ok
+}
+
+// Address is where the label is, and which bank it's in
+func (s *Symbols) Address(name string) (int, uint16, bool) {
+  key, ok := s.addresses[name]
+  return key.bank, key.address, ok
+}
+
+func (s *Symbols) Len() int {
+  return len(s.names)
+}
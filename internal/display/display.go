@@ -0,0 +1,176 @@
+package display
+
+import (
+  "log"
+  "sync/atomic"
+  "time"
+  "github.com/hajimehoshi/ebiten/v2"
+  "github.com/hajimehoshi/ebiten/v2/audio"
+  "github.com/hajimehoshi/ebiten/v2/inpututil"
+  "jfeintzeig/gameboy/internal/cpu"
+)
+
+var pixels [4]*ebiten.Image
+
+// save state slots 1-9
+var stateKeys = []ebiten.Key{
+  ebiten.KeyF1, ebiten.KeyF2, ebiten.KeyF3, ebiten.KeyF4, ebiten.KeyF5,
+  ebiten.KeyF6, ebiten.KeyF7, ebiten.KeyF8, ebiten.KeyF9,
+}
+
+func init() {
+  for shade, c := range cpu.DisplayPalette {
+    pixels[shade] = ebiten.NewImage(5,5)
+    pixels[shade].Fill(c)
+  }
+}
+
+type Game struct {
+  cpu *cpu.Cpu
+  keyboard map[string]ebiten.Key
+  player *audio.Player
+  rumbling atomic.Bool
+  gamepadIDs []ebiten.GamepadID
+
+  // whether the record hotkey also writes per-channel stems
+  RecordStems bool
+  // size of screenshot pixels
+  ScreenshotScale int
+  rewinding bool
+  // set from other goroutines to close the window, e.g. quitting the debugger
+  quit atomic.Bool
+}
+
+// Quit closes the window after the current frame. Safe from any goroutine
+func (g *Game) Quit() {
+  g.quit.Store(true)
+}
+
+func (g *Game) Update() error {
+  if g.quit.Load() {
+    return ebiten.Termination
+  }
+  for keyName, key := range g.keyboard {
+    g.cpu.SetKey(keyName, inpututil.IsKeyJustPressed(key), inpututil.IsKeyJustReleased(key))
+  }
+
+  // keep topping up the vibration while the cartridge's motor is on
+  if g.rumbling.Load() {
+    g.gamepadIDs = ebiten.AppendGamepadIDs(g.gamepadIDs[:0])
+    for _, id := range g.gamepadIDs {
+      ebiten.VibrateGamepad(id, &ebiten.VibrateGamepadOptions{
+        Duration: 50 * time.Millisecond,
+        StrongMagnitude: 1,
+        WeakMagnitude: 1,
+      })
+    }
+  }
+
+  // hold backspace to rewind, one snapshot per frame
+  if ebiten.IsKeyPressed(ebiten.KeyBackspace) {
+    if !g.rewinding {
+      g.rewinding = g.cpu.StartRewind()
+    }
+    if g.rewinding {
+      g.cpu.RewindStep()
+    }
+  } else if g.rewinding {
+    g.cpu.StopRewind()
+    g.rewinding = false
+  }
+
+  if inpututil.IsKeyJustPressed(ebiten.KeyP) {
+    path, err := g.cpu.SaveScreenshot(g.ScreenshotScale)
+    if err != nil {
+      log.Printf("screenshot: %v", err)
+    } else {
+      log.Printf("saved screenshot to %s", path)
+    }
+  }
+
+  // F1-F9 load a save state slot, shift+F1-F9 save to it
+  for i, key := range stateKeys {
+    if !inpututil.IsKeyJustPressed(key) {
+      continue
+    }
+    slot := i + 1
+    if ebiten.IsKeyPressed(ebiten.KeyShift) {
+      path, err := g.cpu.SaveStateSlot(slot)
+      if err != nil {
+        log.Printf("save state: %v", err)
+      } else {
+        log.Printf("saved state to %s", path)
+      }
+    } else {
+      path, err := g.cpu.LoadStateSlot(slot)
+      if err != nil {
+        log.Printf("load state: %v", err)
+      } else {
+        log.Printf("loaded state from %s", path)
+      }
+    }
+  }
+
+  if inpututil.IsKeyJustPressed(ebiten.KeyR) {
+    path, err := g.cpu.ToggleRecording(g.RecordStems)
+    if err != nil {
+      log.Printf("recording: %v", err)
+    } else if path != "" {
+      log.Printf("recording audio to %s", path)
+    } else {
+      log.Printf("stopped recording audio")
+    }
+  }
+  return nil
+}
+
+func (g *Game) Draw(screen *ebiten.Image) {
+  for index, element := range g.cpu.Screen() {
+    op := &ebiten.DrawImageOptions{}
+    y := int(index / 160)
+    x := int(index % 160)
+    op.GeoM.Translate(float64(x*5),float64(y*5))
+    screen.DrawImage(pixels[element & 0x03], op)
+  }
+}
+
+func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
+  // TODO: abstract this away.
+  return 800, 720
+}
+
+func NewEbitenGame(gb *cpu.Cpu, enableAudio bool) (*Game, error) {
+  keyboard := make(map[string]ebiten.Key)
+  keyboard["up"] = ebiten.KeyW
+  keyboard["down"] = ebiten.KeyS
+  keyboard["left"] = ebiten.KeyA
+  keyboard["right"] = ebiten.KeyD
+  keyboard["a"] = ebiten.KeyK
+  keyboard["b"] = ebiten.KeyJ
+  keyboard["start"] = ebiten.KeyI
+  keyboard["select"] = ebiten.KeyU
+
+  g := &Game{
+    cpu: gb,
+    keyboard: keyboard,
+    ScreenshotScale: 1,
+  }
+
+  gb.OnRumble(func(on bool) {
+    g.rumbling.Store(on)
+  })
+
+  // the player pulls samples out of the APU's ring buffer, which
+  // in turn throttles cpu.Execute
+  if enableAudio {
+    audioContext := audio.NewContext(cpu.AudioSampleRate)
+    player, err := audioContext.NewPlayer(gb.EnableAudio(cpu.AudioSampleRate))
+    if err != nil {
+      return nil, err
+    }
+    player.SetBufferSize(20 * time.Millisecond)
+    player.Play()
+    g.player = player
+  }
+  return g, nil
+}
@@ -0,0 +1,23 @@
+#!/bin/bash
+# traces blargg's cpu_instrs ROMs and checks the logs against gameboy-doctor's
+# reference logs, e.g. for just 03-op sp,hl.gb
+#   scripts/run_doctor.sh 3
+# or all 11 with no argument. expects ../gameboy_resources like the Makefile
+# (RESOURCES=... to change that). logs are left in /tmp/gameboy-doctor-N.log
+
+RESOURCES=${RESOURCES:-../gameboy_resources}
+TESTS=${1:-`seq 1 11`}
+
+go build -o /tmp/gameboy-headless ./cmd/headless || exit 2
+
+failed=0
+for n in $TESTS; do
+  rom=`ls ${RESOURCES}/gb-test-roms/cpu_instrs/individual/$(printf %02d $n)-*.gb`
+  log=/tmp/gameboy-doctor-$n.log
+  echo "***GAMEBOY DOCTOR: `basename "$rom"`"
+  /tmp/gameboy-headless -file "$rom" -test-rom -trace $log > /dev/null
+  python3 ${RESOURCES}/gameboy-doctor/gameboy-doctor $log cpu_instrs $n || failed=$((failed+1))
+done
+
+echo "DONE WITH TEST: $failed failed"
+[ $failed -eq 0 ]
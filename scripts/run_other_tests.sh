@@ -1,12 +1,16 @@
-trap printout SIGINT
-printout() {
-    echo "DONE WITH TEST"
-}
+#!/bin/bash
+# same as run_test_roms.sh but for the ROMs listed in other_tests.txt
 
-ROMDIR=$1
+FRAMES=${FRAMES:-3600}
 
+go build -o /tmp/gameboy-headless ./cmd/headless || exit 2
+
+failed=0
 IFS=$'\n'
 for file in `cat other_tests.txt`; do
   echo "***CPU INSTR TEST: `basename $file`"
-  ~/projects/2023/gameboy/app -file $file -bootrom -fast
+  /tmp/gameboy-headless -file $file -frames $FRAMES -test-rom || failed=$((failed+1))
 done
+
+echo "DONE WITH TEST: $failed failed"
+[ $failed -eq 0 ]
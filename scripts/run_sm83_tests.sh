@@ -1,8 +1,10 @@
 #!/bin/bash
-
+# runs the SM83 single step tests, one subtest per opcode file, e.g.
+#   scripts/run_sm83_tests.sh ../gameboy_resources/jsmoo/misc/tests/GeneratedTests/sm83/v1
+# add -sm83-cycles=false to only check the state after each instruction
 # fyi had to rename cb \XX.json -> cb_XX.json before running this
 
-for file in `ls ../../../gameboy_resources/jsmoo/misc/tests/GeneratedTests/sm83/v1/*.json`;
-  do echo $file >> test.out
-  printf %s `go test -file $file | wc -l` >> test.out
-done
+DIR=${1:-../gameboy_resources/jsmoo/misc/tests/GeneratedTests/sm83/v1}
+shift
+
+go test ./internal/cpu -run TestCpu -sm83 "$DIR" "$@" 2>&1 | tee test.out | grep -E "^\s+--- FAIL|^ok|^FAIL"
@@ -1,15 +1,27 @@
-trap printout SIGINT
-printout() {
-    echo "DONE WITH TEST"
-}
+#!/bin/bash
+# runs every blargg or mooneye ROM in a directory headless, e.g.
+#   scripts/run_test_roms.sh ~/gameboy_resources/cpu_instrs/individual
+# or just the ones matching some patterns, e.g.
+#   scripts/run_test_roms.sh ~/gameboy_resources/mts/acceptance 'halt_ime*.gb'
+# exits non-zero if any of them fail
 
 ROMDIR=$1
+shift
+if [ $# -eq 0 ]; then
+  set -- '*.gb'
+fi
+FRAMES=${FRAMES:-3600}
 
-#cd ~/projects/2023/gameboy_resources/gameboy-doctor
+go build -o /tmp/gameboy-headless ./cmd/headless || exit 2
+
+failed=0
 IFS=$'\n'
-for file in `ls ${ROMDIR}/*.gb`; do
-  echo "***CPU INSTR TEST: `basename $file`"
-  ~/projects/2023/gameboy/app -file $file -bootrom -fast
+for pattern in "$@"; do
+  for file in `ls ${ROMDIR}/${pattern}`; do
+    echo "***CPU INSTR TEST: `basename $file`"
+    /tmp/gameboy-headless -file $file -frames $FRAMES -test-rom || failed=$((failed+1))
+  done
 done
 
-#cd -
+echo "DONE WITH TEST: $failed failed"
+[ $failed -eq 0 ]